@@ -14,6 +14,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 	"tp-sistemas-distribuidos/client/utils"
 )
 
@@ -23,50 +24,83 @@ const (
 )
 
 type ClientConfig struct {
-	Id             int
-	ServerAddress  string
-	MoviesFile     string
-	ReviewsFile    string
-	CreditsFile    string
-	MaxBatchMovie  int
-	MaxBatchReview int
-	MaxBatchCredit int
-	sleep          int
-}
-
-func NewClientConfig(id int, serverAddress, moviesFile, reviewsFile, creditsFile string, maxBatchMovie, maxBatchReview, maxBatchCredits, sleep int) ClientConfig {
-	return ClientConfig{
-		Id:             id,
-		ServerAddress:  serverAddress,
-		MoviesFile:     moviesFile,
-		ReviewsFile:    reviewsFile,
-		CreditsFile:    creditsFile,
-		MaxBatchMovie:  maxBatchMovie,
-		MaxBatchReview: maxBatchReview,
-		MaxBatchCredit: maxBatchCredits,
-		sleep:          sleep,
-	}
+	Id int `env:"CLI_ID" json:"client_id" required:"true" min:"1"`
+	// Gateways the client can use, the session is resumed through another one if the connection is lost
+	ServerAddresses   []string      `env:"SERVER_ADDRESSES" json:"server_addresses" default:"gateway:12345"`
+	ReconnectAttempts int           `env:"RECONNECT_ATTEMPTS" json:"reconnect_attempts" default:"10" min:"0"`
+	ReconnectDelay    time.Duration `env:"RECONNECT_DELAY" json:"reconnect_delay" default:"2s"`
+	MoviesFile        string        `env:"MOVIES_FILE" json:"movies_file" required:"true"`
+	ReviewsFile       string        `env:"REVIEWS_FILE" json:"reviews_file" required:"true"`
+	CreditsFile       string        `env:"CREDITS_FILE" json:"credits_file" required:"true"`
+	MaxBatchMovie     int           `env:"MOVIES_BATCH" json:"movies_batch" default:"30" min:"1"`
+	MaxBatchReview    int           `env:"REVIEWS_BATCH" json:"reviews_batch" default:"300" min:"1"`
+	MaxBatchCredit    int           `env:"CREDITS_BATCH" json:"credits_batch" default:"30" min:"1"`
 }
 
 type Client struct {
-	config ClientConfig
-	conn   net.Conn
+	config    ClientConfig
+	mu        sync.Mutex
+	conn      net.Conn
+	sessionID string
+	next      int // the address tried first
 }
 
 func NewClient(config ClientConfig) *Client {
 	return &Client{
 		config: config,
+		// Clients start on different gateways to spread the load
+		next: config.Id - 1,
+	}
+}
+
+// connect opens the session through the first gateway that answers, starting from the next address
+func (c *Client) connect() (models.Welcome, error) {
+	addresses := c.config.ServerAddresses
+	if len(addresses) == 0 {
+		return models.Welcome{}, errors.New("no gateway addresses configured")
 	}
+
+	var errs []error
+	for i := range addresses {
+		address := addresses[(c.next+i)%len(addresses)]
+		welcome, err := c.handshake(address)
+		if err == nil {
+			c.next = (c.next + i) % len(addresses)
+			slog.Info("client connected to server", slog.String("serverAddress", address))
+			return welcome, nil
+		}
+		slog.Warn("gateway unavailable", slog.String("address", address), slog.String("error", err.Error()))
+		errs = append(errs, err)
+	}
+	return models.Welcome{}, fmt.Errorf("no gateway available: %w", errors.Join(errs...))
 }
 
-func (c *Client) connect() error {
-	conn, err := net.Dial("tcp", c.config.ServerAddress)
+func (c *Client) handshake(address string) (models.Welcome, error) {
+	conn, err := net.Dial("tcp", address)
 	if err != nil {
-		slog.Error("error connecting to server", slog.String("error", err.Error()))
-		return err
+		return models.Welcome{}, err
 	}
+	c.mu.Lock()
 	c.conn = conn
-	return nil
+	c.mu.Unlock()
+
+	// The gateway opens a session, or resumes the previous one of this client
+	if err := communication.SendHello(conn, models.Hello{SessionID: c.sessionID}); err != nil {
+		c.close()
+		return models.Welcome{}, err
+	}
+	welcome, err := communication.RecvWelcome(conn)
+	for err == nil && welcome.Position > 0 {
+		slog.Info("gateway at capacity, waiting for admission", slog.Int("position", welcome.Position))
+		welcome, err = communication.RecvWelcome(conn)
+	}
+	if err != nil {
+		c.close()
+		return models.Welcome{}, err
+	}
+	c.sessionID = welcome.SessionID
+	slog.Info("session opened", slog.String("session id", welcome.SessionID), slog.Bool("resumed", welcome.Resumed))
+	return welcome, nil
 }
 
 func (c *Client) sigtermHandler(ctx context.Context, finishedChan chan bool) {
@@ -81,6 +115,8 @@ func (c *Client) sigtermHandler(ctx context.Context, finishedChan chan bool) {
 }
 
 func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.conn != nil {
 		err := c.conn.Close()
 		if err != nil && !errors.Is(err, net.ErrClosed) {
@@ -91,43 +127,75 @@ func (c *Client) close() {
 
 func (c *Client) Start() {
 	finishedChan := make(chan bool)
-	wg := &sync.WaitGroup{}
 	// SIGINT and SIGTERM signal handling
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
 	go c.sigtermHandler(ctx, finishedChan)
+	defer c.close()
 
-	err := c.connect()
-	if err != nil {
-		slog.Error("error starting client", slog.String("error", err.Error()))
-		return
+	attempts := 0
+	for ctx.Err() == nil {
+		welcome, err := c.connect()
+		if err != nil {
+			attempts++
+			if attempts > c.config.ReconnectAttempts {
+				slog.Error("error starting client", slog.String("error", err.Error()))
+				return
+			}
+			slog.Warn("retrying to reach a gateway", slog.Int("attempt", attempts), slog.String("error", err.Error()))
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.config.ReconnectDelay):
+			}
+			continue
+		}
+		attempts = 0
+
+		if c.runSession(ctx, welcome) {
+			break
+		}
+		c.close()
+		// The gateway that failed is tried last
+		c.next++
+		slog.Warn("connection to the gateway lost, resuming the session", slog.String("session id", c.sessionID))
 	}
-	defer c.close()
+	close(finishedChan)
+	slog.Info("Shutting down client")
+}
 
-	slog.Info("client connected to server", slog.String("serverAddress", c.config.ServerAddress))
+// runSession uploads what the gateway is missing and receives the results. It returns false if the
+// connection was lost before the job was over
+func (c *Client) runSession(ctx context.Context, welcome models.Welcome) bool {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
 
+	wg := &sync.WaitGroup{}
+	finished := false
 	wg.Add(1)
-	go c.RecvAnswers(wg, ctx)
-	c.sendAllData()
+	go func() {
+		defer wg.Done()
+		finished = c.RecvAnswers(ctx, conn)
+	}()
+	c.sendAllData(conn, welcome.Uploaded)
 	wg.Wait()
-	close(finishedChan)
-	slog.Info("Shutting down client")
+	return finished
 }
 
-func (c *Client) sendAllData() {
-	MovieSender := NewSender(&c.conn, c.config.MoviesFile, c.config.MaxBatchMovie, utils.NewMoviesReader, "movies")
+func (c *Client) sendAllData(conn net.Conn, uploaded map[string]models.UploadProgress) {
+	MovieSender := NewSender(&conn, c.config.MoviesFile, c.config.MaxBatchMovie, utils.NewMoviesReader, "movies", uploaded["movies"])
 	if err := MovieSender.Send(); err != nil {
 		c.checkSendError(err, "error sending movies")
 		return
 	}
-	ReviewSender := NewSender(&c.conn, c.config.ReviewsFile, c.config.MaxBatchReview, utils.NewReviewReader, "reviews")
+	ReviewSender := NewSender(&conn, c.config.ReviewsFile, c.config.MaxBatchReview, utils.NewReviewReader, "reviews", uploaded["reviews"])
 	if err := ReviewSender.Send(); err != nil {
 		c.checkSendError(err, "error sending reviews")
 		return
 	}
 
-	CreditsSender := NewSender(&c.conn, c.config.CreditsFile, c.config.MaxBatchCredit, utils.NewCreditsReader, "credits")
+	CreditsSender := NewSender(&conn, c.config.CreditsFile, c.config.MaxBatchCredit, utils.NewCreditsReader, "credits", uploaded["credits"])
 	if err := CreditsSender.Send(); err != nil {
 		c.checkSendError(err, "error sending credits")
 		return
@@ -170,32 +238,39 @@ func (c *Client) writeQueryResults(queriesResults map[int][]models.QueryResult)
 	}
 }
 
-func (c *Client) RecvAnswers(wg *sync.WaitGroup, ctx context.Context) {
+// RecvAnswers receives the results until every query is over. The gateway sends again the results of a
+// resumed session, so they are collected from scratch on every connection. It returns false if the
+// connection was lost before
+func (c *Client) RecvAnswers(ctx context.Context, conn net.Conn) bool {
 	queriesReceived := make([]bool, 0) // Array to store when we get the complete query
 	queriesResults := make(map[int][]models.QueryResult)
-	defer wg.Done()
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return true
 		default:
 			if len(queriesReceived) == TotalQueries {
 				slog.Info("All queries received")
 				c.writeQueryResults(queriesResults)
-				return
+				return true
 			}
 
-			results, err := communication.RecvQueryResults(c.conn)
+			results, err := communication.RecvQueryResults(conn)
 			if err != nil {
 				if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
 					slog.Info("Server closed connection")
-					return
+					return false
 				}
 				if errors.Is(err, net.ErrClosed) {
-					return
+					return ctx.Err() != nil
 				}
 				slog.Error("error receiving query results", slog.String("error", err.Error()))
-				return
+				return false
+			}
+			if results.Rejected != "" {
+				slog.Error("session rejected by the gateway", slog.String("reason", results.Rejected))
+				c.close()
+				return true
 			}
 
 			if results.Last {
@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"net"
 	"pkg/communication"
+	"pkg/models"
 	"tp-sistemas-distribuidos/client/utils"
 )
 
@@ -14,24 +15,40 @@ type Sender[T any] struct {
 	newReader func(string, int) (utils.BatchReader[T], error)
 	path      string
 	batchSize int
+	uploaded  models.UploadProgress // what the gateway already has
 }
 
-func NewSender[T any](conn *net.Conn, path string, batchSize int, newReader func(string, int) (utils.BatchReader[T], error), dataType string) *Sender[T] {
+func NewSender[T any](conn *net.Conn, path string, batchSize int, newReader func(string, int) (utils.BatchReader[T], error), dataType string, uploaded models.UploadProgress) *Sender[T] {
 	return &Sender[T]{
 		conn:      conn,
 		dataType:  dataType,
 		newReader: newReader,
 		path:      path,
 		batchSize: batchSize,
+		uploaded:  uploaded,
 	}
 }
 
 func (s *Sender[T]) Send() error {
+	if s.uploaded.Done {
+		slog.Info(fmt.Sprintf("All %s were already uploaded", s.dataType))
+		return nil
+	}
 	reader, err := s.newReader(s.path, s.batchSize)
 	if err != nil {
 		return fmt.Errorf("error creating %s reader: %w", s.dataType, err)
 	}
 
+	// The batches are read the same way every time, so the ones the gateway has are skipped
+	for skipped := uint64(0); skipped < s.uploaded.Batches && !reader.Finished(); skipped++ {
+		if _, err := reader.ReadBatch(); err != nil {
+			return fmt.Errorf("error skipping uploaded %s: %w", s.dataType, err)
+		}
+	}
+	if s.uploaded.Batches > 0 {
+		slog.Info(fmt.Sprintf("Resuming %s upload", s.dataType), slog.Uint64("skipped batches", s.uploaded.Batches))
+	}
+
 	total, err := sendAllData(reader, *s.conn)
 	if err != nil {
 		return fmt.Errorf("error sending %s: %w", s.dataType, err)
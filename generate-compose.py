@@ -3,9 +3,13 @@ import sys
 
 YAML_FILE = "docker-compose.yaml"
 
-# nodos que inyectan JOINER_SHARDS automáticamente
+# nodos que inyectan JOINER_SHARDS automáticamente (el gateway también, como primer anillo de joiners)
 NEEDS_SHARDS = {"preprocessor", "production-filter"}
 
+# nodos sin estado que procesan con un pool de workers. Los nodos siguientes cuentan por peso y no por
+# orden, asi que el orden por cliente solo se pide para los nodos listados en "per_client_order"
+POOLED = {"preprocessor", "production-filter", "year-filter", "sentiment-analyzer"}
+
 QUERY_AMNT = 5
 
 # plantillas
@@ -16,13 +20,21 @@ BASE_NODE = """
       args:
         NODE: {node}
     container_name: {svc_name}
+    stop_grace_period: 15s
     environment:
       - RABBITMQ_DEFAULT_USER=monke
-      - RABBITMQ_DEFAULT_PASS=joaco1{extra_env}
+      - RABBITMQ_DEFAULT_PASS=joaco1
+      - NODE_ID={svc_name}
+      - WATCHDOG_ADDRS={watchdogs}{extra_env}{volumes}
     depends_on:
       rabbitmq:
         condition: service_healthy
         restart: true
+    healthcheck:
+      test: ["CMD", "wget", "-q", "-O", "/dev/null", "http://localhost:8081/health/ready"]
+      interval: 5s
+      timeout: 3s
+      retries: 3
 """
 
 CLIENT_NODE = """
@@ -34,30 +46,40 @@ CLIENT_NODE = """
       - CLI_ID={idx}
       - MOVIES_FILE={movies_file}
       - REVIEWS_FILE={reviews_file}
-      - CREDITS_FILE={credits_file}
-    depends_on:
-      - gateway
+      - CREDITS_FILE={credits_file}{servers}
+    depends_on:{gateways}
     volumes:
       - ./archive/:/home/app/archive/
       - ./client-results/:/home/app/results/
 """
 
 FINAL_REDUCER_NODE = """
-  final-reducer-q{idx}:
+  {svc_name}:
     build:
       dockerfile: ./server/Dockerfile
       args:
         NODE: final-reducer
-    container_name: final-reducer-q{idx}
+    container_name: {svc_name}
+    stop_grace_period: 15s
     environment:
       - RABBITMQ_DEFAULT_USER=monke
       - RABBITMQ_DEFAULT_PASS=joaco1
+      - NODE_ID={svc_name}
+      - WATCHDOG_ADDRS={watchdogs}
       - QUERY_NUM={idx}
       - JOINER_SHARDS={joiners}
+      - STATE_DIR=/state{replica_env}
+    volumes:
+      - ./state/{svc_name}/:/state/
     depends_on:
       rabbitmq:
         condition: service_healthy
         restart: true
+    healthcheck:
+      test: ["CMD", "wget", "-q", "-O", "/dev/null", "http://localhost:8081/health/ready"]
+      interval: 5s
+      timeout: 3s
+      retries: 3
 """
 
 JOINER_NODE = """
@@ -67,14 +89,45 @@ JOINER_NODE = """
       args:
         NODE: joiner
     container_name: joiner-{idx}
+    stop_grace_period: 15s
     environment:
       - RABBITMQ_DEFAULT_USER=monke
       - RABBITMQ_DEFAULT_PASS=joaco1
+      - NODE_ID=joiner-{idx}
+      - WATCHDOG_ADDRS={watchdogs}
       - JOINER_ID={idx}
+      - STATE_DIR=/state
+    volumes:
+      - ./state/joiner-{idx}/:/state/
     depends_on:
       rabbitmq:
         condition: service_healthy
         restart: true
+    healthcheck:
+      test: ["CMD", "wget", "-q", "-O", "/dev/null", "http://localhost:8081/health/ready"]
+      interval: 5s
+      timeout: 3s
+      retries: 3
+"""
+
+# las replicas del watchdog eligen un lider, que reinicia los contenedores que dejan de mandar heartbeats
+# usando el socket de docker
+WATCHDOG_NODE = """
+  watchdog-{idx}:
+    build:
+      dockerfile: ./server/Dockerfile
+      args:
+        NODE: watchdog
+    container_name: watchdog-{idx}
+    environment:
+      - NODE_ID=watchdog-{idx}
+      - WATCHDOG_ID={idx}
+      - WATCHDOG_PEERS={peers}
+      - WATCHDOG_ADDRS={watchdogs}
+      - RESTART_ACTION=docker
+      - WATCHED_NODES={watched}
+    volumes:
+      - /var/run/docker.sock:/var/run/docker.sock
 """
 
 RABBITMQ_SERVICE = """
@@ -100,15 +153,30 @@ def create_compose(cfg):
     clients = cfg["clients"]
     joiners = cfg["joiners"]
     nodes    = cfg["nodes"]    # dict: { "preprocessor": n, "production-filter": m, ... }
+    workers  = cfg.get("workers", {})  # dict opcional: { "sentiment-analyzer": n, ... }
+    ordered  = set(cfg.get("per_client_order", []))  # lista opcional de nodos que procesan en orden por cliente
+    replicas = cfg.get("watchdogs", 1)
+    standby  = cfg.get("final_reducer_standby", False)  # agrega un final reducer standby por query
+    gateways = cfg.get("gateways", 1)  # con mas de uno, comparten el estado y los clientes pasan de uno a otro si se cae
 
-    compose = "name: tp-dist\nservices:\n"
+    watchdog_names = [f"watchdog-{w}" for w in range(1, replicas+1)]
+    watchdogs = ",".join(f"{name}:9000" for name in watchdog_names)
 
-    # Gateway
-    compose += BASE_NODE.format(
-        svc_name="gateway",
-        node="gateway",
-        extra_env=""
-    )
+    compose = "name: tp-dist\nservices:\n"
+    gateway_names = [f"gateway-{g}" for g in range(1, gateways+1)] if gateways > 1 else ["gateway"]
+    watched = list(gateway_names)
+
+    # Gateways
+    for g, name in enumerate(gateway_names):
+        alias = "\n    networks:\n      default:\n        aliases:\n          - gateway" if gateways > 1 else ""
+        state = "gateway" if gateways > 1 else name
+        compose += BASE_NODE.format(
+            svc_name=name,
+            node="gateway",
+            watchdogs=watchdogs,
+            extra_env=f"\n      - STATE_DIR=/state\n      - ADMIN_PORT=8090\n      - JOINER_SHARDS={joiners}",
+            volumes=f"\n    ports:\n      - \"{8090+g}:8090\"\n    volumes:\n      - ./state/{state}/:/state/{alias}"
+        )
 
     # RabbitMQ
     compose += RABBITMQ_SERVICE
@@ -118,26 +186,44 @@ def create_compose(cfg):
         for i in range(1, count+1):
             svc_name = f"{node}-{i}" if count > 1 else node
             extra = f"\n      - JOINER_SHARDS={joiners}" if node in NEEDS_SHARDS else ""
-            compose += BASE_NODE.format(svc_name=svc_name, node=node, extra_env=extra)
+            if node in POOLED:
+                extra += f"\n      - WORKERS={workers.get(node, 1)}\n      - PER_CLIENT_ORDER={str(node in ordered).lower()}"
+            compose += BASE_NODE.format(svc_name=svc_name, node=node, watchdogs=watchdogs, extra_env=extra, volumes="")
+            watched.append(svc_name)
 
     # Final Reducer
     for q in range(2, QUERY_AMNT+1):
-        compose += FINAL_REDUCER_NODE.format(idx=q, joiners=joiners)
+        names = [f"final-reducer-q{q}", f"final-reducer-q{q}-standby"] if standby else [f"final-reducer-q{q}"]
+        for replica_id, name in enumerate(names, start=1):
+            replica_env = f"\n      - REPLICAS={len(names)}\n      - REPLICA_ID={replica_id}" if standby else ""
+            compose += FINAL_REDUCER_NODE.format(svc_name=name, idx=q, joiners=joiners, watchdogs=watchdogs, replica_env=replica_env)
+            watched.append(name)
 
     # Joiners
     for j in range(1, joiners+1):
-        compose += JOINER_NODE.format(idx=j)
+        compose += JOINER_NODE.format(idx=j, watchdogs=watchdogs)
+        watched.append(f"joiner-{j}")
+
+    # Watchdogs
+    watched += watchdog_names
+    peers = ",".join(f"{w}={name}:9100" for w, name in enumerate(watchdog_names, start=1))
+    for w in range(1, replicas+1):
+        compose += WATCHDOG_NODE.format(idx=w, peers=peers, watchdogs=watchdogs, watched=",".join(watched))
 
     # Clients
     print(f"   • clients ×{clients}")
+    depends = "".join(f"\n      {name}:\n        condition: service_healthy" for name in gateway_names)
+    servers = "\n      - SERVER_ADDRESSES=" + ",".join(f"{name}:12345" for name in gateway_names) if gateways > 1 else ""
     for c in range(1, clients+1):
         review_file = "archive/ratings.csv" if c % 2 == 1 else "archive/ratings_small.csv" # Multiples of 2 use small dataset
-        compose += CLIENT_NODE.format(idx=c, movies_file="archive/movies_metadata.csv", reviews_file=review_file, credits_file="archive/credits.csv")
+        compose += CLIENT_NODE.format(idx=c, movies_file="archive/movies_metadata.csv", reviews_file=review_file, credits_file="archive/credits.csv", servers=servers, gateways=depends)
 
     with open(YAML_FILE, "w") as f:
         f.write(compose)
 
+    print(f"   • gateways ×{gateways}")
     print(f"   • joiners ×{joiners}")
+    print(f"   • watchdogs ×{replicas}")
     for node, count in nodes.items():
         print(f"   • {node} ×{count}")
 
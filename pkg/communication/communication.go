@@ -149,3 +149,28 @@ func recvResults(conn net.Conn) (models.RawQueryResults, error) {
 
 	return results, nil
 }
+
+func sendMessage(conn net.Conn, message any) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("error marshalling message: %w", err)
+	}
+	return sendFixedSize(conn, data)
+}
+
+func recvMessage(conn net.Conn, message any) error {
+	sizeBuf, err := RecvAll(conn, size)
+	if err != nil {
+		return fmt.Errorf("error reading size: %w", err)
+	}
+
+	dataBuf, err := RecvAll(conn, int(binary.BigEndian.Uint32(sizeBuf)))
+	if err != nil {
+		return fmt.Errorf("error reading data: %w", err)
+	}
+
+	if err := json.Unmarshal(dataBuf, message); err != nil {
+		return fmt.Errorf("error unmarshalling message: %w", err)
+	}
+	return nil
+}
@@ -50,15 +50,9 @@ func RecvBatch[T any](conn net.Conn) (models.RawBatch[T], error) {
 }
 
 func SendQueryResults(conn net.Conn, results models.TotalQueryResults) error {
-	itemsJson, err := json.Marshal(results.Items)
+	rawResults, err := EncodeQueryResults(results)
 	if err != nil {
-		return fmt.Errorf("error marshalling query results: %w", err)
-	}
-
-	rawResults := models.RawQueryResults{
-		QueryId: results.QueryId,
-		Items:   itemsJson,
-		Last:    results.Last,
+		return err
 	}
 
 	err = sendResults(conn, rawResults)
@@ -69,6 +63,28 @@ func SendQueryResults(conn net.Conn, results models.TotalQueryResults) error {
 	return nil
 }
 
+// SendRawQueryResults sends results that are already encoded, like the ones stored by the gateway
+func SendRawQueryResults(conn net.Conn, results models.RawQueryResults) error {
+	if err := sendResults(conn, results); err != nil {
+		return fmt.Errorf("error sending query responose: %w", err)
+	}
+	return nil
+}
+
+func EncodeQueryResults(results models.TotalQueryResults) (models.RawQueryResults, error) {
+	itemsJson, err := json.Marshal(results.Items)
+	if err != nil {
+		return models.RawQueryResults{}, fmt.Errorf("error marshalling query results: %w", err)
+	}
+
+	return models.RawQueryResults{
+		QueryId:  results.QueryId,
+		Items:    itemsJson,
+		Last:     results.Last,
+		Rejected: results.Rejected,
+	}, nil
+}
+
 func unmarshalSlice[T models.QueryResult](data []byte) ([]models.QueryResult, error) {
 	if data == nil {
 		return nil, nil
@@ -86,13 +102,21 @@ func unmarshalSlice[T models.QueryResult](data []byte) ([]models.QueryResult, er
 }
 
 func RecvQueryResults(conn net.Conn) (models.TotalQueryResults, error) {
-	var totalResults models.TotalQueryResults
 	results, err := recvResults(conn)
 	if err != nil {
-		return totalResults, fmt.Errorf("error receiving query response: %w", err)
+		return models.TotalQueryResults{}, fmt.Errorf("error receiving query response: %w", err)
 	}
+	return DecodeQueryResults(results)
+}
 
+func DecodeQueryResults(results models.RawQueryResults) (models.TotalQueryResults, error) {
+	var totalResults models.TotalQueryResults
 	var resultsArr []models.QueryResult
+	var err error
+	if results.Rejected != "" {
+		totalResults.Rejected = results.Rejected
+		return totalResults, nil
+	}
 	// Must unmarshal the items to the correct type
 	switch results.QueryId {
 	case 1:
@@ -118,3 +142,34 @@ func RecvQueryResults(conn net.Conn) (models.TotalQueryResults, error) {
 	totalResults.Last = results.Last
 	return totalResults, nil
 }
+
+// SendHello opens a session, or resumes it when the hello carries the id of a previous one
+func SendHello(conn net.Conn, hello models.Hello) error {
+	if err := sendMessage(conn, hello); err != nil {
+		return fmt.Errorf("error sending hello: %w", err)
+	}
+	return nil
+}
+
+func RecvHello(conn net.Conn) (models.Hello, error) {
+	var hello models.Hello
+	if err := recvMessage(conn, &hello); err != nil {
+		return hello, fmt.Errorf("error receiving hello: %w", err)
+	}
+	return hello, nil
+}
+
+func SendWelcome(conn net.Conn, welcome models.Welcome) error {
+	if err := sendMessage(conn, welcome); err != nil {
+		return fmt.Errorf("error sending welcome: %w", err)
+	}
+	return nil
+}
+
+func RecvWelcome(conn net.Conn) (models.Welcome, error) {
+	var welcome models.Welcome
+	if err := recvMessage(conn, &welcome); err != nil {
+		return welcome, fmt.Errorf("error receiving welcome: %w", err)
+	}
+	return welcome, nil
+}
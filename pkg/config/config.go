@@ -0,0 +1,238 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileEnv is the environment variable holding the path of an optional JSON config file
+const FileEnv = "CONFIG_FILE"
+
+const redacted = "******"
+
+// Load fills the struct pointed by cfg. Each field is described with tags:
+//
+//	env:"JOINER_SHARDS" json:"joiner_shards" default:"1" required:"true" min:"1" secret:"true"
+//
+// Values are taken from the default tag, then from the JSON file pointed by CONFIG_FILE
+// and finally from the environment. Embedded structs are loaded recursively.
+func Load(cfg any) error {
+	value := reflect.ValueOf(cfg)
+	if value.Kind() != reflect.Pointer || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to a struct, got %T", cfg)
+	}
+
+	fileValues, err := readFile(os.Getenv(FileEnv))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	forEachField(value.Elem(), func(field reflect.StructField, fieldValue reflect.Value) {
+		if err := loadField(field, fieldValue, fileValues); err != nil {
+			errs = append(errs, err)
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Log prints the effective configuration with its secrets redacted
+func Log(cfg any) {
+	slog.Info("effective config", slog.Any("config", Redacted(cfg)))
+}
+
+// Redacted returns the configuration as a map keyed by env name, with the secrets hidden
+func Redacted(cfg any) map[string]string {
+	value := reflect.Indirect(reflect.ValueOf(cfg))
+	result := make(map[string]string)
+	forEachField(value, func(field reflect.StructField, fieldValue reflect.Value) {
+		name := field.Tag.Get("env")
+		if name == "" {
+			name = field.Name
+		}
+		if field.Tag.Get("secret") == "true" && !fieldValue.IsZero() {
+			result[name] = redacted
+			return
+		}
+		result[name] = format(fieldValue)
+	})
+	return result
+}
+
+func forEachField(value reflect.Value, apply func(reflect.StructField, reflect.Value)) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			forEachField(value.Field(i), apply)
+			continue
+		}
+		apply(field, value.Field(i))
+	}
+}
+
+func loadField(field reflect.StructField, value reflect.Value, fileValues map[string]string) error {
+	env := field.Tag.Get("env")
+	raw, found := field.Tag.Lookup("default")
+
+	if key := field.Tag.Get("json"); key != "" {
+		if fileValue, ok := fileValues[key]; ok {
+			raw, found = fileValue, true
+		}
+	}
+	if env != "" {
+		if envValue, ok := os.LookupEnv(env); ok && envValue != "" {
+			raw, found = envValue, true
+		}
+	}
+
+	if !found || raw == "" {
+		if field.Tag.Get("required") == "true" {
+			return fmt.Errorf("%s is required but was not set", describe(field))
+		}
+		return nil
+	}
+
+	if err := set(value, raw); err != nil {
+		return fmt.Errorf("%s is invalid: %w", describe(field), err)
+	}
+	if err := checkMin(field, value); err != nil {
+		return fmt.Errorf("%s is invalid: %w", describe(field), err)
+	}
+	return nil
+}
+
+func checkMin(field reflect.StructField, value reflect.Value) error {
+	raw, ok := field.Tag.Lookup("min")
+	if !ok {
+		return nil
+	}
+	minimum, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad min tag %q", raw)
+	}
+	switch value.Kind() {
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		if value.Int() < minimum {
+			return fmt.Errorf("%d is lower than %d", value.Int(), minimum)
+		}
+	}
+	return nil
+}
+
+func set(value reflect.Value, raw string) error {
+	if value.Type() == reflect.TypeOf(time.Duration(0)) {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(duration))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(parsed)
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetUint(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(parsed)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(parsed)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported slice type %s", value.Type())
+		}
+		items := make([]string, 0)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+func format(value reflect.Value) string {
+	if value.Type() == reflect.TypeOf(time.Duration(0)) {
+		return time.Duration(value.Int()).String()
+	}
+	if value.Kind() == reflect.Slice {
+		return strings.Join(value.Interface().([]string), ",")
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+func describe(field reflect.StructField) string {
+	if env := field.Tag.Get("env"); env != "" {
+		return env
+	}
+	if key := field.Tag.Get("json"); key != "" {
+		return key
+	}
+	return field.Name
+}
+
+// readFile reads a flat JSON object, turning every value into its string form
+func readFile(path string) (map[string]string, error) {
+	values := make(map[string]string)
+	if path == "" {
+		return values, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file %s: %w", path, err)
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	for key, value := range raw {
+		switch v := value.(type) {
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case float64:
+			values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
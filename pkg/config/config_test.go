@@ -0,0 +1,71 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Node
+	Shards int      `env:"TEST_SHARDS" json:"shards" required:"true" min:"1"`
+	Peers  []string `env:"TEST_PEERS" json:"peers"`
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := `{"rabbitmq_user": "file-user", "rabbitmq_pass": "secret", "shards": 2, "peers": ["a", "b"], "drain_timeout": "3s"}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(FileEnv, path)
+	t.Setenv("RABBITMQ_DEFAULT_USER", "env-user")
+	t.Setenv("TEST_SHARDS", "")
+
+	var cfg testConfig
+	if err := Load(&cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		got      any
+		expected any
+	}{
+		{"env overrides file", cfg.RabbitUser, "env-user"},
+		{"file overrides default", cfg.DrainTimeout, 3 * time.Second},
+		{"default", cfg.RabbitHost, "rabbitmq"},
+		{"int from file", cfg.Shards, 2},
+		{"list from file", strings.Join(cfg.Peers, ","), "a,b"},
+	}
+	for _, test := range tests {
+		if test.got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, test.got)
+		}
+	}
+
+	if Redacted(cfg)["RABBITMQ_DEFAULT_PASS"] == "secret" {
+		t.Errorf("secret was not redacted")
+	}
+}
+
+func TestLoadValidation(t *testing.T) {
+	t.Setenv(FileEnv, "")
+	t.Setenv("RABBITMQ_DEFAULT_USER", "user")
+	t.Setenv("RABBITMQ_DEFAULT_PASS", "")
+	t.Setenv("TEST_SHARDS", "0")
+	t.Setenv("DRAIN_TIMEOUT", "soon")
+
+	var cfg testConfig
+	err := Load(&cfg)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, name := range []string{"RABBITMQ_DEFAULT_PASS", "TEST_SHARDS", "DRAIN_TIMEOUT"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected error to mention %s, got %q", name, err.Error())
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Rabbit holds the settings needed to reach the RabbitMQ broker
+type Rabbit struct {
+	RabbitUser string `env:"RABBITMQ_DEFAULT_USER" json:"rabbitmq_user" required:"true"`
+	RabbitPass string `env:"RABBITMQ_DEFAULT_PASS" json:"rabbitmq_pass" required:"true" secret:"true"`
+	RabbitHost string `env:"RABBITMQ_HOST" json:"rabbitmq_host" default:"rabbitmq"`
+	RabbitPort int    `env:"RABBITMQ_PORT" json:"rabbitmq_port" default:"5672" min:"1"`
+	// Deliveries the broker pushes to each consumer before they are acked, all of them are handled on a drain
+	Prefetch int `env:"RABBITMQ_PREFETCH" json:"rabbitmq_prefetch" default:"32" min:"1"`
+}
+
+// URL returns the amqp url of the broker, credentials included
+func (r Rabbit) URL() string {
+	return fmt.Sprintf("amqp://%s@%s", url.UserPassword(r.RabbitUser, r.RabbitPass).String(), r.Address())
+}
+
+// Address returns the host:port of the broker, without credentials
+func (r Rabbit) Address() string {
+	return net.JoinHostPort(r.RabbitHost, strconv.Itoa(r.RabbitPort))
+}
+
+// Node holds the settings shared by every server node
+type Node struct {
+	Rabbit
+	Faults
+	NodeID        string        `env:"NODE_ID" json:"node_id"`
+	WatchdogAddrs []string      `env:"WATCHDOG_ADDRS" json:"watchdog_addrs"`
+	HealthPort    string        `env:"HEALTH_PORT" json:"health_port" default:"8081"`
+	DrainTimeout  time.Duration `env:"DRAIN_TIMEOUT" json:"drain_timeout" default:"10s"`
+}
+
+// ID returns the id of the node, falling back to its hostname
+func (n Node) ID() string {
+	if n.NodeID != "" {
+		return n.NodeID
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+// Pool holds the settings of the nodes that process deliveries with a worker pool
+type Pool struct {
+	Workers        int  `env:"WORKERS" json:"workers" default:"1" min:"1"`
+	PerClientOrder bool `env:"PER_CLIENT_ORDER" json:"per_client_order" default:"false"`
+}
+
+// Persistence holds the settings of the nodes that keep their state on disk
+type Persistence struct {
+	StateDir      string `env:"STATE_DIR" json:"state_dir" default:"state"`
+	SnapshotEvery int    `env:"SNAPSHOT_EVERY" json:"snapshot_every" default:"1000" min:"1"`
+}
+
+// Sessions holds the expiry settings of the nodes that keep state per client session.
+// A session idle for longer than the ttl is evicted, a zero ttl keeps sessions forever
+type Sessions struct {
+	SessionTTL    time.Duration `env:"SESSION_TTL" json:"session_ttl" default:"30m"`
+	SweepInterval time.Duration `env:"SWEEP_INTERVAL" json:"sweep_interval" default:"1m" min:"1"`
+}
+
+// Faults holds the fault injection settings, every fault is disabled by default.
+// Rates are the probability of applying the fault to each delivery
+type Faults struct {
+	DuplicateRate float64       `env:"FAULT_DUPLICATE_RATE" json:"fault_duplicate_rate"`
+	DropRate      float64       `env:"FAULT_DROP_RATE" json:"fault_drop_rate"`
+	ReorderRate   float64       `env:"FAULT_REORDER_RATE" json:"fault_reorder_rate"`
+	DelayRate     float64       `env:"FAULT_DELAY_RATE" json:"fault_delay_rate"`
+	Delay         time.Duration `env:"FAULT_DELAY" json:"fault_delay" default:"100ms"`
+	Seed          int           `env:"FAULT_SEED" json:"fault_seed" default:"1"`
+	// CrashPoints are the named points where the node exits, as name or name@n to crash on the nth hit
+	CrashPoints []string `env:"CRASH_POINTS" json:"crash_points"`
+}
+
+// InjectsDeliveryFaults reports whether any delivery fault is enabled
+func (f Faults) InjectsDeliveryFaults() bool {
+	return f.DuplicateRate > 0 || f.DropRate > 0 || f.ReorderRate > 0 || f.DelayRate > 0
+}
@@ -14,13 +14,16 @@ type TotalQueryResults struct {
 	QueryId int           `json:"query_id"`
 	Items   []QueryResult `json:"items"`
 	Last    bool          `json:"last"`
+	// Rejected is the reason the gateway ended the session early, like a quota exceeded. It comes without results
+	Rejected string `json:"rejected,omitempty"`
 }
 
 // Struct to hold the raw query results for unmarshalling and sending
 type RawQueryResults struct {
-	QueryId int             `json:"query_id"`
-	Items   json.RawMessage `json:"items"`
-	Last    bool            `json:"last"`
+	QueryId  int             `json:"query_id"`
+	Items    json.RawMessage `json:"items"`
+	Last     bool            `json:"last"`
+	Rejected string          `json:"rejected,omitempty"`
 }
 
 type QueryResult interface {
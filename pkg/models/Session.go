@@ -0,0 +1,28 @@
+package models
+
+// Hello is the first message of a client connection. SessionID is empty to open a new session,
+// or the id given by the gateway to claim a previous one
+type Hello struct {
+	SessionID string `json:"session_id"`
+}
+
+// Welcome answers the hello with the id of the session, Resumed is false when a new one was opened.
+// While the gateway is at capacity the client waits in line: it gets a welcome without session with
+// its position every time it changes, and the session starts with the welcome at position 0.
+// A resumed session tells how much of each dataset was already uploaded, the client sends the rest
+type Welcome struct {
+	SessionID string                    `json:"session_id"`
+	Resumed   bool                      `json:"resumed"`
+	Position  int                       `json:"position,omitempty"`
+	Uploaded  map[string]UploadProgress `json:"uploaded,omitempty"`
+}
+
+// UploadProgress is how much of a dataset the gateway already has: the batches received, not
+// counting the EOF, and whether the EOF was received too. The records and bytes received are
+// kept so the quotas of a resumed upload go on from them
+type UploadProgress struct {
+	Batches uint64 `json:"batches"`
+	Done    bool   `json:"done,omitempty"`
+	Records int    `json:"records,omitempty"`
+	Bytes   int64  `json:"bytes,omitempty"`
+}
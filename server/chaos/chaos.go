@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const resultsFileFormat = "queries-results-%d.txt"
+
+type Kill struct {
+	At     time.Time
+	Target string
+	Err    error
+}
+
+// ClientReport holds the divergences of a client and the kills that happened while its job was running
+type ClientReport struct {
+	Client      int
+	Finished    bool
+	Divergences []Divergence
+	Kills       []Kill
+}
+
+type Chaos struct {
+	topology   Topology
+	targets    []string
+	killer     Killer
+	resultsDir string
+	interval   time.Duration
+	maxKills   int
+	timeout    time.Duration
+	rand       *rand.Rand
+}
+
+func NewChaos(topology Topology, targets []string, killer Killer, resultsDir string, interval time.Duration, maxKills int, timeout time.Duration, seed int64) *Chaos {
+	return &Chaos{
+		topology:   topology,
+		targets:    targets,
+		killer:     killer,
+		resultsDir: resultsDir,
+		interval:   interval,
+		maxKills:   maxKills,
+		timeout:    timeout,
+		rand:       rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Start removes the results of previous runs and launches the job with the given shell command
+func (c *Chaos) Start(command string) error {
+	old, err := filepath.Glob(filepath.Join(c.resultsDir, "queries-results-*.txt"))
+	if err != nil {
+		return err
+	}
+	for _, path := range old {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error removing old results: %w", err)
+		}
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error starting job: %w", err)
+	}
+	return nil
+}
+
+// Run kills a random target every interval until every client wrote its results or the timeout expires
+func (c *Chaos) Run(start time.Time) []Kill {
+	var kills []Kill
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	deadline := time.After(c.timeout)
+
+	for !c.allFinished(start) {
+		select {
+		case <-deadline:
+			slog.Warn("timeout waiting for the clients results")
+			return kills
+		case <-ticker.C:
+		}
+		if len(kills) >= c.maxKills {
+			continue
+		}
+
+		target := c.targets[c.rand.Intn(len(c.targets))]
+		kill := Kill{At: time.Now(), Target: target, Err: c.killer.Kill(target)}
+		if kill.Err != nil {
+			slog.Error("error killing node", slog.String("node", target), slog.String("error", kill.Err.Error()))
+		} else {
+			slog.Info("node killed", slog.String("node", target), slog.Int("kill", len(kills)+1))
+		}
+		kills = append(kills, kill)
+	}
+	return kills
+}
+
+func (c *Chaos) resultsPath(client int) string {
+	return filepath.Join(c.resultsDir, fmt.Sprintf(resultsFileFormat, client))
+}
+
+// finishedAt returns when the client wrote its results, they are written once the job ends
+func (c *Chaos) finishedAt(client int, start time.Time) (time.Time, bool) {
+	info, err := os.Stat(c.resultsPath(client))
+	if err != nil || info.ModTime().Before(start) {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
+
+func (c *Chaos) allFinished(start time.Time) bool {
+	for client := 1; client <= c.topology.Clients; client++ {
+		if _, ok := c.finishedAt(client, start); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify compares the results of every client. The kills blamed for a divergence are the ones done
+// before the client finished, a client without results is blamed on every kill
+func (c *Chaos) Verify(start time.Time, kills []Kill) ([]ClientReport, error) {
+	reports := make([]ClientReport, 0, c.topology.Clients)
+	for client := 1; client <= c.topology.Clients; client++ {
+		report := ClientReport{Client: client}
+		finishedAt, ok := c.finishedAt(client, start)
+		report.Finished = ok
+
+		for _, kill := range kills {
+			if kill.Err == nil && (!ok || kill.At.Before(finishedAt)) {
+				report.Kills = append(report.Kills, kill)
+			}
+		}
+
+		if ok {
+			actual, err := ParseResults(c.resultsPath(client))
+			if err != nil {
+				return nil, fmt.Errorf("error reading results of client %d: %w", client, err)
+			}
+			report.Divergences = Compare(actual, ExpectedFor(client))
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// PrintReport writes the outcome of every client and returns whether all of them got the expected results
+func PrintReport(w io.Writer, start time.Time, kills []Kill, reports []ClientReport) bool {
+	fmt.Fprintf(w, "Kills: %d\n", len(kills))
+	for _, kill := range kills {
+		status := "ok"
+		if kill.Err != nil {
+			status = kill.Err.Error()
+		}
+		fmt.Fprintf(w, "   +%s %s (%s)\n", kill.At.Sub(start).Round(time.Second), kill.Target, status)
+	}
+
+	passed := true
+	for _, report := range reports {
+		switch {
+		case !report.Finished:
+			passed = false
+			fmt.Fprintf(w, "client %d: ❌ no results\n", report.Client)
+		case len(report.Divergences) > 0:
+			passed = false
+			fmt.Fprintf(w, "client %d: ❌\n", report.Client)
+			for _, divergence := range report.Divergences {
+				fmt.Fprintf(w, "   Query %d: missing %d, extra %d\n", divergence.Query, len(divergence.Missing), len(divergence.Extra))
+				for _, item := range divergence.Missing {
+					fmt.Fprintf(w, "      - %s\n", item)
+				}
+				for _, item := range divergence.Extra {
+					fmt.Fprintf(w, "      + %s\n", item)
+				}
+			}
+		default:
+			fmt.Fprintf(w, "client %d: ✅\n", report.Client)
+			continue
+		}
+
+		targets := make([]string, 0, len(report.Kills))
+		for _, kill := range report.Kills {
+			targets = append(targets, fmt.Sprintf("%s (+%s)", kill.Target, kill.At.Sub(start).Round(time.Second)))
+		}
+		fmt.Fprintf(w, "   kills during the job: %s\n", strings.Join(targets, ", "))
+	}
+	return passed
+}
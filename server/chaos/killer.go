@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const nodePlaceholder = "{node}"
+
+// Killer abruptly stops a node, as a crash would
+type Killer interface {
+	Kill(node string) error
+}
+
+// DockerKiller sends SIGKILL to the container of the node
+type DockerKiller struct{}
+
+func (DockerKiller) Kill(node string) error {
+	output, err := exec.Command("docker", "kill", node).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error killing container %s: %w: %s", node, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CommandKiller runs a command to kill a node running as a local process, {node} is replaced by the node name.
+// For example: pkill -KILL -f {node}
+type CommandKiller struct {
+	command []string
+}
+
+func NewCommandKiller(command string) (*CommandKiller, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty kill command")
+	}
+	return &CommandKiller{command: args}, nil
+}
+
+func (k *CommandKiller) Kill(node string) error {
+	args := make([]string, len(k.command))
+	for i, arg := range k.command {
+		args[i] = strings.ReplaceAll(arg, nodePlaceholder, node)
+	}
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error killing %s: %w: %s", node, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
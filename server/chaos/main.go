@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"pkg/log"
+	"time"
+)
+
+// chaos kills random nodes while a job runs and checks the clients got the expected results.
+// Usage from the server module, or with make chaos from the repository root:
+//
+//	go run ./chaos -topology ../config-script.json -results ../client-results -start "make -C .. run"
+func main() {
+	topologyPath := flag.String("topology", "config-script.json", "topology used to generate the compose file")
+	resultsDir := flag.String("results", "client-results", "directory where the clients write their results")
+	killerName := flag.String("killer", "docker", "how nodes are killed: docker or command")
+	killCommand := flag.String("kill-cmd", "pkill -KILL -f {node}", "command run by the command killer")
+	start := flag.String("start", "", "shell command that starts the job, empty if it is already running")
+	interval := flag.Duration("interval", 15*time.Second, "time between kills")
+	maxKills := flag.Int("max-kills", 10, "maximum amount of kills")
+	timeout := flag.Duration("timeout", 30*time.Minute, "time to wait for the clients results")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed used to pick the nodes")
+	includeGateway := flag.Bool("include-gateway", false, "also kill the gateway")
+	flag.Parse()
+
+	logger, err := log.SetupLogger("chaos", false, nil)
+	if err != nil {
+		fmt.Printf("error creating logger: %v", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	topology, err := LoadTopology(*topologyPath)
+	if err != nil {
+		slog.Error("error loading topology", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	var killer Killer
+	switch *killerName {
+	case "docker":
+		killer = DockerKiller{}
+	case "command":
+		if killer, err = NewCommandKiller(*killCommand); err != nil {
+			slog.Error("error creating killer", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	default:
+		slog.Error("unknown killer", slog.String("killer", *killerName))
+		os.Exit(1)
+	}
+
+	targets := topology.Targets(*includeGateway)
+	chaos := NewChaos(topology, targets, killer, *resultsDir, *interval, *maxKills, *timeout, *seed)
+	slog.Info("starting chaos", slog.Int("targets", len(targets)), slog.Int64("seed", *seed))
+
+	startedAt := time.Now()
+	if *start != "" {
+		if err := chaos.Start(*start); err != nil {
+			slog.Error("error starting job", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	}
+
+	kills := chaos.Run(startedAt)
+	reports, err := chaos.Verify(startedAt, kills)
+	if err != nil {
+		slog.Error("error verifying results", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	if !PrintReport(os.Stdout, startedAt, kills, reports) {
+		os.Exit(8)
+	}
+}
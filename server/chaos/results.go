@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Expected answers of the datasets, the same used by compare_outputs.py.
+// Odd clients send the full ratings and even clients the small ones.
+var q1Expected = []string{
+	"La Cienaga | Genres: [Comedy, Drama]",
+	"Burnt Money | Genres: [Crime]",
+	"The City of No Limits | Genres: [Thriller, Drama]",
+	"Nicotina | Genres: [Drama, Action, Comedy, Thriller]",
+	"Lost Embrace | Genres: [Drama, Foreign]",
+	"Whisky | Genres: [Comedy, Drama, Foreign]",
+	"The Holy Girl | Genres: [Drama, Foreign]",
+	"The Aura | Genres: [Crime, Drama, Thriller]",
+	"Bombón: The Dog | Genres: [Drama]",
+	"Rolling Family | Genres: [Drama, Comedy]",
+	"The Method | Genres: [Drama, Thriller]",
+	"Every Stewardess Goes to Heaven | Genres: [Drama, Romance, Foreign]",
+	"Tetro | Genres: [Drama, Mystery]",
+	"The Secret in Their Eyes | Genres: [Crime, Drama, Mystery, Romance]",
+	"Liverpool | Genres: [Drama]",
+	"The Headless Woman | Genres: [Drama, Mystery, Thriller]",
+	"The Last Summer of La Boyita | Genres: [Drama]",
+	"The Appeared | Genres: [Horror, Thriller, Mystery]",
+	"The Fish Child | Genres: [Drama, Thriller, Romance, Foreign]",
+	"Cleopatra | Genres: [Drama, Comedy, Foreign]",
+	"Roma | Genres: [Drama, Foreign]",
+	"Conversations with Mother | Genres: [Comedy, Drama, Foreign]",
+	"The Education of Fairies | Genres: [Drama]",
+	"The Good Life | Genres: [Drama]",
+}
+
+var q2Expected = []string{
+	"United States of America | Budget: 120153886644",
+	"France | Budget: 2256831838",
+	"United Kingdom | Budget: 1611604610",
+	"India | Budget: 1169682797",
+	"Japan | Budget: 832585873",
+}
+
+var q4Expected = []string{
+	"Actor: Ricardo Darín | Appearances: 17",
+	"Actor: Leonardo Sbaraglia | Appearances: 7",
+	"Actor: Alejandro Awada | Appearances: 7",
+	"Actor: Inés Efron | Appearances: 7",
+	"Actor: Valeria Bertuccelli | Appearances: 7",
+	"Actor: Pablo Echarri | Appearances: 6",
+	"Actor: Rodrigo de la Serna | Appearances: 6",
+	"Actor: Rafael Spregelburd | Appearances: 6",
+	"Actor: Arturo Goetz | Appearances: 6",
+	"Actor: Diego Peretti | Appearances: 6",
+}
+
+var q5Expected = []string{
+	"Positive Avg Profit Ratio: 3587.09 | Negative Avg Profit Ratio: 25945.69",
+}
+
+var expectedFullRatings = map[int][]string{
+	1: q1Expected,
+	2: q2Expected,
+	3: {"Best Movie: ID: 125619 | Title: The forbidden education | Rating: 4.00 | Worst Movie: ID: 128598 | Title: Left for Dead | Rating: 1.00"},
+	4: q4Expected,
+	5: q5Expected,
+}
+
+var expectedSmallRatings = map[int][]string{
+	1: q1Expected,
+	2: q2Expected,
+	3: {"Best Movie: ID: 80717 | Title: Violeta Went to Heaven | Rating: 5.00 | Worst Movie: ID: 69278 | Title: Phase 7 | Rating: 2.75"},
+	4: q4Expected,
+	5: q5Expected,
+}
+
+func ExpectedFor(client int) map[int][]string {
+	if client%2 == 1 {
+		return expectedFullRatings
+	}
+	return expectedSmallRatings
+}
+
+// Divergence is a query whose results differ from the expected ones, ignoring the order
+type Divergence struct {
+	Query   int
+	Missing []string
+	Extra   []string
+}
+
+// ParseResults reads a results file written by the client, one "Query N: a, b" line per query
+func ParseResults(path string) (map[int][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	results := make(map[int][]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		header, items, ok := strings.Cut(line, ": ")
+		if !ok || !strings.HasPrefix(header, "Query ") {
+			continue
+		}
+		query, err := strconv.Atoi(strings.TrimPrefix(header, "Query "))
+		if err != nil {
+			return nil, fmt.Errorf("invalid query line %q", line)
+		}
+		results[query] = splitResults(items)
+	}
+	return results, scanner.Err()
+}
+
+// splitResults splits by the commas that are not inside the genres brackets
+func splitResults(items string) []string {
+	var results []string
+	var current strings.Builder
+	depth := 0
+	for _, char := range strings.TrimSpace(items) {
+		switch {
+		case char == '[':
+			depth++
+		case char == ']':
+			depth--
+		case char == ',' && depth == 0:
+			results = append(results, strings.TrimSpace(current.String()))
+			current.Reset()
+			continue
+		}
+		current.WriteRune(char)
+	}
+	if current.Len() > 0 {
+		results = append(results, strings.TrimSpace(current.String()))
+	}
+	return results
+}
+
+func Compare(actual, expected map[int][]string) []Divergence {
+	var divergences []Divergence
+	for query := 1; query <= queryAmount; query++ {
+		missing := difference(expected[query], actual[query])
+		extra := difference(actual[query], expected[query])
+		if len(missing) > 0 || len(extra) > 0 {
+			divergences = append(divergences, Divergence{Query: query, Missing: missing, Extra: extra})
+		}
+	}
+	return divergences
+}
+
+func difference(a, b []string) []string {
+	inB := make(map[string]bool, len(b))
+	for _, item := range b {
+		inB[item] = true
+	}
+	var diff []string
+	for _, item := range a {
+		if !inB[item] {
+			diff = append(diff, item)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
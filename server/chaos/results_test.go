@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseResultsKeepsGenresTogether(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries-results-1.txt")
+	content := "Query 1: Whisky | Genres: [Comedy, Drama, Foreign], Liverpool | Genres: [Drama]\n" +
+		"Query 5: Positive Avg Profit Ratio: 3587.09 | Negative Avg Profit Ratio: 25945.69\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+	results, err := ParseResults(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Whisky | Genres: [Comedy, Drama, Foreign]", "Liverpool | Genres: [Drama]"}, results[1])
+	require.Equal(t, q5Expected, results[5])
+}
+
+func TestCompareReportsDivergentQueries(t *testing.T) {
+	actual := map[int][]string{}
+	for query, expected := range ExpectedFor(2) {
+		actual[query] = expected
+	}
+	actual[2] = append([]string{"Argentina | Budget: 1"}, q2Expected[1:]...)
+
+	require.Equal(t, []Divergence{{
+		Query:   2,
+		Missing: []string{q2Expected[0]},
+		Extra:   []string{"Argentina | Budget: 1"},
+	}}, Compare(actual, ExpectedFor(2)))
+	require.Empty(t, Compare(ExpectedFor(1), ExpectedFor(1)))
+}
+
+func TestTargetsFollowTheComposeNames(t *testing.T) {
+	topology := Topology{Joiners: 2, Watchdogs: 1, Nodes: map[string]int{"reducer": 2, "year-filter": 1}}
+	require.Equal(t, []string{
+		"reducer-1", "reducer-2", "year-filter",
+		"final-reducer-q2", "final-reducer-q3", "final-reducer-q4", "final-reducer-q5",
+		"joiner-1", "joiner-2", "watchdog-1",
+	}, topology.Targets(false))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+const queryAmount = 5
+
+// Topology is the config-script.json used by generate-compose.py to build the compose file
+type Topology struct {
+	Clients   int            `json:"clients"`
+	Joiners   int            `json:"joiners"`
+	Watchdogs int            `json:"watchdogs"`
+	Nodes     map[string]int `json:"nodes"`
+	// FinalReducerStandby adds a standby final reducer to each query
+	FinalReducerStandby bool `json:"final_reducer_standby"`
+	Gateways            int  `json:"gateways"`
+}
+
+func LoadTopology(path string) (Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Topology{}, fmt.Errorf("error reading topology: %w", err)
+	}
+	var topology Topology
+	if err := json.Unmarshal(data, &topology); err != nil {
+		return Topology{}, fmt.Errorf("error parsing topology: %w", err)
+	}
+	if topology.Watchdogs == 0 {
+		topology.Watchdogs = 1
+	}
+	if topology.Gateways == 0 {
+		topology.Gateways = 1
+	}
+	return topology, nil
+}
+
+// Targets are the names of the nodes that can be killed, named as the containers in the compose file
+func (t Topology) Targets(includeGateway bool) []string {
+	var targets []string
+	if includeGateway && t.Gateways > 1 {
+		for g := 1; g <= t.Gateways; g++ {
+			targets = append(targets, fmt.Sprintf("gateway-%d", g))
+		}
+	} else if includeGateway {
+		targets = append(targets, "gateway")
+	}
+
+	nodes := make([]string, 0, len(t.Nodes))
+	for node := range t.Nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		count := t.Nodes[node]
+		if count == 1 {
+			targets = append(targets, node)
+			continue
+		}
+		for i := 1; i <= count; i++ {
+			targets = append(targets, fmt.Sprintf("%s-%d", node, i))
+		}
+	}
+
+	for q := 2; q <= queryAmount; q++ {
+		targets = append(targets, fmt.Sprintf("final-reducer-q%d", q))
+		if t.FinalReducerStandby {
+			targets = append(targets, fmt.Sprintf("final-reducer-q%d-standby", q))
+		}
+	}
+	for j := 1; j <= t.Joiners; j++ {
+		targets = append(targets, fmt.Sprintf("joiner-%d", j))
+	}
+	for w := 1; w <= t.Watchdogs; w++ {
+		targets = append(targets, fmt.Sprintf("watchdog-%d", w))
+	}
+	return targets
+}
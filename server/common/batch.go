@@ -1,9 +1,22 @@
 package common
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 type Header struct {
 	Weight      uint32 `json:"weight"`
 	TotalWeight int32  `json:"total_weight"` //-1 if its uknown for the moment
 	ClientID    string `json:"client_id"`
+	ProducerID  string `json:"producer_id,omitempty"`
+	Seq         uint64 `json:"seq,omitempty"` // per client and producer, starting at 1
+	// Producers is set on EOF markers: how many producers send one for the stream, 0 means a single one
+	Producers int32 `json:"producers,omitempty"`
+	// GatewayID is the gateway serving the client, its results are routed back to it
+	GatewayID string `json:"gateway_id,omitempty"`
+	// Shards are the joiner shards of the session, empty for the configured ones
+	Shards []int `json:"shards,omitempty"`
 }
 
 type Batch[T any] struct {
@@ -18,3 +31,28 @@ func (h *Header) IsEof() bool {
 func (h *Header) GetClientID() string {
 	return h.ClientID
 }
+
+// WithProducer returns a copy of the header produced by producerID, keeping its sequence number.
+// Nodes whose outputs are merged downstream with the ones of their replicas have to stamp it.
+func (h Header) WithProducer(producerID string) Header {
+	h.ProducerID = producerID
+	return h
+}
+
+// WithProducers returns a copy of the header announcing that count producers send an EOF marker.
+// Nodes that fan a stream out to shards stamp it, each shard forwards its own marker downstream.
+func (h Header) WithProducers(count int) Header {
+	h.Producers = int32(count)
+	return h
+}
+
+// HeaderOf decodes only the header of a serialized batch
+func HeaderOf(msg Message) (Header, error) {
+	var batch struct {
+		Header Header `json:"header"`
+	}
+	if err := json.Unmarshal(msg.Body, &batch); err != nil {
+		return Header{}, fmt.Errorf("error unmarshalling header: %w", err)
+	}
+	return batch.Header, nil
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+)
+
+// JoinFiltersExchange is where the joiners broadcast the movies each shard holds for a client, so the
+// preprocessors drop the reviews and credits that can not join before sending them
+const JoinFiltersExchange = "join-filters"
+
+// JoinFilter tells that the shard has every movie of the client, and which ones may be among them.
+// A filter marked done tells that the shard finished the client, its filter is not needed anymore
+type JoinFilter struct {
+	ClientID string       `json:"client_id"`
+	Shard    int          `json:"shard"`
+	Movies   *BloomFilter `json:"movies,omitempty"`
+	Done     bool         `json:"done,omitempty"`
+}
+
+// bloomFalsePositives is the rate of keys a filter lets through without holding them
+const bloomFalsePositives = 0.01
+
+// BloomFilter answers whether a key may be in a set, with no false negatives. It is sized for the
+// number of keys it is built with
+type BloomFilter struct {
+	Bits   []uint64 `json:"bits"`
+	Hashes int      `json:"hashes"`
+}
+
+func NewBloomFilter(keys []string) *BloomFilter {
+	n := max(len(keys), 1)
+	size := int(math.Ceil(-float64(n) * math.Log(bloomFalsePositives) / (math.Ln2 * math.Ln2)))
+	f := &BloomFilter{
+		Bits:   make([]uint64, (size+63)/64),
+		Hashes: max(int(math.Round(float64(size)/float64(n)*math.Ln2)), 1),
+	}
+	for _, key := range keys {
+		f.Add(key)
+	}
+	return f
+}
+
+// positions are the bits of the key, derived from two hashes of it
+func (f *BloomFilter) positions(key string) []uint64 {
+	hash := sha256.Sum256([]byte(key))
+	h1 := binary.BigEndian.Uint64(hash[:8])
+	h2 := binary.BigEndian.Uint64(hash[8:16])
+	bits := uint64(len(f.Bits) * 64)
+	positions := make([]uint64, f.Hashes)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % bits
+	}
+	return positions
+}
+
+func (f *BloomFilter) Add(key string) {
+	for _, p := range f.positions(key) {
+		f.Bits[p/64] |= 1 << (p % 64)
+	}
+}
+
+func (f *BloomFilter) MayContain(key string) bool {
+	if len(f.Bits) == 0 {
+		return true
+	}
+	for _, p := range f.positions(key) {
+		if f.Bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilterHasNoFalseNegatives(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("movie-%d", i)
+	}
+	data, err := json.Marshal(NewBloomFilter(keys))
+	require.NoError(t, err)
+	var filter BloomFilter
+	require.NoError(t, json.Unmarshal(data, &filter))
+
+	for _, key := range keys {
+		require.True(t, filter.MayContain(key))
+	}
+	falsePositives := 0
+	for i := range 10000 {
+		if filter.MayContain(fmt.Sprintf("other-%d", i)) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 300)
+
+	require.False(t, NewBloomFilter(nil).MayContain("movie-1"))
+}
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ControlExchange is where the gateway broadcasts the orders that every stateful node must follow
+const ControlExchange = "control"
+
+const (
+	// CancelSession orders the nodes to drop everything kept for a client
+	CancelSession = "cancel"
+	// MoveSession tells that the client is now served by another gateway, which gets its results
+	MoveSession = "move"
+	// RingChanged tells the gateways the joiner shards new sessions are spread over
+	RingChanged = "ring"
+	// ShardRetired tells that no session uses the drained joiner shards anymore, they can be removed
+	ShardRetired = "retired"
+)
+
+type ControlMsg struct {
+	Kind     string `json:"kind"`
+	ClientID string `json:"client_id"`
+	Gateway  string `json:"gateway,omitempty"`
+	Shards   []int  `json:"shards,omitempty"`
+}
+
+func DecodeControlMsg(body []byte) (ControlMsg, error) {
+	var msg ControlMsg
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return msg, fmt.Errorf("error unmarshalling control message: %w", err)
+	}
+	if msg.ClientID == "" && msg.Kind != RingChanged && msg.Kind != ShardRetired {
+		return msg, fmt.Errorf("control message %q has no client id", msg.Kind)
+	}
+	return msg, nil
+}
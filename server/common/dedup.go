@@ -0,0 +1,171 @@
+package common
+
+import (
+	"slices"
+	"sort"
+	"time"
+)
+
+// DedupFilter detects batches that were already processed, using the producer id and
+// sequence number of their header. It keeps a window per client and producer: every
+// sequence number up to floor was seen, and ranges hold the ones received out of order.
+// Clients closed are remembered for the ttl, so their late redeliveries are dropped too
+type DedupFilter struct {
+	windows      map[string]map[string]*seqWindow
+	closed       map[string]struct{}
+	closedExpiry *SessionExpiry
+}
+
+// seqRange are the sequence numbers from Low to High, both included
+type seqRange struct {
+	Low  uint64 `json:"low"`
+	High uint64 `json:"high"`
+}
+
+// seqWindow keeps the ranges sorted and apart from each other and from the floor, so it holds one range
+// per gap still open. Every gap is kept until it fills, a batch is never taken as seen before it arrives
+type seqWindow struct {
+	floor  uint64
+	ranges []seqRange
+}
+
+func NewDedupFilter(closedTTL time.Duration) *DedupFilter {
+	return &DedupFilter{
+		windows:      make(map[string]map[string]*seqWindow),
+		closed:       make(map[string]struct{}),
+		closedExpiry: NewSessionExpiry(closedTTL),
+	}
+}
+
+// IsDuplicate reports whether the batch was already processed and marks it as seen otherwise.
+// Batches without a sequence number are never considered duplicates.
+func (d *DedupFilter) IsDuplicate(header Header) bool {
+	if _, ok := d.closed[header.ClientID]; ok {
+		return true
+	}
+	if header.Seq == 0 {
+		return false
+	}
+
+	producers, ok := d.windows[header.ClientID]
+	if !ok {
+		producers = make(map[string]*seqWindow)
+		d.windows[header.ClientID] = producers
+	}
+	window, ok := producers[header.ProducerID]
+	if !ok {
+		window = &seqWindow{}
+		producers[header.ProducerID] = window
+	}
+	return !window.add(header.Seq)
+}
+
+// Seen reports whether the batch was already processed, without marking it as seen
+func (d *DedupFilter) Seen(header Header) bool {
+	if _, ok := d.closed[header.ClientID]; ok {
+		return true
+	}
+	if header.Seq == 0 {
+		return false
+	}
+	window, ok := d.windows[header.ClientID][header.ProducerID]
+	return ok && window.contains(header.Seq)
+}
+
+// Close drops the windows of a finished client. Any batch of the client received afterwards is a duplicate
+func (d *DedupFilter) Close(clientID string) {
+	delete(d.windows, clientID)
+	d.closed[clientID] = struct{}{}
+	d.closedExpiry.Touch(clientID)
+}
+
+// Expire forgets the clients closed for longer than the ttl, no batch of them is expected anymore
+func (d *DedupFilter) Expire() {
+	for _, clientID := range d.closedExpiry.Expired() {
+		delete(d.closed, clientID)
+	}
+}
+
+// search returns the first range ending at or after seq
+func (w *seqWindow) search(seq uint64) int {
+	return sort.Search(len(w.ranges), func(i int) bool { return w.ranges[i].High >= seq })
+}
+
+func (w *seqWindow) contains(seq uint64) bool {
+	if seq <= w.floor {
+		return true
+	}
+	i := w.search(seq)
+	return i < len(w.ranges) && w.ranges[i].Low <= seq
+}
+
+// add marks the sequence number as seen. It reports false if it already was
+func (w *seqWindow) add(seq uint64) bool {
+	if w.contains(seq) {
+		return false
+	}
+	i := w.search(seq)
+
+	joinsPrevious := i > 0 && w.ranges[i-1].High+1 == seq
+	joinsNext := i < len(w.ranges) && w.ranges[i].Low-1 == seq
+	switch {
+	case joinsPrevious && joinsNext:
+		w.ranges[i-1].High = w.ranges[i].High
+		w.ranges = slices.Delete(w.ranges, i, i+1)
+	case joinsPrevious:
+		w.ranges[i-1].High = seq
+	case joinsNext:
+		w.ranges[i].Low = seq
+	default:
+		w.ranges = slices.Insert(w.ranges, i, seqRange{seq, seq})
+	}
+
+	if w.ranges[0].Low == w.floor+1 {
+		w.floor = w.ranges[0].High
+		w.ranges = slices.Delete(w.ranges, 0, 1)
+	}
+	return true
+}
+
+// DedupState is the serializable form of a DedupFilter, used to persist it
+type DedupState struct {
+	Windows map[string]map[string]WindowState `json:"windows"`
+	Closed  []string                          `json:"closed"`
+}
+
+type WindowState struct {
+	Floor  uint64     `json:"floor"`
+	Ranges []seqRange `json:"ranges,omitempty"`
+}
+
+func (d *DedupFilter) State() DedupState {
+	state := DedupState{Windows: make(map[string]map[string]WindowState), Closed: make([]string, 0, len(d.closed))}
+	for clientID, producers := range d.windows {
+		state.Windows[clientID] = make(map[string]WindowState)
+		for producerID, window := range producers {
+			state.Windows[clientID][producerID] = WindowState{Floor: window.floor, Ranges: slices.Clone(window.ranges)}
+		}
+	}
+	for clientID := range d.closed {
+		state.Closed = append(state.Closed, clientID)
+	}
+	slices.Sort(state.Closed)
+	return state
+}
+
+// Restore replaces the windows of the filter with the ones of a persisted state. The closed clients
+// restored are kept for another ttl
+func (d *DedupFilter) Restore(state DedupState) {
+	d.windows = make(map[string]map[string]*seqWindow)
+	d.closed = make(map[string]struct{})
+	for clientID, producers := range state.Windows {
+		d.windows[clientID] = make(map[string]*seqWindow)
+		for producerID, window := range producers {
+			d.windows[clientID][producerID] = &seqWindow{floor: window.Floor, ranges: slices.Clone(window.Ranges)}
+		}
+	}
+	for _, clientID := range state.Closed {
+		d.closed[clientID] = struct{}{}
+		d.closedExpiry.Touch(clientID)
+	}
+}
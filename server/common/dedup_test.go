@@ -0,0 +1,73 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupFilter(t *testing.T) {
+	header := func(client, producer string, seq uint64) Header {
+		return Header{ClientID: client, ProducerID: producer, Seq: seq}
+	}
+
+	tests := []struct {
+		name       string
+		seen       []Header
+		header     Header
+		duplicated bool
+	}{
+		{"first batch", nil, header("c1", "p1", 1), false},
+		{"redelivered batch", []Header{header("c1", "p1", 1)}, header("c1", "p1", 1), true},
+		{"redelivered out of order batch", []Header{header("c1", "p1", 3)}, header("c1", "p1", 3), true},
+		{"out of order batch", []Header{header("c1", "p1", 3)}, header("c1", "p1", 2), false},
+		{"same seq from another producer", []Header{header("c1", "p1", 1)}, header("c1", "p2", 1), false},
+		{"same seq from another client", []Header{header("c1", "p1", 1)}, header("c2", "p1", 1), false},
+		{"batch without seq", []Header{header("c1", "p1", 0)}, header("c1", "p1", 0), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dedup := NewDedupFilter(0)
+			for _, seen := range test.seen {
+				dedup.IsDuplicate(seen)
+			}
+			require.Equal(t, test.duplicated, dedup.IsDuplicate(test.header))
+		})
+	}
+}
+
+func TestDedupFilterKeepsGapsOpen(t *testing.T) {
+	dedup := NewDedupFilter(0)
+	for seq := uint64(3); seq <= 10000; seq += 2 {
+		require.False(t, dedup.IsDuplicate(Header{ClientID: "c1", Seq: seq}))
+	}
+
+	// Every missing sequence number is still expected, however many arrived after it
+	require.False(t, dedup.IsDuplicate(Header{ClientID: "c1", Seq: 1}))
+	require.False(t, dedup.IsDuplicate(Header{ClientID: "c1", Seq: 4}))
+	require.True(t, dedup.IsDuplicate(Header{ClientID: "c1", Seq: 5}))
+
+	state := dedup.State().Windows["c1"][""]
+	require.Equal(t, uint64(1), state.Floor)
+	require.Equal(t, seqRange{3, 5}, state.Ranges[0])
+
+	restored := NewDedupFilter(0)
+	restored.Restore(dedup.State())
+	require.False(t, restored.IsDuplicate(Header{ClientID: "c1", Seq: 2}))
+	require.Equal(t, uint64(5), restored.State().Windows["c1"][""].Floor)
+}
+
+func TestDedupFilterClosedClient(t *testing.T) {
+	dedup := NewDedupFilter(time.Minute)
+	now := time.Now()
+	dedup.closedExpiry.now = func() time.Time { return now }
+	require.False(t, dedup.IsDuplicate(Header{ClientID: "c1", Seq: 1}))
+	dedup.Close("c1")
+	require.True(t, dedup.IsDuplicate(Header{ClientID: "c1", Seq: 2}))
+
+	now = now.Add(2 * time.Minute)
+	dedup.Expire()
+	require.Empty(t, dedup.State().Closed)
+}
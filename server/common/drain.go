@@ -0,0 +1,70 @@
+package common
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Drainer coordinates the graceful shutdown of a node. Once the termination signal arrives
+// the consumers are cancelled so the inboxes close after handing off the deliveries already
+// received, and the whole drain, including the flush of pending publishes, is bounded by a timeout.
+type Drainer struct {
+	middleware *Middleware
+	timeout    time.Duration
+	signal     <-chan struct{}
+	expired    <-chan time.Time
+	deadline   time.Time
+	draining   bool
+}
+
+func NewDrainer(ctx context.Context, middleware *Middleware, timeout time.Duration) *Drainer {
+	return &Drainer{
+		middleware: middleware,
+		timeout:    timeout,
+		signal:     ctx.Done(),
+	}
+}
+
+// Signal is closed when the node has to start draining. It returns nil once the drain started
+func (d *Drainer) Signal() <-chan struct{} {
+	if d.draining {
+		return nil
+	}
+	return d.signal
+}
+
+// Expired fires when the drain timeout is reached. It returns nil while the node is not draining
+func (d *Drainer) Expired() <-chan time.Time {
+	return d.expired
+}
+
+func (d *Drainer) IsDraining() bool {
+	return d.draining
+}
+
+func (d *Drainer) Start() {
+	if d.draining {
+		return
+	}
+	d.draining = true
+	d.deadline = time.Now().Add(d.timeout)
+	d.expired = time.After(d.timeout)
+	d.middleware.StopConsuming()
+}
+
+// Finish flushes the pending publishes with whatever is left of the drain timeout. Handlers still
+// running once it expired can not publish anymore, their deliveries are left unacked
+func (d *Drainer) Finish() {
+	if !d.draining {
+		d.deadline = time.Now().Add(d.timeout)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), d.deadline)
+	defer cancel()
+
+	if err := d.middleware.Flush(ctx); err != nil {
+		slog.Error("error flushing middleware", slog.String("error", err.Error()))
+		return
+	}
+	slog.Info("drain finished")
+}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnexpectedProducers rejects an EOF marker that announces another number of producers than the
+// topology of the stream has
+var ErrUnexpectedProducers = errors.New("eof marker disagrees with the topology")
+
+// EofTracker detects the end of a client stream merged from several producers. Every producer
+// sends its own EOF marker with the weight it produced. The number of producers comes from the
+// topology of the consumer, the markers only confirm it
+type EofTracker struct {
+	Received  map[string]uint32 `json:"received"`
+	Announced map[string]uint32 `json:"announced"`
+	Producers int32             `json:"producers"`
+}
+
+func NewEofTracker(producers int) *EofTracker {
+	return &EofTracker{
+		Received:  make(map[string]uint32),
+		Announced: make(map[string]uint32),
+		Producers: int32(max(producers, 1)),
+	}
+}
+
+// CheckProducers fails if the header is an EOF marker announcing other than the expected producers
+func CheckProducers(header Header, expected int) error {
+	if !header.IsEof() {
+		return nil
+	}
+	if announced := max(header.Producers, 1); int(announced) != max(expected, 1) {
+		return fmt.Errorf("%w: producer %s announces %d producers, expected %d", ErrUnexpectedProducers, header.ProducerID, announced, expected)
+	}
+	return nil
+}
+
+// Observe accounts a batch of the stream, it must not be called twice for the same batch. A marker
+// disagreeing with the producers of the tracker is not accounted
+func (t *EofTracker) Observe(header Header) error {
+	if err := CheckProducers(header, int(t.Producers)); err != nil {
+		return err
+	}
+	t.Received[header.ProducerID] += header.Weight
+	if header.IsEof() {
+		t.Announced[header.ProducerID] = uint32(header.TotalWeight)
+	}
+	return nil
+}
+
+// IsDone reports whether every producer sent its EOF marker and all the weight it announced
+func (t *EofTracker) IsDone() bool {
+	if len(t.Announced) < int(t.Producers) {
+		return false
+	}
+	for producer, announced := range t.Announced {
+		if t.Received[producer] != announced {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEofTrackerWaitsForEveryProducer(t *testing.T) {
+	tracker := NewEofTracker(2)
+	for _, shard := range []string{"joiner-1", "joiner-2"} {
+		require.NoError(t, tracker.Observe(Header{Weight: 2, TotalWeight: -1, ProducerID: shard}))
+	}
+	require.NoError(t, tracker.Observe(Header{Weight: 1, TotalWeight: 3, ProducerID: "joiner-1", Producers: 2}))
+	require.False(t, tracker.IsDone())
+
+	// The marker of joiner-2 arrives before the rest of its weight
+	require.NoError(t, tracker.Observe(Header{TotalWeight: 3, ProducerID: "joiner-2", Producers: 2}))
+	require.False(t, tracker.IsDone())
+	require.NoError(t, tracker.Observe(Header{Weight: 1, TotalWeight: -1, ProducerID: "joiner-2"}))
+	require.True(t, tracker.IsDone())
+}
+
+func TestEofTrackerWithSingleProducer(t *testing.T) {
+	tracker := NewEofTracker(1)
+	require.NoError(t, tracker.Observe(Header{Weight: 1, TotalWeight: -1, ProducerID: "gateway"}))
+	require.NoError(t, tracker.Observe(Header{TotalWeight: 2, ProducerID: "gateway"}))
+	require.False(t, tracker.IsDone())
+	require.NoError(t, tracker.Observe(Header{Weight: 1, TotalWeight: -1, ProducerID: "gateway"}))
+	require.True(t, tracker.IsDone())
+}
+
+func TestEofTrackerRejectsMarkersAgainstTheTopology(t *testing.T) {
+	tracker := NewEofTracker(3)
+	require.NoError(t, tracker.Observe(Header{Weight: 2, TotalWeight: -1, ProducerID: "joiner-1"}))
+	// A stale marker would complete the stream once two of the three shards are over
+	err := tracker.Observe(Header{TotalWeight: 2, ProducerID: "joiner-1", Producers: 2})
+	require.ErrorIs(t, err, ErrUnexpectedProducers)
+	require.Empty(t, tracker.Announced)
+	require.Equal(t, map[string]uint32{"joiner-1": 2}, tracker.Received)
+}
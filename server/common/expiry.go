@@ -0,0 +1,49 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// SessionExpiry tracks the last activity of the sessions of a node, so the ones abandoned by
+// their client can be evicted once the ttl passes. A zero ttl never expires a session
+type SessionExpiry struct {
+	ttl      time.Duration
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+	now      func() time.Time
+}
+
+func NewSessionExpiry(ttl time.Duration) *SessionExpiry {
+	return &SessionExpiry{ttl: ttl, lastSeen: make(map[string]time.Time), now: time.Now}
+}
+
+func (e *SessionExpiry) Touch(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastSeen[id] = e.now()
+}
+
+func (e *SessionExpiry) Forget(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.lastSeen, id)
+}
+
+// Expired returns the sessions idle for longer than the ttl and forgets them
+func (e *SessionExpiry) Expired() []string {
+	if e.ttl <= 0 {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var expired []string
+	deadline := e.now().Add(-e.ttl)
+	for id, seen := range e.lastSeen {
+		if seen.Before(deadline) {
+			expired = append(expired, id)
+			delete(e.lastSeen, id)
+		}
+	}
+	return expired
+}
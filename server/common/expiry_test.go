@@ -0,0 +1,32 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionExpiryEvictsIdleSessions(t *testing.T) {
+	now := time.Unix(0, 0)
+	expiry := NewSessionExpiry(time.Minute)
+	expiry.now = func() time.Time { return now }
+
+	expiry.Touch("idle")
+	expiry.Touch("active")
+	expiry.Touch("finished")
+	expiry.Forget("finished")
+
+	now = now.Add(50 * time.Second)
+	expiry.Touch("active")
+	require.Empty(t, expiry.Expired())
+
+	now = now.Add(20 * time.Second)
+	require.Equal(t, []string{"idle"}, expiry.Expired())
+	require.Empty(t, expiry.Expired())
+
+	disabled := NewSessionExpiry(0)
+	disabled.Touch("idle")
+	disabled.now = func() time.Time { return now.Add(time.Hour) }
+	require.Empty(t, disabled.Expired())
+}
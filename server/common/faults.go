@@ -0,0 +1,198 @@
+package common
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg/config"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// reorderWindow is how long a held back delivery waits for the next one before it is released anyway
+	reorderWindow = 200 * time.Millisecond
+	crashExitCode = 137
+)
+
+// FaultInjector alters the deliveries of a consumer before they reach the node. Faults are picked
+// with a seeded generator, so the same seed and input reproduce the same failures
+type FaultInjector struct {
+	cfg  config.Faults
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewFaultInjector returns nil when no delivery fault is enabled
+func NewFaultInjector(cfg config.Faults) *FaultInjector {
+	if !cfg.InjectsDeliveryFaults() {
+		return nil
+	}
+	slog.Warn("fault injection enabled",
+		slog.Float64("duplicate", cfg.DuplicateRate),
+		slog.Float64("drop", cfg.DropRate),
+		slog.Float64("reorder", cfg.ReorderRate),
+		slog.Float64("delay", cfg.DelayRate),
+		slog.Int("seed", cfg.Seed))
+	return &FaultInjector{cfg: cfg, rand: rand.New(rand.NewSource(int64(cfg.Seed)))}
+}
+
+func (f *FaultInjector) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Float64() < rate
+}
+
+// pipe hands off the deliveries to the inbox applying the faults:
+//   - drop: the delivery is rejected and the broker redelivers it, as when a connection is lost
+//   - delay: the delivery is handed off after the configured delay
+//   - reorder: the delivery is held back and handed off after the next one
+//   - duplicate: the delivery is handed off twice, only the first ack reaches the broker
+func (f *FaultInjector) pipe(deliveries <-chan amqp.Delivery, inbox chan<- Message) {
+	var held *Message
+	var release <-chan time.Time
+	handOffHeld := func() {
+		if held != nil {
+			inbox <- *held
+			held, release = nil, nil
+		}
+	}
+
+	for {
+		select {
+		case <-release:
+			handOffHeld()
+		case delivery, ok := <-deliveries:
+			if !ok {
+				handOffHeld()
+				return
+			}
+			msg := Message{delivery.Body, delivery}
+
+			if f.roll(f.cfg.DropRate) {
+				slog.Warn("fault injection: dropping delivery", slog.Uint64("tag", delivery.DeliveryTag))
+				if err := delivery.Nack(false, true); err != nil {
+					slog.Error("error requeueing dropped delivery", slog.String("error", err.Error()))
+				}
+				continue
+			}
+			if f.roll(f.cfg.DelayRate) {
+				time.Sleep(f.cfg.Delay)
+			}
+			if held == nil && f.roll(f.cfg.ReorderRate) {
+				held, release = &msg, time.After(reorderWindow)
+				continue
+			}
+
+			inbox <- msg
+			if f.roll(f.cfg.DuplicateRate) {
+				slog.Warn("fault injection: duplicating delivery", slog.Uint64("tag", delivery.DeliveryTag))
+				inbox <- msg.duplicate()
+			}
+			handOffHeld()
+		}
+	}
+}
+
+// duplicate returns a copy whose ack is not sent, the broker only knows about the original delivery
+func (m Message) duplicate() Message {
+	delivery := m.amqpMsg
+	delivery.Acknowledger = discardAcknowledger{}
+	return Message{Body: m.Body, amqpMsg: delivery}
+}
+
+type discardAcknowledger struct{}
+
+func (discardAcknowledger) Ack(uint64, bool) error        { return nil }
+func (discardAcknowledger) Nack(uint64, bool, bool) error { return nil }
+func (discardAcknowledger) Reject(uint64, bool) error     { return nil }
+
+// Crash points are named places in the nodes where a crash exposes a specific failure window,
+// like a batch published but not acked. Armed points make the node exit abruptly when they are hit.
+// A point fires once: a marker file survives the restart of the process or container, so the
+// restarted node does not crash again in the same place
+var crashPoints = struct {
+	mu      sync.Mutex
+	armed   map[string]int
+	hits    map[string]int
+	handler func(point string)
+}{
+	armed: map[string]int{},
+	hits:  map[string]int{},
+	handler: func(point string) {
+		slog.Error("crash point reached, exiting", slog.String("point", point))
+		if err := os.WriteFile(crashMarker(point), nil, 0o644); err != nil {
+			slog.Error("error marking crash point", slog.String("error", err.Error()))
+		}
+		os.Exit(crashExitCode)
+	},
+}
+
+func crashMarker(point string) string {
+	return filepath.Join(os.TempDir(), "crash-point-"+point)
+}
+
+// ArmCrashPoints parses the points as name or name@n, a point without count crashes on its first hit
+func ArmCrashPoints(points []string) error {
+	armed := make(map[string]int, len(points))
+	for _, point := range points {
+		name, countText, hasCount := strings.Cut(point, "@")
+		count := 1
+		if hasCount {
+			parsed, err := strconv.Atoi(countText)
+			if err != nil || parsed < 1 {
+				return fmt.Errorf("invalid crash point %q, expected name@n", point)
+			}
+			count = parsed
+		}
+		if _, err := os.Stat(crashMarker(name)); err == nil {
+			slog.Info("crash point already fired", slog.String("point", name))
+			continue
+		}
+		armed[name] = count
+	}
+
+	crashPoints.mu.Lock()
+	defer crashPoints.mu.Unlock()
+	crashPoints.armed = armed
+	crashPoints.hits = map[string]int{}
+	if len(armed) > 0 {
+		slog.Warn("crash points armed", slog.Any("points", points))
+	}
+	return nil
+}
+
+// OnCrash replaces the exit of the process, so tests can reproduce a crash point without dying
+func OnCrash(handler func(point string)) {
+	crashPoints.mu.Lock()
+	defer crashPoints.mu.Unlock()
+	crashPoints.handler = handler
+}
+
+// CrashPoint crashes the node if the point is armed and this is the hit it waits for
+func CrashPoint(name string) {
+	crashPoints.mu.Lock()
+	count, ok := crashPoints.armed[name]
+	if !ok {
+		crashPoints.mu.Unlock()
+		return
+	}
+	crashPoints.hits[name]++
+	hit := crashPoints.hits[name] == count
+	handler := crashPoints.handler
+	crashPoints.mu.Unlock()
+
+	if hit {
+		handler(name)
+	}
+}
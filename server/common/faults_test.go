@@ -0,0 +1,66 @@
+package common
+
+import (
+	"testing"
+
+	"pkg/config"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/require"
+)
+
+func pipeDeliveries(t *testing.T, faults config.Faults, acknowledger amqp.Acknowledger, tags ...uint64) []Message {
+	deliveries := make(chan amqp.Delivery, len(tags))
+	for _, tag := range tags {
+		deliveries <- amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: tag}
+	}
+	close(deliveries)
+
+	inbox := make(chan Message, 2*len(tags))
+	injector := NewFaultInjector(faults)
+	require.NotNil(t, injector)
+	injector.pipe(deliveries, inbox)
+	close(inbox)
+
+	var received []Message
+	for msg := range inbox {
+		received = append(received, msg)
+	}
+	return received
+}
+
+func TestDuplicatedDeliveriesAreAckedOnce(t *testing.T) {
+	acknowledger := &recordingAcknowledger{}
+	received := pipeDeliveries(t, config.Faults{DuplicateRate: 1, Seed: 1}, acknowledger, 1, 2)
+
+	require.Len(t, received, 4)
+	for _, msg := range received {
+		require.NoError(t, msg.Ack())
+	}
+	require.Equal(t, []uint64{1, 2}, acknowledger.acked)
+}
+
+func TestReorderedDeliveriesAreSwapped(t *testing.T) {
+	received := pipeDeliveries(t, config.Faults{ReorderRate: 1, Seed: 1}, &recordingAcknowledger{}, 1, 2, 3)
+
+	var tags []uint64
+	for _, msg := range received {
+		tags = append(tags, msg.amqpMsg.DeliveryTag)
+	}
+	require.Equal(t, []uint64{2, 1, 3}, tags)
+}
+
+func TestCrashPointFiresOnTheArmedHit(t *testing.T) {
+	var crashed []string
+	OnCrash(func(point string) { crashed = append(crashed, point) })
+	require.NoError(t, ArmCrashPoints([]string{"test.point@2"}))
+	t.Cleanup(func() { _ = ArmCrashPoints(nil) })
+
+	CrashPoint("test.point")
+	CrashPoint("test.other")
+	require.Empty(t, crashed)
+	CrashPoint("test.point")
+	require.Equal(t, []string{"test.point"}, crashed)
+
+	require.Error(t, ArmCrashPoints([]string{"test.point@0"}))
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"pkg/config"
+)
+
+const (
+	DefaultHealthPort  = "8081"
+	HealthTickInterval = 2 * time.Second
+	livenessTimeout    = 5 * HealthTickInterval
+)
+
+// HealthServer exposes the liveness and readiness of a node over HTTP.
+// Readiness means the middleware is connected and the node registered its consumers,
+// liveness means the main loop has ticked recently.
+type HealthServer struct {
+	middleware *Middleware
+	server     *http.Server
+	ready      atomic.Bool
+	lastTick   atomic.Int64
+	heartbeat  *Heartbeater
+}
+
+func NewHealthServer(node config.Node, middleware *Middleware) *HealthServer {
+	port := node.HealthPort
+	if port == "" {
+		port = DefaultHealthPort
+	}
+
+	h := &HealthServer{middleware: middleware, heartbeat: NewHeartbeater(node.WatchdogAddrs, node.ID())}
+	h.lastTick.Store(time.Now().UnixNano())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health/live", h.handleLive)
+	mux.HandleFunc("/health/ready", h.handleReady)
+	h.server = &http.Server{Addr: ":" + port, Handler: mux}
+
+	return h
+}
+
+func (h *HealthServer) Start() {
+	go func() {
+		slog.Info("starting health server", slog.String("address", h.server.Addr))
+		if err := h.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("error serving health endpoints", slog.String("error", err.Error()))
+		}
+	}()
+}
+
+// Tick must be called periodically from the node main loop, it also sends the heartbeat to the watchdog
+func (h *HealthServer) Tick() {
+	h.lastTick.Store(time.Now().UnixNano())
+	h.heartbeat.Beat()
+}
+
+func (h *HealthServer) SetReady(ready bool) {
+	h.ready.Store(ready)
+}
+
+func (h *HealthServer) IsAlive() bool {
+	return time.Since(time.Unix(0, h.lastTick.Load())) < livenessTimeout
+}
+
+func (h *HealthServer) IsReady() bool {
+	return h.ready.Load() && h.middleware != nil && h.middleware.IsConnected() && h.middleware.HasConsumers()
+}
+
+func (h *HealthServer) Close() error {
+	_ = h.heartbeat.Close()
+	if err := h.server.Close(); err != nil {
+		return fmt.Errorf("error closing health server: %w", err)
+	}
+	return nil
+}
+
+func (h *HealthServer) handleLive(w http.ResponseWriter, _ *http.Request) {
+	writeHealthStatus(w, h.IsAlive())
+}
+
+func (h *HealthServer) handleReady(w http.ResponseWriter, _ *http.Request) {
+	writeHealthStatus(w, h.IsReady())
+}
+
+func writeHealthStatus(w http.ResponseWriter, ok bool) {
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("unavailable\n"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"log/slog"
+	"net"
+)
+
+// Heartbeater tells the watchdogs that the node is alive by sending its id in a UDP datagram to each of them.
+// The watchdogs are resolved lazily, so nodes can start before they do
+type Heartbeater struct {
+	nodeID string
+	addrs  []string
+	conns  []net.Conn
+}
+
+// NewHeartbeater returns nil when no watchdog is configured, Beat and Close are no-ops on nil
+func NewHeartbeater(addrs []string, nodeID string) *Heartbeater {
+	if len(addrs) == 0 {
+		return nil
+	}
+	return &Heartbeater{nodeID: nodeID, addrs: addrs, conns: make([]net.Conn, len(addrs))}
+}
+
+func (h *Heartbeater) Beat() {
+	if h == nil {
+		return
+	}
+	for i, addr := range h.addrs {
+		if h.conns[i] == nil {
+			conn, err := net.Dial("udp", addr)
+			if err != nil {
+				slog.Debug("error resolving watchdog", slog.String("address", addr), slog.String("error", err.Error()))
+				continue
+			}
+			h.conns[i] = conn
+		}
+		if _, err := h.conns[i].Write([]byte(h.nodeID)); err != nil {
+			slog.Debug("error sending heartbeat", slog.String("address", addr), slog.String("error", err.Error()))
+			_ = h.conns[i].Close()
+			h.conns[i] = nil
+		}
+	}
+}
+
+func (h *Heartbeater) Close() error {
+	if h == nil {
+		return nil
+	}
+	for i, conn := range h.conns {
+		if conn != nil {
+			_ = conn.Close()
+			h.conns[i] = nil
+		}
+	}
+	return nil
+}
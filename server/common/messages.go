@@ -8,6 +8,10 @@ import (
 type ToProcessMsg struct {
 	Type     string          `json:"type"`
 	ClientId string          `json:"client_id"`
+	Producer string          `json:"producer"`
+	Seq      uint64          `json:"seq"`
+	Gateway  string          `json:"gateway"`
+	Shards   []int           `json:"shards,omitempty"`
 	Body     json.RawMessage `json:"body"`
 }
 
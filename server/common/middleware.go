@@ -2,9 +2,13 @@ package common
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"log/slog"
+	"pkg/config"
+	"sync"
+	"sync/atomic"
 )
 
 type Message struct {
@@ -20,14 +24,38 @@ func (m *Message) Ack() error {
 	return nil
 }
 
+// Nack gives the message back to the broker, which delivers it again
+func (m *Message) Nack() error {
+	if err := m.amqpMsg.Nack(false, true); err != nil {
+		return fmt.Errorf("error requeueing message: %s", err)
+	}
+	return nil
+}
+
 type Middleware struct {
-	conn *amqp.Connection
-	ch   *amqp.Channel
+	conn       *amqp.Connection
+	ch         *amqp.Channel
+	consumers  atomic.Int32
+	mu         sync.Mutex
+	tags       []string
+	nextTag    uint64 // consumers registered so far, never reset so tags are not reused
+	flushing   chan struct{}
+	flushOnce  sync.Once
+	publishers sync.WaitGroup
+	faults     *FaultInjector
+	leases     []*amqp.Channel
 }
 
-func NewMiddleware(rabbitUser string, rabbitPass string, host string) (*Middleware, error) {
-	slog.Info("creating middleware", slog.String("dialing", "amqp://"+rabbitUser+":"+rabbitPass+"@"+host+":5672"))
-	conn, err := amqp.Dial("amqp://" + rabbitUser + ":" + rabbitPass + "@" + host + ":5672")
+// NewMiddleware connects to the broker. It also sets up the fault injection of the node,
+// the delivery faults of its consumers and its crash points
+func NewMiddleware(node config.Node) (*Middleware, error) {
+	if err := ArmCrashPoints(node.CrashPoints); err != nil {
+		return nil, err
+	}
+
+	rabbit := node.Rabbit
+	slog.Info("creating middleware", slog.String("dialing", rabbit.Address()), slog.String("user", rabbit.RabbitUser))
+	conn, err := amqp.Dial(rabbit.URL())
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to RabbitMQ: %s", err)
 	}
@@ -35,12 +63,20 @@ func NewMiddleware(rabbitUser string, rabbitPass string, host string) (*Middlewa
 	if err != nil {
 		return nil, fmt.Errorf("failed to open a channel: %s", err)
 	}
-	return &Middleware{conn: conn, ch: ch}, nil
+	// Publisher confirms let Flush know when every pending publish reached the broker
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("failed to put channel in confirm mode: %s", err)
+	}
+	// A bounded prefetch keeps what a drain has to handle after the consumers are cancelled short
+	if err := ch.Qos(rabbit.Prefetch, 0, false); err != nil {
+		return nil, fmt.Errorf("failed to set the prefetch: %s", err)
+	}
+	return &Middleware{conn: conn, ch: ch, flushing: make(chan struct{}), faults: NewFaultInjector(node.Faults)}, nil
 }
 
-func (m *Middleware) sendToQueue(queueName string, body []byte) error {
-	// TODO: Deberia ser publish with context?
-	err := m.ch.Publish(
+func (m *Middleware) sendToQueue(queueName string, body []byte) (*amqp.DeferredConfirmation, error) {
+	confirmation, err := m.ch.PublishWithDeferredConfirmWithContext(
+		context.Background(),
 		"",
 		queueName, //routing key
 		false,
@@ -50,9 +86,9 @@ func (m *Middleware) sendToQueue(queueName string, body []byte) error {
 			Body:        body,
 		})
 	if err != nil {
-		return fmt.Errorf("error sending message: %s", err)
+		return nil, fmt.Errorf("error sending message: %s", err)
 	}
-	return nil
+	return confirmation, nil
 }
 
 func (m *Middleware) GetChanToSend(name string) (chan<- []byte, error) {
@@ -61,47 +97,42 @@ func (m *Middleware) GetChanToSend(name string) (chan<- []byte, error) {
 		return nil, fmt.Errorf("error declaring queue: %s", err)
 	}
 
-	chanToSend := make(chan []byte)
-	go func() {
-		for msg := range chanToSend {
+	return m.startPublisher(func(msg []byte) (*amqp.DeferredConfirmation, error) {
+		return m.sendToQueue(queue.Name, msg)
+	}), nil
+}
 
-			if err := m.sendToQueue(queue.Name, msg); err != nil {
-				//TODO: deberia tener otro canal para devolver el error?
-				fmt.Printf("Error sending message: %s", err)
-			}
-		}
-	}()
-	return chanToSend, nil
+// DeclareQueue makes sure the queue exists, so SendConfirmed can publish to it
+func (m *Middleware) DeclareQueue(name string) error {
+	if _, err := m.ch.QueueDeclare(name, false, false, false, false, nil); err != nil {
+		return fmt.Errorf("error declaring queue: %s", err)
+	}
+	return nil
 }
 
-func (m *Middleware) GetChanToRecv(name string) (<-chan Message, error) {
-	queue, err := m.ch.QueueDeclare(name, false, false, false, false, nil)
+// SendConfirmed publishes the message to the queue and waits until the broker confirmed it
+func (m *Middleware) SendConfirmed(ctx context.Context, queueName string, body []byte) error {
+	confirmation, err := m.sendToQueue(queueName, body)
 	if err != nil {
-		return nil, fmt.Errorf("error declaring queue: %s", err)
+		return err
 	}
-
-	amqpChan, err := m.ch.Consume(
-		queue.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-
+	acked, err := confirmation.WaitContext(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to register a consumer: %s", err)
+		return fmt.Errorf("error waiting for the confirm of %s: %w", queueName, err)
 	}
+	if !acked {
+		return fmt.Errorf("message to %s was not confirmed by the broker", queueName)
+	}
+	return nil
+}
 
-	inboxChan := make(chan Message)
-	go func() {
-		for msg := range amqpChan {
-			inboxChan <- Message{msg.Body, msg}
-		}
-	}()
+func (m *Middleware) GetChanToRecv(name string) (<-chan Message, error) {
+	queue, err := m.ch.QueueDeclare(name, false, false, false, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error declaring queue: %s", err)
+	}
 
-	return inboxChan, nil
+	return m.consume(queue.Name)
 }
 
 func (m *Middleware) GetChanWithTopicToSend(exchange, topic string) (chan<- []byte, error) {
@@ -118,15 +149,9 @@ func (m *Middleware) GetChanWithTopicToSend(exchange, topic string) (chan<- []by
 		return nil, fmt.Errorf("error binding queue: %s", err)
 	}
 
-	chanToSend := make(chan []byte)
-	go func() {
-		for msg := range chanToSend {
-			if err := m.sendToExchange(exchange, topic, msg); err != nil {
-				slog.Error("error sending message", slog.String("error", err.Error()))
-			}
-		}
-	}()
-	return chanToSend, nil
+	return m.startPublisher(func(msg []byte) (*amqp.DeferredConfirmation, error) {
+		return m.sendToExchange(exchange, topic, msg)
+	}), nil
 }
 
 func (m *Middleware) GetChanWithTopicToRecv(exchange, topic string) (<-chan Message, error) {
@@ -143,9 +168,49 @@ func (m *Middleware) GetChanWithTopicToRecv(exchange, topic string) (<-chan Mess
 		return nil, fmt.Errorf("error binding queue: %s", err)
 	}
 
+	return m.consume(q.Name)
+}
+
+// GetChanToBroadcast returns a channel whose messages reach every queue bound to the fanout exchange
+func (m *Middleware) GetChanToBroadcast(exchange string) (chan<- []byte, error) {
+	if err := m.ch.ExchangeDeclare(exchange, "fanout", false, false, false, false, nil); err != nil {
+		return nil, fmt.Errorf("error declaring exchange: %s", err)
+	}
+
+	return m.startPublisher(func(msg []byte) (*amqp.DeferredConfirmation, error) {
+		return m.sendToExchange(exchange, "", msg)
+	}), nil
+}
+
+// GetBroadcastChanToRecv consumes the queue of the subscriber bound to the fanout exchange. Nodes sharing
+// a subscriber name share the queue, so each broadcast message is handled once per subscriber
+func (m *Middleware) GetBroadcastChanToRecv(exchange, subscriber string) (<-chan Message, error) {
+	if err := m.ch.ExchangeDeclare(exchange, "fanout", false, false, false, false, nil); err != nil {
+		return nil, fmt.Errorf("error declaring exchange: %s", err)
+	}
+
+	q, err := m.ch.QueueDeclare(exchange+"-"+subscriber, false, false, false, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error declaring queue: %s", err)
+	}
+
+	if err := m.ch.QueueBind(q.Name, "", exchange, false, nil); err != nil {
+		return nil, fmt.Errorf("error binding queue: %s", err)
+	}
+
+	return m.consume(q.Name)
+}
+
+// consume registers a consumer on the queue. The returned channel is closed once the
+// consumer is cancelled and every delivery already received was handed off
+func (m *Middleware) consume(queueName string) (<-chan Message, error) {
+	m.mu.Lock()
+	m.nextTag++
+	tag := fmt.Sprintf("%s-%d", queueName, m.nextTag)
+	m.mu.Unlock()
 	amqpChan, err := m.ch.Consume(
-		q.Name,
-		"",
+		queueName,
+		tag,
 		false,
 		false,
 		false,
@@ -156,11 +221,19 @@ func (m *Middleware) GetChanWithTopicToRecv(exchange, topic string) (<-chan Mess
 	if err != nil {
 		return nil, fmt.Errorf("failed to register a consumer: %s", err)
 	}
+	m.consumers.Add(1)
+	m.mu.Lock()
+	m.tags = append(m.tags, tag)
+	m.mu.Unlock()
 
 	inboxChan := make(chan Message)
 	go func() {
+		defer close(inboxChan)
+		if m.faults != nil {
+			m.faults.pipe(amqpChan, inboxChan)
+			return
+		}
 		for msg := range amqpChan {
-			//slog.Info("received message", slog.String("topic", topic), slog.String("exchange", exchange))
 			inboxChan <- Message{msg.Body, msg}
 		}
 	}()
@@ -168,6 +241,121 @@ func (m *Middleware) GetChanWithTopicToRecv(exchange, topic string) (<-chan Mess
 	return inboxChan, nil
 }
 
+// startPublisher returns a channel whose messages are published with the given function.
+// The publisher keeps track of the confirmations still pending so Flush can wait for them
+func (m *Middleware) startPublisher(publish func(msg []byte) (*amqp.DeferredConfirmation, error)) chan<- []byte {
+	chanToSend := make(chan []byte)
+	m.publishers.Add(1)
+	go func() {
+		defer m.publishers.Done()
+		var pending []*amqp.DeferredConfirmation
+	publishing:
+		for {
+			select {
+			case msg := <-chanToSend:
+				confirmation, err := publish(msg)
+				if err != nil {
+					slog.Error("error sending message", slog.String("error", err.Error()))
+					continue
+				}
+				pending = dropConfirmed(append(pending, confirmation))
+			case <-m.flushing:
+				break publishing
+			}
+		}
+
+		for _, confirmation := range pending {
+			if !confirmation.Wait() {
+				slog.Warn("message was not confirmed by the broker")
+			}
+		}
+	}()
+	return chanToSend
+}
+
+func dropConfirmed(pending []*amqp.DeferredConfirmation) []*amqp.DeferredConfirmation {
+	for len(pending) > 0 {
+		select {
+		case <-pending[0].Done():
+			if !pending[0].Acked() {
+				slog.Warn("message was not confirmed by the broker")
+			}
+			pending = pending[1:]
+		default:
+			return pending
+		}
+	}
+	return pending
+}
+
+// StopConsuming cancels every consumer. Deliveries already received are still handed
+// off through the inbox channels, which are closed afterwards
+func (m *Middleware) StopConsuming() {
+	m.mu.Lock()
+	tags := m.tags
+	m.tags = nil
+	m.mu.Unlock()
+
+	for _, tag := range tags {
+		if err := m.ch.Cancel(tag, false); err != nil {
+			slog.Error("error cancelling consumer", slog.String("consumer", tag), slog.String("error", err.Error()))
+		}
+	}
+	m.consumers.Store(0)
+}
+
+// Flush stops the publishers and waits until the broker confirmed all the publishes or the context
+// is done. The channels to send are left open, a handler still running after a drain timeout blocks
+// on its send instead of panicking, and the delivery it answers is never acked so it comes back
+func (m *Middleware) Flush(ctx context.Context) error {
+	m.flushOnce.Do(func() { close(m.flushing) })
+
+	flushed := make(chan struct{})
+	go func() {
+		m.publishers.Wait()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error flushing pending publishes: %w", ctx.Err())
+	}
+}
+
+// AcquireLease tries to own the lease with the given name, an exclusive queue that only one
+// connection can declare. The broker deletes it when the owner connection closes or stops
+// answering heartbeats, so the lease expires with the node that holds it
+func (m *Middleware) AcquireLease(name string) (bool, error) {
+	// A refused declare closes the channel, so it is tried on its own one
+	ch, err := m.conn.Channel()
+	if err != nil {
+		return false, fmt.Errorf("failed to open a lease channel: %s", err)
+	}
+	if _, err := ch.QueueDeclare(name, false, true, true, false, nil); err != nil {
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.ResourceLocked {
+			return false, nil
+		}
+		_ = ch.Close()
+		return false, fmt.Errorf("error declaring lease %s: %s", name, err)
+	}
+
+	m.mu.Lock()
+	m.leases = append(m.leases, ch)
+	m.mu.Unlock()
+	return true, nil
+}
+
+func (m *Middleware) IsConnected() bool {
+	return !m.conn.IsClosed() && !m.ch.IsClosed()
+}
+
+func (m *Middleware) HasConsumers() bool {
+	return m.consumers.Load() > 0
+}
+
 func (m *Middleware) Close() error {
 	if err := m.ch.Close(); err != nil {
 		return fmt.Errorf("failed to close channel: %s", err)
@@ -179,8 +367,8 @@ func (m *Middleware) Close() error {
 	return nil
 }
 
-func (m *Middleware) sendToExchange(exchange string, topic string, msg []byte) error {
-	err := m.ch.PublishWithContext(
+func (m *Middleware) sendToExchange(exchange string, topic string, msg []byte) (*amqp.DeferredConfirmation, error) {
+	confirmation, err := m.ch.PublishWithDeferredConfirmWithContext(
 		context.Background(),
 		exchange,
 		topic,
@@ -191,7 +379,7 @@ func (m *Middleware) sendToExchange(exchange string, topic string, msg []byte) e
 			Body:        msg,
 		})
 	if err != nil {
-		return fmt.Errorf("error sending message: %s", err)
+		return nil, fmt.Errorf("error sending message: %s", err)
 	}
-	return nil
+	return confirmation, nil
 }
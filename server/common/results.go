@@ -0,0 +1,45 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ResultsExchange is where the results of every query are published, on the topic of the gateway
+// serving the client
+const ResultsExchange = "results"
+
+func ResultsTopic(query int, gatewayID string) string {
+	return fmt.Sprintf("q%d-%s", query, gatewayID)
+}
+
+// ResultsRouter publishes the results of a query to the gateway that serves each client. The channel
+// to a gateway is opened the first time it gets a result
+type ResultsRouter struct {
+	middleware *Middleware
+	query      int
+	mu         sync.Mutex
+	chans      map[string]chan<- []byte
+}
+
+func NewResultsRouter(middleware *Middleware, query int) *ResultsRouter {
+	return &ResultsRouter{middleware: middleware, query: query, chans: make(map[string]chan<- []byte)}
+}
+
+func (r *ResultsRouter) Send(gatewayID string, msg []byte) error {
+	r.mu.Lock()
+	chanToSend, ok := r.chans[gatewayID]
+	if !ok {
+		var err error
+		chanToSend, err = r.middleware.GetChanWithTopicToSend(ResultsExchange, ResultsTopic(r.query, gatewayID))
+		if err != nil {
+			r.mu.Unlock()
+			return fmt.Errorf("error getting results channel of gateway %s: %w", gatewayID, err)
+		}
+		r.chans[gatewayID] = chanToSend
+	}
+	r.mu.Unlock()
+
+	chanToSend <- msg
+	return nil
+}
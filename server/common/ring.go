@@ -0,0 +1,145 @@
+package common
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ringReplicas is the number of points of every shard on the ring, more points spread the keys better
+const ringReplicas = 64
+
+// Ring spreads the movie ids over the joiner shards with consistent hashing. Adding or removing a
+// shard only moves the keys of the arcs it takes or gives back. The movies of a session are never
+// moved between joiners: every session is routed with the ring it was opened with until it ends
+type Ring struct {
+	shards []int
+	points []uint64
+	owners []int // shard owning each point
+}
+
+func NewRing(shards []int) *Ring {
+	r := &Ring{shards: slices.Clone(shards)}
+	slices.Sort(r.shards)
+	r.shards = slices.Compact(r.shards)
+
+	type point struct {
+		hash  uint64
+		shard int
+	}
+	points := make([]point, 0, len(r.shards)*ringReplicas)
+	for _, shard := range r.shards {
+		for i := range ringReplicas {
+			points = append(points, point{ringHash(fmt.Sprintf("shard-%d-%d", shard, i)), shard})
+		}
+	}
+	slices.SortFunc(points, func(a, b point) int {
+		if a.hash != b.hash {
+			return cmp.Compare(a.hash, b.hash)
+		}
+		return a.shard - b.shard
+	})
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.shard)
+	}
+	return r
+}
+
+// DefaultShards are the shards 1 to count, the ring of a session that was not given one
+func DefaultShards(count int) []int {
+	shards := make([]int, count)
+	for i := range shards {
+		shards[i] = i + 1
+	}
+	return shards
+}
+
+func ringHash(key string) uint64 {
+	hash := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+// Shard returns the shard owning the key, the first point clockwise from its hash
+func (r *Ring) Shard(key string) int {
+	hash := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+func (r *Ring) Shards() []int {
+	return r.shards
+}
+
+// ShardRouter sends the batches of a session to the joiner shards of its ring. Rings are built once
+// per membership and the channel to a shard is opened the first time it gets a batch
+type ShardRouter struct {
+	middleware *Middleware
+	exchange   string
+	topic      string // format of the topic of a shard
+	fallback   []int
+	mu         sync.Mutex
+	rings      map[string]*Ring
+	chans      map[int]chan<- []byte
+}
+
+// NewShardRouter routes to the shards of the topic format, sessions without a ring use the fallback shards
+func NewShardRouter(middleware *Middleware, exchange, topic string, fallback []int) *ShardRouter {
+	return &ShardRouter{
+		middleware: middleware,
+		exchange:   exchange,
+		topic:      topic,
+		fallback:   fallback,
+		rings:      make(map[string]*Ring),
+		chans:      make(map[int]chan<- []byte),
+	}
+}
+
+// Ring returns the ring of the shards, or the fallback one if there are none
+func (r *ShardRouter) Ring(shards []int) *Ring {
+	if len(shards) == 0 {
+		shards = r.fallback
+	}
+	parts := make([]string, len(shards))
+	for i, shard := range shards {
+		parts[i] = strconv.Itoa(shard)
+	}
+	key := strings.Join(parts, ",")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ring, ok := r.rings[key]
+	if !ok {
+		ring = NewRing(shards)
+		r.rings[key] = ring
+	}
+	return ring
+}
+
+func (r *ShardRouter) Send(shard int, msg []byte) error {
+	r.mu.Lock()
+	chanToSend, ok := r.chans[shard]
+	if !ok {
+		topic := fmt.Sprintf(r.topic, shard)
+		var err error
+		chanToSend, err = r.middleware.GetChanWithTopicToSend(r.exchange, topic)
+		if err != nil {
+			r.mu.Unlock()
+			return fmt.Errorf("error getting channel of shard %d: %w", shard, err)
+		}
+		r.chans[shard] = chanToSend
+	}
+	r.mu.Unlock()
+
+	chanToSend <- msg
+	return nil
+}
@@ -0,0 +1,27 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRingMovesOnlyTheKeysOfTheNewShard(t *testing.T) {
+	before := NewRing([]int{1, 2, 3})
+	after := NewRing([]int{3, 1, 2, 4})
+	require.Equal(t, []int{1, 2, 3, 4}, after.Shards())
+
+	counts := make(map[int]int)
+	for i := range 10000 {
+		key := fmt.Sprintf("movie-%d", i)
+		shard := after.Shard(key)
+		counts[shard]++
+		if previous := before.Shard(key); shard != previous {
+			require.Equal(t, 4, shard, "key %s moved between old shards", key)
+		}
+	}
+	for _, shard := range after.Shards() {
+		require.InDelta(t, 2500, counts[shard], 1000, "shard %d", shard)
+	}
+}
@@ -1,7 +1,5 @@
 package common
 
-import "crypto/sha256"
-
 func Filter[T any](slice []T, predicate func(T) bool) []T {
 	var result []T
 	for _, item := range slice {
@@ -44,8 +42,3 @@ func Flatten[T any](slices [][]T) []T {
 	}
 	return result
 }
-
-func GetShard(movieId string, shards int) int {
-	hash := sha256.Sum256([]byte(movieId))
-	return (int(hash[0]) % shards) + 1
-}
@@ -0,0 +1,214 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+const (
+	walFile          = "wal.log"
+	snapshotFile     = "snapshot"
+	recordHeaderSize = 16 // length, crc and lsn
+	maxRecordSize    = 64 << 20
+)
+
+// WAL is a write-ahead log stored in its own directory. Every record is numbered with
+// a log sequence number (lsn) and synced to disk before Append returns. A snapshot holds
+// the state up to some lsn, so the records it covers are discarded.
+//
+// Record layout: length (4 bytes) | crc32 of lsn and payload (4 bytes) | lsn (8 bytes) | payload
+type WAL struct {
+	dir     string
+	log     *os.File
+	lsn     uint64
+	entries int
+}
+
+// OpenWAL opens the log stored in dir, creating it if needed. Recover has to be called before appending
+func OpenWAL(dir string) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating wal directory %s: %w", dir, err)
+	}
+	log, err := os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening wal: %w", err)
+	}
+	return &WAL{dir: dir, log: log}, nil
+}
+
+// Recover returns the last snapshot, if any, and the records appended after it.
+// A torn record at the end of the log, left by a crash in the middle of a write, is discarded.
+func (w *WAL) Recover() ([]byte, [][]byte, error) {
+	snapshot, snapshotLSN, err := w.readSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.lsn = snapshotLSN
+
+	if _, err := w.log.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, fmt.Errorf("error seeking wal: %w", err)
+	}
+	reader := bufio.NewReader(w.log)
+	records := make([][]byte, 0)
+	var offset int64
+	for {
+		payload, lsn, err := readRecord(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			slog.Warn("discarding torn wal tail", slog.Int64("offset", offset), slog.String("error", err.Error()))
+			break
+		}
+		offset += int64(recordHeaderSize + len(payload))
+		if lsn <= snapshotLSN {
+			continue
+		}
+		records = append(records, payload)
+		w.lsn = lsn
+	}
+
+	if err := w.log.Truncate(offset); err != nil {
+		return nil, nil, fmt.Errorf("error truncating wal: %w", err)
+	}
+	if _, err := w.log.Seek(offset, io.SeekStart); err != nil {
+		return nil, nil, fmt.Errorf("error seeking wal: %w", err)
+	}
+	w.entries = len(records)
+	return snapshot, records, nil
+}
+
+// Append writes a record and syncs it to disk
+func (w *WAL) Append(payload []byte) error {
+	lsn := w.lsn + 1
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(record[8:16], lsn)
+	copy(record[recordHeaderSize:], payload)
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+
+	if _, err := w.log.Write(record); err != nil {
+		return fmt.Errorf("error writing wal record: %w", err)
+	}
+	if err := w.log.Sync(); err != nil {
+		return fmt.Errorf("error syncing wal: %w", err)
+	}
+	w.lsn = lsn
+	w.entries++
+	return nil
+}
+
+// Entries returns the amount of records appended since the last snapshot
+func (w *WAL) Entries() int {
+	return w.entries
+}
+
+// Snapshot atomically replaces the snapshot with state, which must include every record appended so far,
+// and truncates the log
+func (w *WAL) Snapshot(state []byte) error {
+	content := make([]byte, 12+len(state))
+	binary.BigEndian.PutUint64(content[0:8], w.lsn)
+	binary.BigEndian.PutUint32(content[8:12], crc32.ChecksumIEEE(state))
+	copy(content[12:], state)
+
+	if err := WriteFileAtomic(filepath.Join(w.dir, snapshotFile), content); err != nil {
+		return fmt.Errorf("error writing snapshot: %w", err)
+	}
+
+	// A crash before truncating leaves records the snapshot already covers, Recover skips them by lsn
+	if err := w.log.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating wal: %w", err)
+	}
+	if _, err := w.log.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking wal: %w", err)
+	}
+	if err := w.log.Sync(); err != nil {
+		return fmt.Errorf("error syncing wal: %w", err)
+	}
+	w.entries = 0
+	return nil
+}
+
+func (w *WAL) Close() error {
+	return w.log.Close()
+}
+
+func (w *WAL) readSnapshot() ([]byte, uint64, error) {
+	content, err := os.ReadFile(filepath.Join(w.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading snapshot: %w", err)
+	}
+	if len(content) < 12 {
+		return nil, 0, fmt.Errorf("snapshot is truncated")
+	}
+	state := content[12:]
+	if crc32.ChecksumIEEE(state) != binary.BigEndian.Uint32(content[8:12]) {
+		return nil, 0, fmt.Errorf("snapshot checksum mismatch")
+	}
+	return state, binary.BigEndian.Uint64(content[0:8]), nil
+}
+
+func readRecord(reader io.Reader) ([]byte, uint64, error) {
+	header := make([]byte, recordHeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if errors.Is(err, io.EOF) {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("truncated record header (%d bytes): %w", n, err)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, 0, fmt.Errorf("record length %d is too big", length)
+	}
+	body := make([]byte, 8+length)
+	copy(body, header[8:16])
+	if _, err := io.ReadFull(reader, body[8:]); err != nil {
+		return nil, 0, fmt.Errorf("truncated record payload: %w", err)
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, fmt.Errorf("record checksum mismatch")
+	}
+	return body[8:], binary.BigEndian.Uint64(header[8:16]), nil
+}
+
+// WriteFileAtomic writes a file through a synced temporary file and a rename, so readers
+// find either the old content or the new one
+func WriteFileAtomic(path string, content []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
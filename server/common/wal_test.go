@@ -0,0 +1,68 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func openRecoveredWAL(t *testing.T, dir string) (*WAL, []byte, [][]byte) {
+	wal, err := OpenWAL(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = wal.Close() })
+	snapshot, records, err := wal.Recover()
+	require.NoError(t, err)
+	return wal, snapshot, records
+}
+
+func TestWALRecoversAppendedRecords(t *testing.T) {
+	dir := t.TempDir()
+	wal, _, _ := openRecoveredWAL(t, dir)
+	for _, record := range []string{"a", "b", "c"} {
+		require.NoError(t, wal.Append([]byte(record)))
+	}
+	require.NoError(t, wal.Close())
+
+	_, snapshot, records := openRecoveredWAL(t, dir)
+	require.Nil(t, snapshot)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, records)
+}
+
+func TestWALDiscardsTornTail(t *testing.T) {
+	dir := t.TempDir()
+	wal, _, _ := openRecoveredWAL(t, dir)
+	require.NoError(t, wal.Append([]byte("complete")))
+	require.NoError(t, wal.Append([]byte("torn")))
+	require.NoError(t, wal.Close())
+
+	path := filepath.Join(dir, walFile)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-2))
+
+	wal, _, records := openRecoveredWAL(t, dir)
+	require.Equal(t, [][]byte{[]byte("complete")}, records)
+
+	// New records are appended after the last complete one
+	require.NoError(t, wal.Append([]byte("next")))
+	require.NoError(t, wal.Close())
+	_, _, records = openRecoveredWAL(t, dir)
+	require.Equal(t, [][]byte{[]byte("complete"), []byte("next")}, records)
+}
+
+func TestWALSnapshotDiscardsCoveredRecords(t *testing.T) {
+	dir := t.TempDir()
+	wal, _, _ := openRecoveredWAL(t, dir)
+	require.NoError(t, wal.Append([]byte("a")))
+	require.NoError(t, wal.Append([]byte("b")))
+	require.NoError(t, wal.Snapshot([]byte("state")))
+	require.Equal(t, 0, wal.Entries())
+	require.NoError(t, wal.Append([]byte("c")))
+	require.NoError(t, wal.Close())
+
+	_, snapshot, records := openRecoveredWAL(t, dir)
+	require.Equal(t, []byte("state"), snapshot)
+	require.Equal(t, [][]byte{[]byte("c")}, records)
+}
@@ -0,0 +1,172 @@
+package common
+
+import (
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+)
+
+const inFlightPerWorker = 4
+
+// ErrUnprocessable marks a delivery that fails however many times it is handled, like a malformed one.
+// It is dropped instead of requeued
+var ErrUnprocessable = errors.New("unprocessable message")
+
+// Handler processes a single delivery. The worker pool acks the delivery afterwards, or requeues it
+// if the handler failed
+type Handler func(msg Message) error
+
+// WorkerPool processes the deliveries of an inbox concurrently and acks them in delivery order.
+// When keyOf is set, deliveries with the same key (usually the client id) are processed
+// by the same worker, so their relative order is kept.
+type WorkerPool struct {
+	workers int
+	keyOf   func(Message) string
+}
+
+func NewWorkerPool(workers int) *WorkerPool {
+	return &WorkerPool{workers: max(workers, 1)}
+}
+
+func NewOrderedWorkerPool(workers int, keyOf func(Message) string) *WorkerPool {
+	return &WorkerPool{workers: max(workers, 1), keyOf: keyOf}
+}
+
+// NewWorkerPoolWithOrder returns an ordered pool keyed by keyOf when perKeyOrder is set
+func NewWorkerPoolWithOrder(workers int, perKeyOrder bool, keyOf func(Message) string) *WorkerPool {
+	if perKeyOrder {
+		return NewOrderedWorkerPool(workers, keyOf)
+	}
+	return NewWorkerPool(workers)
+}
+
+// Consumer pairs an inbox with the handler of its deliveries
+type Consumer struct {
+	Inbox  <-chan Message
+	Handle Handler
+}
+
+// RunAll runs every consumer on its own set of workers. The returned channel is closed
+// once all the inboxes were closed and their deliveries acked
+func (p *WorkerPool) RunAll(consumers ...Consumer) <-chan struct{} {
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for _, consumer := range consumers {
+		wg.Add(1)
+		go func(consumer Consumer) {
+			defer wg.Done()
+			p.Run(consumer.Inbox, consumer.Handle)
+		}(consumer)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+type job struct {
+	seq uint64
+	msg Message
+}
+
+type processedJob struct {
+	job
+	err error
+}
+
+// Run processes deliveries until the inbox is closed. It returns once every delivery was handled and acked
+func (p *WorkerPool) Run(inbox <-chan Message, handle Handler) {
+	queues := make([]chan job, 1)
+	if p.keyOf != nil {
+		queues = make([]chan job, p.workers)
+	}
+	for i := range queues {
+		queues[i] = make(chan job, inFlightPerWorker)
+	}
+
+	results := make(chan processedJob, p.workers)
+	inFlight := make(chan struct{}, p.workers*inFlightPerWorker)
+
+	workers := &sync.WaitGroup{}
+	for i := 0; i < p.workers; i++ {
+		workers.Add(1)
+		go func(jobs <-chan job) {
+			defer workers.Done()
+			for j := range jobs {
+				results <- processedJob{job: j, err: handle(j.msg)}
+			}
+		}(queues[i%len(queues)])
+	}
+
+	acked := make(chan struct{})
+	go func() {
+		defer close(acked)
+		ackInOrder(results, inFlight)
+	}()
+
+	var seq uint64
+	for msg := range inbox {
+		inFlight <- struct{}{}
+		queues[p.queueFor(msg)] <- job{seq: seq, msg: msg}
+		seq++
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	workers.Wait()
+	close(results)
+	<-acked
+}
+
+func (p *WorkerPool) queueFor(msg Message) int {
+	if p.keyOf == nil {
+		return 0
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(p.keyOf(msg)))
+	return int(hash.Sum32() % uint32(p.workers))
+}
+
+// ackInOrder acks the processed deliveries following the order in which they were received. A failed
+// delivery is requeued to be handled again, the stateful nodes drop it if it was already applied
+func ackInOrder(results <-chan processedJob, inFlight <-chan struct{}) {
+	pending := make(map[uint64]processedJob)
+	var next uint64
+	for result := range results {
+		pending[result.seq] = result
+		for {
+			current, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			if current.err != nil && !errors.Is(current.err, ErrUnprocessable) {
+				slog.Error("error processing message, requeueing it", slog.String("error", current.err.Error()))
+				if err := current.msg.Nack(); err != nil {
+					slog.Error("error requeueing message", slog.String("error", err.Error()))
+				}
+			} else {
+				if current.err != nil {
+					slog.Error("dropping message", slog.String("error", current.err.Error()))
+				}
+				if err := current.msg.Ack(); err != nil {
+					slog.Error("error acknowledging message", slog.String("error", err.Error()))
+				}
+			}
+			<-inFlight
+			next++
+		}
+	}
+}
+
+// ClientIDOf extracts the client id from the header of a serialized batch
+func ClientIDOf(msg Message) string {
+	header, err := HeaderOf(msg)
+	if err != nil {
+		return ""
+	}
+	return header.GetClientID()
+}
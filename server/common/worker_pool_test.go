@@ -0,0 +1,116 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingAcknowledger struct {
+	mu     sync.Mutex
+	acked  []uint64
+	nacked []uint64
+}
+
+func (a *recordingAcknowledger) Ack(tag uint64, _ bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *recordingAcknowledger) Nack(tag uint64, _ bool, requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if requeue {
+		a.nacked = append(a.nacked, tag)
+	}
+	return nil
+}
+
+func (a *recordingAcknowledger) Reject(uint64, bool) error { return nil }
+
+func newTestMessage(acknowledger amqp.Acknowledger, tag uint64, clientID string) Message {
+	body := []byte(fmt.Sprintf(`{"header":{"client_id":%q},"data":[]}`, clientID))
+	return Message{Body: body, amqpMsg: amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: tag}}
+}
+
+func TestWorkerPoolAcksInDeliveryOrder(t *testing.T) {
+	acknowledger := &recordingAcknowledger{}
+	inbox := make(chan Message)
+	go func() {
+		for tag := uint64(1); tag <= 100; tag++ {
+			inbox <- newTestMessage(acknowledger, tag, "client")
+		}
+		close(inbox)
+	}()
+
+	NewWorkerPool(8).Run(inbox, func(Message) error {
+		time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+		return nil
+	})
+
+	require.Len(t, acknowledger.acked, 100)
+	for i, tag := range acknowledger.acked {
+		require.Equal(t, uint64(i+1), tag)
+	}
+}
+
+func TestOrderedWorkerPoolKeepsOrderPerClient(t *testing.T) {
+	acknowledger := &recordingAcknowledger{}
+	inbox := make(chan Message)
+	go func() {
+		for tag := uint64(1); tag <= 90; tag++ {
+			inbox <- newTestMessage(acknowledger, tag, fmt.Sprintf("client-%d", tag%3))
+		}
+		close(inbox)
+	}()
+
+	mu := sync.Mutex{}
+	processed := make(map[string][]uint64)
+	NewOrderedWorkerPool(4, ClientIDOf).Run(inbox, func(msg Message) error {
+		time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+		mu.Lock()
+		defer mu.Unlock()
+		clientID := ClientIDOf(msg)
+		processed[clientID] = append(processed[clientID], msg.amqpMsg.DeliveryTag)
+		return nil
+	})
+
+	require.Len(t, processed, 3)
+	for clientID, tags := range processed {
+		require.Len(t, tags, 30, clientID)
+		for i := 1; i < len(tags); i++ {
+			require.Less(t, tags[i-1], tags[i], clientID)
+		}
+	}
+	require.Len(t, acknowledger.acked, 90)
+}
+
+func TestWorkerPoolRequeuesFailedDeliveries(t *testing.T) {
+	acknowledger := &recordingAcknowledger{}
+	inbox := make(chan Message, 3)
+	for tag := uint64(1); tag <= 3; tag++ {
+		inbox <- newTestMessage(acknowledger, tag, "client")
+	}
+	close(inbox)
+
+	NewWorkerPool(2).Run(inbox, func(msg Message) error {
+		switch msg.amqpMsg.DeliveryTag {
+		case 2:
+			return errors.New("broker unavailable")
+		case 3:
+			return fmt.Errorf("%w: bad json", ErrUnprocessable)
+		}
+		return nil
+	})
+
+	require.Equal(t, []uint64{1, 3}, acknowledger.acked)
+	require.Equal(t, []uint64{2}, acknowledger.nacked)
+}
@@ -1,17 +1,19 @@
 package main
 
+import "tp-sistemas-distribuidos/server/common"
+
 type ClientSession struct {
-	currentWeight  uint32
-	eofWeight      int32
-	eofMultiplier uint32
-	sessionId      string
-	data           any
+	eof       *common.EofTracker
+	sessionId string
+	gatewayID string
+	data      any
 }
 
-func NewClientSession(sessionId string, eofMultiplier uint32) *ClientSession {
+// NewClientSession creates the session of a client whose stream is merged from the given producers
+func NewClientSession(sessionId string, producers int) *ClientSession {
 	return &ClientSession{
-		sessionId:      sessionId,
-		eofMultiplier: eofMultiplier,
+		eof:       common.NewEofTracker(producers),
+		sessionId: sessionId,
 	}
 }
 
@@ -23,18 +25,21 @@ func (c *ClientSession) GetData() any {
 	return c.data
 }
 
-func (c *ClientSession) AddCurrentWeight(weight uint32) {
-	c.currentWeight += weight
-}
-
-func (c *ClientSession) SetEofWeight(weight int32) {
-	c.eofWeight = weight
+// Observe accounts the weight of a batch and the EOF marker it may carry, and the gateway that gets the result
+func (c *ClientSession) Observe(header common.Header) error {
+	if err := c.eof.Observe(header); err != nil {
+		return err
+	}
+	if header.GatewayID != "" {
+		c.gatewayID = header.GatewayID
+	}
+	return nil
 }
 
-func (c *ClientSession) GetEofWeight() int32 {
-	return c.eofWeight
+func (c *ClientSession) GatewayID() string {
+	return c.gatewayID
 }
 
 func (c *ClientSession) IsFinished() bool {
-	return c.eofWeight > 0 && c.currentWeight == (uint32(c.eofWeight) * c.eofMultiplier)
+	return c.eof.IsDone()
 }
@@ -6,77 +6,110 @@ import (
 	"fmt"
 	"log/slog"
 	"os/signal"
+	"path/filepath"
 	"sort"
 	"syscall"
+	"time"
 	"tp-sistemas-distribuidos/server/common"
 
 	pkg "pkg/models"
 )
 
-const rabbitHost = "rabbitmq"
-
 type queuesNames struct {
 	previousQueue string
-	nextQueue     string
 }
 
 var queriesQueues = map[int]queuesNames{
-	2: {previousQueue: "q2-to-final-reduce", nextQueue: "q2-results"},
-	3: {previousQueue: "q3-to-final-reduce", nextQueue: "q3-results"},
-	4: {previousQueue: "q4-to-final-reduce", nextQueue: "q4-results"},
-	5: {previousQueue: "q5-to-final-reduce", nextQueue: "q5-results"},
+	2: {previousQueue: "q2-to-final-reduce"},
+	3: {previousQueue: "q3-to-final-reduce"},
+	4: {previousQueue: "q4-to-final-reduce"},
+	5: {previousQueue: "q5-to-final-reduce"},
 }
 
 type FinalReducer struct {
-	middleware   *common.Middleware
-	connection   connection
-	queryNum     int
-	joinerShards int
-	sessions     map[string]*ClientSession
+	middleware    *common.Middleware
+	health        *common.HealthServer
+	drainTimeout  time.Duration
+	connection    connection
+	queryNum      int
+	joinerShards  int
+	sessions      map[string]*ClientSession
+	dedup         *common.DedupFilter
+	wal           *common.WAL
+	snapshotEvery int
+	replication   *replication
+	expiry        *common.SessionExpiry
+	sweepInterval time.Duration
 }
 
 type connection struct {
 	ChanToRecv <-chan common.Message
-	ChanToSend chan<- []byte
+	Results    *common.ResultsRouter
+	Control    <-chan common.Message
 }
 
-func NewFinalReducer(queryNum int, rabbitUser, rabbitPass string, amtOfShards int) (*FinalReducer, error) {
-	middleware, err := common.NewMiddleware(rabbitUser, rabbitPass, rabbitHost)
+func NewFinalReducer(cfg FinalReducerConfig) (*FinalReducer, error) {
+	middleware, err := common.NewMiddleware(cfg.Node)
 	if err != nil {
 		return nil, fmt.Errorf("error creating middleware: %w", err)
 	}
 
-	connection, err := initializeConnectionForQuery(queryNum, middleware)
+	connection, err := initializeConnectionForQuery(cfg.QueryNum, middleware)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing connection for query %d: %w", cfg.QueryNum, err)
+	}
+
+	var rep *replication
+	if cfg.Replicas > 1 {
+		if rep, err = newReplication(cfg, middleware); err != nil {
+			return nil, err
+		}
+	}
+
+	wal, err := common.OpenWAL(filepath.Join(cfg.StateDir, fmt.Sprintf("final-reducer-q%d", cfg.QueryNum)))
 	if err != nil {
-		return nil, fmt.Errorf("error initializing connection for query %d: %w", queryNum, err)
+		return nil, fmt.Errorf("error opening wal: %w", err)
 	}
 
 	return &FinalReducer{
-		middleware:   middleware,
-		connection:   connection,
-		queryNum:     queryNum,
-		joinerShards: amtOfShards,
-		sessions:     make(map[string]*ClientSession),
+		middleware:    middleware,
+		health:        common.NewHealthServer(cfg.Node, middleware),
+		drainTimeout:  cfg.DrainTimeout,
+		connection:    connection,
+		queryNum:      cfg.QueryNum,
+		joinerShards:  cfg.JoinerShards,
+		sessions:      make(map[string]*ClientSession),
+		dedup:         common.NewDedupFilter(cfg.SessionTTL),
+		wal:           wal,
+		snapshotEvery: cfg.SnapshotEvery,
+		replication:   rep,
+		expiry:        common.NewSessionExpiry(cfg.SessionTTL),
+		sweepInterval: cfg.SweepInterval,
 	}, nil
 }
 
 func initializeConnectionForQuery(queryNum int, middleware *common.Middleware) (connection, error) {
-	queuesNames, ok := queriesQueues[queryNum]
-	if !ok {
+	if _, ok := queriesQueues[queryNum]; !ok {
 		return connection{}, fmt.Errorf("query number %d not found", queryNum)
 	}
+	return connection{Results: common.NewResultsRouter(middleware, queryNum)}, nil
+}
 
-	previousChan, err := middleware.GetChanToRecv(queuesNames.previousQueue)
+// consumeInput registers the consumers of the input queue and of the control messages, only the
+// active replica consumes them
+func (r *FinalReducer) consumeInput() error {
+	previousQueue := queriesQueues[r.queryNum].previousQueue
+	previousChan, err := r.middleware.GetChanToRecv(previousQueue)
 	if err != nil {
-		return connection{}, fmt.Errorf("error getting channel %s to receive: %w", queuesNames.previousQueue, err)
+		return fmt.Errorf("error getting channel %s to receive: %w", previousQueue, err)
 	}
-
-	nextChan, err := middleware.GetChanToSend(queuesNames.nextQueue)
+	controlChan, err := r.middleware.GetBroadcastChanToRecv(common.ControlExchange, fmt.Sprintf("final-reducer-q%d", r.queryNum))
 	if err != nil {
-		return connection{}, fmt.Errorf("error getting channel %s to send: %w", queuesNames.nextQueue, err)
+		return fmt.Errorf("error getting control channel: %w", err)
 	}
-
-	return connection{previousChan, nextChan}, nil
+	r.connection.ChanToRecv = previousChan
+	r.connection.Control = controlChan
+	return nil
 }
 
 func (r *FinalReducer) Start() {
@@ -86,67 +119,231 @@ func (r *FinalReducer) Start() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	r.health.Start()
+	r.health.SetReady(true)
+
+	drainer := common.NewDrainer(ctx, r.middleware, r.drainTimeout)
+	defer drainer.Finish()
+
 	if r.queryNum == 2 {
 		slog.Info("starting final reducer for query 2")
-		r.startReceivingQ2(ctx)
+		r.startReceivingQ2(drainer)
 	} else if r.queryNum == 3 {
 		slog.Info("starting final reducer for query 3")
-		r.startReceivingQ3(ctx)
+		r.startReceivingQ3(drainer)
 	} else if r.queryNum == 4 {
 		slog.Info("starting final reducer for query 4")
-		r.startReceivingQ4(ctx)
+		r.startReceivingQ4(drainer)
 	} else if r.queryNum == 5 {
 		slog.Info("starting final reducer for query 5")
-		r.startReceivingQ5(ctx)
+		r.startReceivingQ5(drainer)
 	} else {
 		slog.Error("query number not found", slog.Int("query number", r.queryNum))
 		return
 	}
 }
 
-func startReceiving[T any](ctx context.Context, chanToRecv <-chan common.Message, sessions map[string]*ClientSession, finishAndSendBatch func(clientId string), processBatch func(batch common.Batch[T])) error {
-	for {
+// defaultClientID is the client of the batches that arrive without one
+const defaultClientID = "1"
+
+// expectedProducers is the number of EOF markers that end a stream of the client. The joined queries
+// get one from every joiner shard of the session, the ring stamped on its batches or the configured
+// shards, and the rest a single one from the gateway
+func (r *FinalReducer) expectedProducers(header common.Header) int {
+	if r.queryNum != 3 && r.queryNum != 4 {
+		return 1
+	}
+	if len(header.Shards) > 0 {
+		return len(header.Shards)
+	}
+	return r.joinerShards
+}
+
+func (r *FinalReducer) newSession(header common.Header) *ClientSession {
+	return NewClientSession(header.GetClientID(), r.expectedProducers(header))
+}
+
+// applyFunc applies a serialized batch to the sessions, returning the client it belongs to
+// and whether it was already applied before
+type applyFunc func(body []byte) (clientID string, duplicate bool, err error)
+
+// newApplier builds the applyFunc of a query, shared by the consumer and the recovery of the wal
+func newApplier[T any](r *FinalReducer, processBatch func(batch common.Batch[T])) applyFunc {
+	return func(body []byte) (string, bool, error) {
+		var batch common.Batch[T]
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return "", false, fmt.Errorf("error unmarshalling message: %w", err)
+		}
+
+		if batch.Header.GetClientID() == "" {
+			slog.Warn("client id is empty, using 1")
+			batch.Header.ClientID = defaultClientID
+		}
+
+		clientID := batch.GetClientID()
+		if r.dedup.IsDuplicate(batch.Header) {
+			return clientID, true, nil
+		}
+		if err := common.CheckProducers(batch.Header, r.expectedProducers(batch.Header)); err != nil {
+			return clientID, false, err
+		}
+
+		processBatch(batch)
+		r.expiry.Touch(clientID)
+
+		if err := r.sessions[clientID].Observe(batch.Header); err != nil {
+			return clientID, false, err
+		}
+		if batch.IsEof() {
+			slog.Info("eof marker received", slog.String("client id", clientID), slog.String("producer", batch.ProducerID), slog.Any("eof weight", batch.TotalWeight), slog.Any("producers", batch.Producers))
+		}
+		return clientID, false, nil
+	}
+}
+
+func (r *FinalReducer) startReceiving(drainer *common.Drainer, apply applyFunc, finishAndSendBatch func(clientId string)) error {
+	if err := r.recover(apply); err != nil {
+		return fmt.Errorf("error recovering state: %w", err)
+	}
+
+	var feed <-chan common.Message
+	if r.replication != nil {
+		active, err := r.standBy(drainer, apply, finishAndSendBatch)
+		if err != nil || !active {
+			return err
+		}
+		feed = r.replication.feed
+	}
+
+	if err := r.finishCompleted(finishAndSendBatch); err != nil {
+		return err
+	}
+	if err := r.consumeInput(); err != nil {
+		return err
+	}
+
+	chanToRecv, control := r.connection.ChanToRecv, r.connection.Control
+	ticker := time.NewTicker(common.HealthTickInterval)
+	defer ticker.Stop()
+	sweeper := time.NewTicker(r.sweepInterval)
+	defer sweeper.Stop()
+	for chanToRecv != nil || feed != nil {
 		select {
-		case <-ctx.Done():
-			return nil
-		case msg := <-chanToRecv:
-			var batch common.Batch[T]
-			if err := json.Unmarshal(msg.Body, &batch); err != nil {
-				slog.Error("error unmarshalling message", slog.String("error", err.Error()))
+		case <-drainer.Signal():
+			slog.Info("received termination signal, draining final reducer")
+			r.health.SetReady(false)
+			drainer.Start()
+		case <-drainer.Expired():
+			return fmt.Errorf("drain timeout expired")
+		case <-ticker.C:
+			r.health.Tick()
+		case <-sweeper.C:
+			if err := r.expireSessions(); err != nil {
+				return err
+			}
+		case msg, ok := <-chanToRecv:
+			if !ok {
+				chanToRecv = nil
 				continue
 			}
-
-			if batch.Header.GetClientID() == "" {
-				slog.Warn("client id is empty, using 1")
-				batch.Header.ClientID = "1"
+			if err := r.handleMessage(msg, apply, finishAndSendBatch); err != nil {
+				return err
+			}
+		case msg, ok := <-control:
+			if !ok {
+				control = nil
+				continue
 			}
+			if err := r.handleControl(msg); err != nil {
+				return err
+			}
+		case msg, ok := <-feed:
+			if !ok {
+				feed = nil
+				continue
+			}
+			if err := r.handleReplicated(msg, apply, finishAndSendBatch, true); err != nil {
+				return err
+			}
+		}
+	}
+	slog.Info("final reducer drained")
+	return nil
+}
 
-			processBatch(batch)
+const (
+	// crashAfterLogBeforeAck leaves a batch in the wal but unacked, so it is redelivered after the replay
+	crashAfterLogBeforeAck = "final-reducer.after-log-before-ack"
+	// crashAfterSendBeforeFinished leaves a result sent but the session not logged as finished
+	crashAfterSendBeforeFinished = "final-reducer.after-send-before-finished"
+)
 
-			clientID := batch.GetClientID()
-			sessions[clientID].AddCurrentWeight(batch.Header.Weight)
-			if batch.IsEof() {
-				slog.Info("setting eof weight", slog.String("client id", clientID), slog.Any("eof weight", int32(batch.Header.TotalWeight)))
-				sessions[clientID].SetEofWeight(int32(batch.Header.TotalWeight))
-			}
+// handleMessage applies a batch once it is durable in the wal and confirmed in the feed of the standby,
+// and only then acks it. Batches already applied are acked without being logged nor forwarded
+func (r *FinalReducer) handleMessage(msg common.Message, apply applyFunc, finishAndSendBatch func(clientId string)) error {
+	header, err := common.HeaderOf(msg)
+	if err != nil {
+		slog.Error("dropping malformed message")
+		if err := msg.Ack(); err != nil {
+			slog.Error("error acknowledging message", slog.String("error", err.Error()))
+		}
+		return nil
+	}
+	if header.GetClientID() == "" {
+		header.ClientID = defaultClientID
+	}
+	if r.dedup.Seen(header) {
+		slog.Debug("dropping duplicate batch", slog.String("client id", header.ClientID))
+		if err := msg.Ack(); err != nil {
+			slog.Error("error acknowledging message", slog.String("error", err.Error()))
+		}
+		return nil
+	}
 
-			if err := msg.Ack(); err != nil {
-				slog.Error("error acknowledging message", slog.String("error", err.Error()))
-			}
+	if err := r.record(walRecord{Kind: batchRecord, Body: msg.Body}); err != nil {
+		return fmt.Errorf("error logging batch: %w", err)
+	}
 
-			if sessions[clientID].IsFinished() {
-				slog.Info("finishing and sending batch", slog.String("client id", clientID), slog.String("message weight", fmt.Sprintf("%d", batch.Header.Weight)))
-				finishAndSendBatch(clientID)
-			}
+	clientID, duplicate, err := apply(msg.Body)
+	common.CrashPoint(crashAfterLogBeforeAck)
+	if ackErr := msg.Ack(); ackErr != nil {
+		slog.Error("error acknowledging message", slog.String("error", ackErr.Error()))
+	}
+	if err != nil {
+		slog.Error("error processing message", slog.String("error", err.Error()))
+		return nil
+	}
+	if duplicate {
+		slog.Debug("dropping duplicate batch", slog.String("client id", clientID))
+		return nil
+	}
+
+	if r.sessions[clientID].IsFinished() {
+		slog.Info("finishing and sending batch", slog.String("client id", clientID))
+		if err := r.finishSession(clientID, finishAndSendBatch); err != nil {
+			return err
 		}
 	}
+	return r.maybeSnapshot()
+}
+
+// finishSession sends the result of a client and logs it, so a restart does not send it again
+func (r *FinalReducer) finishSession(clientID string, finishAndSendBatch func(clientId string)) error {
+	finishAndSendBatch(clientID)
+	common.CrashPoint(crashAfterSendBeforeFinished)
+	r.dedup.Close(clientID)
+	r.expiry.Forget(clientID)
+	if err := r.record(walRecord{Kind: finishedRecord, ClientID: clientID}); err != nil {
+		return fmt.Errorf("error logging finished session: %w", err)
+	}
+	return nil
 }
 
-func (r *FinalReducer) startReceivingQ2(ctx context.Context) {
-	err := startReceiving(ctx, r.connection.ChanToRecv, r.sessions, r.finishAndSendBatchForQuery2, func(batch common.Batch[common.CountryBudget]) {
+func (r *FinalReducer) startReceivingQ2(drainer *common.Drainer) {
+	err := r.startReceiving(drainer, newApplier(r, func(batch common.Batch[common.CountryBudget]) {
 		clientID := batch.Header.GetClientID()
 		if _, ok := r.sessions[clientID]; !ok {
-			r.sessions[clientID] = NewClientSession(clientID, 1)
+			r.sessions[clientID] = r.newSession(batch.Header)
 			r.sessions[clientID].SetData(make(map[pkg.Country]uint64))
 		}
 
@@ -161,18 +358,18 @@ func (r *FinalReducer) startReceivingQ2(ctx context.Context) {
 		}
 		//TODO: Por que anda si no hice setData?
 
-	})
+	}), r.finishAndSendBatchForQuery2)
 
 	if err != nil {
 		slog.Error("error receiving", slog.String("error", err.Error()))
 	}
 }
 
-func (r *FinalReducer) startReceivingQ3(ctx context.Context) {
-	err := startReceiving(ctx, r.connection.ChanToRecv, r.sessions, r.finishAndSendBatchForQuery3, func(batch common.Batch[common.MovieAvgRating]) {
+func (r *FinalReducer) startReceivingQ3(drainer *common.Drainer) {
+	err := r.startReceiving(drainer, newApplier(r, func(batch common.Batch[common.MovieAvgRating]) {
 		clientID := batch.Header.GetClientID()
 		if _, ok := r.sessions[clientID]; !ok {
-			r.sessions[clientID] = NewClientSession(clientID, uint32(r.joinerShards))
+			r.sessions[clientID] = r.newSession(batch.Header)
 			r.sessions[clientID].SetData(make(map[string]common.MovieAvgRating))
 		}
 
@@ -193,18 +390,18 @@ func (r *FinalReducer) startReceivingQ3(ctx context.Context) {
 		}
 		//TODO: Por que anda si no hice setData?
 
-	})
+	}), r.finishAndSendBatchForQuery3)
 
 	if err != nil {
 		slog.Error("error receiving", slog.String("error", err.Error()))
 	}
 }
 
-func (r *FinalReducer) startReceivingQ4(ctx context.Context) {
-	err := startReceiving(ctx, r.connection.ChanToRecv, r.sessions, r.finishAndSendBatchForQuery4, func(batch common.Batch[common.ActorMoviesAmount]) {
+func (r *FinalReducer) startReceivingQ4(drainer *common.Drainer) {
+	err := r.startReceiving(drainer, newApplier(r, func(batch common.Batch[common.ActorMoviesAmount]) {
 		clientID := batch.Header.GetClientID()
 		if _, ok := r.sessions[clientID]; !ok {
-			r.sessions[clientID] = NewClientSession(clientID, uint32(r.joinerShards))
+			r.sessions[clientID] = r.newSession(batch.Header)
 			r.sessions[clientID].SetData(make(map[string]common.ActorMoviesAmount))
 		}
 
@@ -224,19 +421,19 @@ func (r *FinalReducer) startReceivingQ4(ctx context.Context) {
 		}
 
 		//TODO: Por que anda si no hice setData?
-	})
+	}), r.finishAndSendBatchForQuery4)
 
 	if err != nil {
 		slog.Error("error receiving", slog.String("error", err.Error()))
 	}
 }
 
-func (r *FinalReducer) startReceivingQ5(ctx context.Context) {
+func (r *FinalReducer) startReceivingQ5(drainer *common.Drainer) {
 	//TODO: add sessions here instead of in the struct and use generics
-	err := startReceiving(ctx, r.connection.ChanToRecv, r.sessions, r.finishAndSendBatchForQuery5, func(batch common.Batch[common.SentimentProfitRatioAccumulator]) {
+	err := r.startReceiving(drainer, newApplier(r, func(batch common.Batch[common.SentimentProfitRatioAccumulator]) {
 		clientID := batch.Header.GetClientID()
 		if _, ok := r.sessions[clientID]; !ok {
-			r.sessions[clientID] = NewClientSession(clientID, 1)
+			r.sessions[clientID] = r.newSession(batch.Header)
 			r.sessions[clientID].SetData(common.SentimentProfitRatioAccumulator{})
 		}
 
@@ -259,13 +456,20 @@ func (r *FinalReducer) startReceivingQ5(ctx context.Context) {
 		}
 
 		r.sessions[clientID].SetData(sentimentProfitRatios)
-	})
+	}), r.finishAndSendBatchForQuery5)
 
 	if err != nil {
 		slog.Error("error receiving", slog.String("error", err.Error()))
 	}
 }
 
+// sendResult publishes the result of a client to the gateway serving it
+func (r *FinalReducer) sendResult(clientId string, response []byte) {
+	if err := r.connection.Results.Send(r.sessions[clientId].GatewayID(), response); err != nil {
+		slog.Error("error sending result", slog.String("client id", clientId), slog.String("error", err.Error()))
+	}
+}
+
 func (r *FinalReducer) finishAndSendBatchForQuery2(clientId string) {
 	slog.Info("finishing and sending batch for query 2", slog.String("client id", clientId))
 	countries := r.sessions[clientId].GetData().(map[pkg.Country]uint64)
@@ -275,7 +479,7 @@ func (r *FinalReducer) finishAndSendBatchForQuery2(clientId string) {
 	if err != nil {
 		slog.Error("error marshalling response", slog.String("error", err.Error()))
 	}
-	r.connection.ChanToSend <- response
+	r.sendResult(clientId, response)
 	slog.Info("sent query2 final response")
 	delete(r.sessions, clientId)
 }
@@ -289,7 +493,7 @@ func (r *FinalReducer) finishAndSendBatchForQuery3(clientId string) {
 	if err != nil {
 		slog.Error("error marshalling response", slog.String("error", err.Error()))
 	}
-	r.connection.ChanToSend <- response
+	r.sendResult(clientId, response)
 	slog.Info("sent query3 final response", slog.String("best movie id", bestAndWorstMovies.BestMovie.MovieID), slog.String("worst movie id", bestAndWorstMovies.WorstMovie.MovieID))
 	delete(r.sessions, clientId)
 }
@@ -303,7 +507,7 @@ func (r *FinalReducer) finishAndSendBatchForQuery4(clientId string) {
 	if err != nil {
 		slog.Error("error marshalling response", slog.String("error", err.Error()))
 	}
-	r.connection.ChanToSend <- response
+	r.sendResult(clientId, response)
 	slog.Info("sent query4 final response", slog.Any("top10 actors", top10Actors))
 	delete(r.sessions, clientId)
 }
@@ -317,7 +521,7 @@ func (r *FinalReducer) finishAndSendBatchForQuery5(clientId string) {
 	if err != nil {
 		slog.Error("error marshalling response", slog.String("error", err.Error()))
 	}
-	r.connection.ChanToSend <- response
+	r.sendResult(clientId, response)
 	slog.Info("sent query5 final response", slog.Float64("positive avg profit ratio", sentimentProfitRatioAverage.PositiveAvgProfitRatio), slog.Float64("negative avg profit ratio", sentimentProfitRatioAverage.NegativeAvgProfitRatio))
 	delete(r.sessions, clientId)
 }
@@ -421,8 +625,14 @@ func calculateSentimentProfitRatioAverage(sentimentProfitRatios common.Sentiment
 }
 
 func (r *FinalReducer) stop() {
+	if err := r.health.Close(); err != nil {
+		slog.Error("error closing health server", slog.String("error", err.Error()))
+	}
 	if err := r.middleware.Close(); err != nil {
 		slog.Error("error closing middleware", slog.String("error", err.Error()))
 	}
+	if err := r.wal.Close(); err != nil {
+		slog.Error("error closing wal", slog.String("error", err.Error()))
+	}
 	slog.Info("final reducer stopped")
 }
@@ -3,11 +3,24 @@ package main
 import (
 	"fmt"
 	"log/slog"
-	"os"
+	"pkg/config"
 	"pkg/log"
-	"strconv"
+	"time"
 )
 
+type FinalReducerConfig struct {
+	config.Node
+	config.Persistence
+	config.Sessions
+	QueryNum int `env:"QUERY_NUM" json:"query_num" required:"true" min:"2"`
+	// Joiner shards of the sessions without a ring of their own, each one sends an EOF marker to queries 3 and 4
+	JoinerShards int `env:"JOINER_SHARDS" json:"joiner_shards" default:"1" min:"1"`
+	// Replicas is 2 when the query runs a standby final reducer next to the active one
+	Replicas   int           `env:"REPLICAS" json:"replicas" default:"1" min:"1"`
+	ReplicaID  int           `env:"REPLICA_ID" json:"replica_id" default:"1" min:"1"`
+	LeaseRetry time.Duration `env:"LEASE_RETRY" json:"lease_retry" default:"2s"`
+}
+
 func main() {
 	logger, err := log.SetupLogger("reducer", false, nil)
 	if err != nil {
@@ -16,29 +29,14 @@ func main() {
 	}
 	slog.SetDefault(logger)
 
-	rabbitUser := os.Getenv("RABBITMQ_DEFAULT_USER")
-	rabbitPass := os.Getenv("RABBITMQ_DEFAULT_PASS")
-	queryNum := os.Getenv("QUERY_NUM")
-	joinerShards := os.Getenv("JOINER_SHARDS")
-
-	if rabbitUser == "" || rabbitPass == "" || queryNum == "" {
-		slog.Error("environment validation failed", slog.String("error", "RABBITMQ_DEFAULT_USER and RABBITMQ_DEFAULT_PASS and QUERY_NUM must be set"))
-		return
-	}
-
-	queryNumInt, err := strconv.Atoi(queryNum)
-	if err != nil {
-		slog.Error("error converting query number to int", slog.String("error", err.Error()))
-		return
-	}
-
-	joinerAmt, err := strconv.Atoi(joinerShards)
-	if err != nil {
-		slog.Error("error converting joiner shards number to int", slog.String("error", err.Error()))
+	var cfg FinalReducerConfig
+	if err := config.Load(&cfg); err != nil {
+		slog.Error("configuration validation failed", slog.String("error", err.Error()))
 		return
 	}
+	config.Log(cfg)
 
-	reducer, err := NewFinalReducer(queryNumInt, rabbitUser, rabbitPass, joinerAmt)
+	reducer, err := NewFinalReducer(cfg)
 	if err != nil {
 		slog.Error("error creating reducer", slog.String("error", err.Error()))
 		return
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+	"tp-sistemas-distribuidos/server/common"
+)
+
+// replication pairs the final reducer of a query with a standby replica. The replica holding the lease
+// is the active one: it consumes the input, sends the results and forwards every record it logs to the
+// feed of the other replica, which applies them to stay warm and takes over once the lease expires
+type replication struct {
+	lease  string
+	feed   <-chan common.Message
+	toPeer func(data []byte) error // returns once the broker confirmed the record
+	retry  time.Duration
+}
+
+func newReplication(cfg FinalReducerConfig, middleware *common.Middleware) (*replication, error) {
+	if cfg.Replicas > 2 {
+		return nil, fmt.Errorf("a final reducer supports one standby replica, got %d replicas", cfg.Replicas)
+	}
+	if cfg.ReplicaID > cfg.Replicas {
+		return nil, fmt.Errorf("replica id %d is out of range for %d replicas", cfg.ReplicaID, cfg.Replicas)
+	}
+	peerID := cfg.Replicas + 1 - cfg.ReplicaID
+
+	feed, err := middleware.GetChanToRecv(feedQueue(cfg.QueryNum, cfg.ReplicaID))
+	if err != nil {
+		return nil, fmt.Errorf("error getting replication feed: %w", err)
+	}
+	peerFeed := feedQueue(cfg.QueryNum, peerID)
+	if err := middleware.DeclareQueue(peerFeed); err != nil {
+		return nil, fmt.Errorf("error declaring replication feed of replica %d: %w", peerID, err)
+	}
+
+	return &replication{
+		lease: fmt.Sprintf("q%d-final-lease", cfg.QueryNum),
+		feed:  feed,
+		toPeer: func(data []byte) error {
+			return middleware.SendConfirmed(context.Background(), peerFeed, data)
+		},
+		retry: cfg.LeaseRetry,
+	}, nil
+}
+
+func feedQueue(queryNum, replicaID int) string {
+	return fmt.Sprintf("q%d-final-feed-%d", queryNum, replicaID)
+}
+
+// forward sends the record to the other replica and waits until the broker has it, so the input it
+// comes from is only acked once the standby can not miss it
+func (rep *replication) forward(record walRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error marshalling replicated record: %w", err)
+	}
+	if err := rep.toPeer(data); err != nil {
+		return fmt.Errorf("error forwarding record to the standby: %w", err)
+	}
+	return nil
+}
+
+// standBy applies the records of the active replica until the lease is acquired. It returns false
+// if the node was asked to stop before taking over
+func (r *FinalReducer) standBy(drainer *common.Drainer, apply applyFunc, finishAndSendBatch func(clientId string)) (bool, error) {
+	leaseTicker := time.NewTicker(r.replication.retry)
+	defer leaseTicker.Stop()
+	healthTicker := time.NewTicker(common.HealthTickInterval)
+	defer healthTicker.Stop()
+
+	slog.Info("waiting for the lease as standby", slog.String("lease", r.replication.lease))
+	for {
+		if !drainer.IsDraining() {
+			acquired, err := r.middleware.AcquireLease(r.replication.lease)
+			if err != nil {
+				return false, err
+			}
+			if acquired {
+				slog.Info("lease acquired, taking over", slog.String("lease", r.replication.lease))
+				return true, nil
+			}
+		}
+
+	wait:
+		for {
+			select {
+			case <-drainer.Signal():
+				slog.Info("received termination signal, draining standby final reducer")
+				r.health.SetReady(false)
+				drainer.Start()
+			case <-drainer.Expired():
+				return false, fmt.Errorf("drain timeout expired")
+			case <-healthTicker.C:
+				r.health.Tick()
+			case <-leaseTicker.C:
+				break wait
+			case msg, ok := <-r.replication.feed:
+				if !ok {
+					return false, nil
+				}
+				if err := r.handleReplicated(msg, apply, finishAndSendBatch, false); err != nil {
+					return false, err
+				}
+			}
+		}
+	}
+}
+
+// handleReplicated applies a record forwarded by the other replica. Only the active replica finishes
+// sessions; records left in its feed by a previous active replica are applied after a takeover
+func (r *FinalReducer) handleReplicated(msg common.Message, apply applyFunc, finishAndSendBatch func(clientId string), active bool) error {
+	var record walRecord
+	if err := json.Unmarshal(msg.Body, &record); err != nil {
+		slog.Error("dropping malformed replicated record", slog.String("error", err.Error()))
+		if ackErr := msg.Ack(); ackErr != nil {
+			slog.Error("error acknowledging message", slog.String("error", ackErr.Error()))
+		}
+		return nil
+	}
+
+	if err := r.logRecord(record); err != nil {
+		return fmt.Errorf("error logging replicated record: %w", err)
+	}
+
+	switch record.Kind {
+	case batchRecord:
+		clientID, duplicate, err := apply(record.Body)
+		if err != nil {
+			slog.Error("error applying replicated batch", slog.String("error", err.Error()))
+		} else if active && !duplicate && r.sessions[clientID].IsFinished() {
+			if err := r.finishSession(clientID, finishAndSendBatch); err != nil {
+				return err
+			}
+		}
+	case finishedRecord, expiredRecord, cancelledRecord:
+		r.closeSession(record.ClientID)
+	case movedRecord:
+		r.moveSession(record)
+	}
+
+	if err := msg.Ack(); err != nil {
+		slog.Error("error acknowledging message", slog.String("error", err.Error()))
+	}
+	return r.maybeSnapshot()
+}
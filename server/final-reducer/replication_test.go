@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	pkg "pkg/models"
+	"tp-sistemas-distribuidos/server/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func countryBatch(t *testing.T, seq uint64, totalWeight int32) []byte {
+	batch := common.Batch[common.CountryBudget]{
+		Header: common.Header{Weight: 1, TotalWeight: totalWeight, ClientID: "client", ProducerID: "reducer", Seq: seq},
+		Data:   []common.CountryBudget{{Country: pkg.Country{Code: "US", Name: "USA"}, Budget: 10}},
+	}
+	body, err := json.Marshal(batch)
+	require.NoError(t, err)
+	return body
+}
+
+func testApplier(r *FinalReducer) applyFunc {
+	return newApplier(r, func(batch common.Batch[common.CountryBudget]) {
+		if _, ok := r.sessions[batch.GetClientID()]; !ok {
+			r.sessions[batch.GetClientID()] = r.newSession(batch.Header)
+		}
+	})
+}
+
+func TestStandbyTakesOverWithoutDuplicatingResults(t *testing.T) {
+	toPeer := make(chan []byte, 10)
+	active := newTestReducer(t, t.TempDir())
+	active.replication = &replication{toPeer: func(data []byte) error {
+		toPeer <- data
+		return nil
+	}}
+	standby := newTestReducer(t, t.TempDir())
+
+	sent := 0
+	finish := func(clientID string) {
+		sent++
+		delete(standby.sessions, clientID)
+	}
+	notSent := func(string) { t.Fatal("the standby must not send results") }
+
+	// Only the batches reach the standby, as if the active replica crashed before sending the result
+	require.NoError(t, active.handleMessage(common.Message{Body: countryBatch(t, 1, -1)}, testApplier(active), notSent))
+	require.NoError(t, active.handleMessage(common.Message{Body: countryBatch(t, 2, 2)}, testApplier(active), func(string) {}))
+	forwarded := [][]byte{<-toPeer, <-toPeer}
+
+	for _, data := range forwarded {
+		require.NoError(t, standby.handleReplicated(common.Message{Body: data}, testApplier(standby), notSent, false))
+	}
+	require.True(t, standby.sessions["client"].IsFinished())
+
+	require.NoError(t, standby.finishCompleted(finish))
+	require.Equal(t, 1, sent)
+
+	// Batches redelivered to the new active replica were already applied
+	require.NoError(t, standby.handleMessage(common.Message{Body: countryBatch(t, 2, 2)}, testApplier(standby), finish))
+	require.NoError(t, standby.handleReplicated(common.Message{Body: forwarded[1]}, testApplier(standby), finish, true))
+	require.Equal(t, 1, sent)
+	require.NotContains(t, standby.sessions, "client")
+}
+
+func TestActiveForwardsABatchAgainIfTheStandbyMissedIt(t *testing.T) {
+	active := newTestReducer(t, t.TempDir())
+	var forwarded [][]byte
+	failing := true
+	active.replication = &replication{toPeer: func(data []byte) error {
+		if failing {
+			return errors.New("connection lost")
+		}
+		forwarded = append(forwarded, data)
+		return nil
+	}}
+
+	// The batch is not acked, so the broker delivers it again
+	require.Error(t, active.handleMessage(common.Message{Body: countryBatch(t, 1, -1)}, testApplier(active), func(string) {}))
+	failing = false
+	require.NoError(t, active.handleMessage(common.Message{Body: countryBatch(t, 1, -1)}, testApplier(active), func(string) {}))
+	require.Len(t, forwarded, 1)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"tp-sistemas-distribuidos/server/common"
+
+	pkg "pkg/models"
+)
+
+const (
+	batchRecord     = "batch"
+	finishedRecord  = "finished"
+	expiredRecord   = "expired"
+	cancelledRecord = "cancelled"
+	movedRecord     = "moved"
+)
+
+// walRecord is a change to the sessions: an input batch, a client whose result was already sent,
+// a client whose session expired or was cancelled, or one now served by the gateway in the body
+type walRecord struct {
+	Kind     string          `json:"kind"`
+	ClientID string          `json:"client_id,omitempty"`
+	Body     json.RawMessage `json:"body,omitempty"`
+}
+
+type sessionState struct {
+	ID      string             `json:"id"`
+	Gateway string             `json:"gateway,omitempty"`
+	Eof     *common.EofTracker `json:"eof"`
+	Data    json.RawMessage    `json:"data"`
+}
+
+type reducerState struct {
+	Sessions []sessionState    `json:"sessions"`
+	Dedup    common.DedupState `json:"dedup"`
+}
+
+func (r *FinalReducer) logRecord(record walRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error marshalling wal record: %w", err)
+	}
+	return r.wal.Append(data)
+}
+
+// record forwards a change to the standby replica, if there is one, and logs it. It is forwarded first:
+// a change logged but not forwarded would be taken as applied when its input is redelivered after a
+// crash, and never reach the standby, while one forwarded twice is dropped by the standby
+func (r *FinalReducer) record(record walRecord) error {
+	if r.replication != nil {
+		if err := r.replication.forward(record); err != nil {
+			return err
+		}
+	}
+	return r.logRecord(record)
+}
+
+func (r *FinalReducer) closeSession(clientID string) {
+	delete(r.sessions, clientID)
+	r.dedup.Close(clientID)
+	r.expiry.Forget(clientID)
+}
+
+// expireSessions evicts the sessions whose client stopped sending batches for longer than the ttl,
+// and forgets the clients finished for longer than it
+func (r *FinalReducer) expireSessions() error {
+	r.dedup.Expire()
+	for _, clientID := range r.expiry.Expired() {
+		if _, ok := r.sessions[clientID]; !ok {
+			continue
+		}
+		slog.Warn("session expired, evicting it", slog.String("client id", clientID))
+		if err := r.record(walRecord{Kind: expiredRecord, ClientID: clientID}); err != nil {
+			return fmt.Errorf("error logging expired session: %w", err)
+		}
+		r.closeSession(clientID)
+	}
+	return r.maybeSnapshot()
+}
+
+// handleControl follows an order broadcast by the gateways. A cancelled session is closed even if it
+// was not seen yet, so the batches of it still on their way are dropped, and the result of a session
+// that moved is sent to its new gateway
+func (r *FinalReducer) handleControl(msg common.Message) error {
+	control, err := common.DecodeControlMsg(msg.Body)
+	switch {
+	case err != nil:
+		slog.Error("dropping control message", slog.String("error", err.Error()))
+	case control.Kind == common.CancelSession:
+		slog.Warn("session cancelled, evicting it", slog.String("client id", control.ClientID))
+		if err := r.record(walRecord{Kind: cancelledRecord, ClientID: control.ClientID}); err != nil {
+			return fmt.Errorf("error logging cancelled session: %w", err)
+		}
+		r.closeSession(control.ClientID)
+	case control.Kind == common.MoveSession:
+		if session, ok := r.sessions[control.ClientID]; ok {
+			slog.Info("session moved", slog.String("client id", control.ClientID), slog.String("gateway", control.Gateway))
+			if err := r.record(walRecord{Kind: movedRecord, ClientID: control.ClientID, Body: gatewayBody(control.Gateway)}); err != nil {
+				return fmt.Errorf("error logging moved session: %w", err)
+			}
+			session.gatewayID = control.Gateway
+		}
+	}
+	if err := msg.Ack(); err != nil {
+		slog.Error("error acknowledging message", slog.String("error", err.Error()))
+	}
+	return r.maybeSnapshot()
+}
+
+func gatewayBody(gateway string) json.RawMessage {
+	body, _ := json.Marshal(gateway)
+	return body
+}
+
+// moveSession applies a moved record, logged or forwarded by the other replica
+func (r *FinalReducer) moveSession(record walRecord) {
+	var gateway string
+	if err := json.Unmarshal(record.Body, &gateway); err != nil {
+		slog.Error("error unmarshalling moved session", slog.String("error", err.Error()))
+		return
+	}
+	if session, ok := r.sessions[record.ClientID]; ok {
+		session.gatewayID = gateway
+	}
+}
+
+// recover rebuilds the sessions from the last snapshot and the records logged after it
+func (r *FinalReducer) recover(apply applyFunc) error {
+	snapshot, records, err := r.wal.Recover()
+	if err != nil {
+		return err
+	}
+	if snapshot != nil {
+		if err := r.restore(snapshot); err != nil {
+			return fmt.Errorf("error restoring snapshot: %w", err)
+		}
+	}
+
+	for _, data := range records {
+		var record walRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("error unmarshalling wal record: %w", err)
+		}
+		switch record.Kind {
+		case batchRecord:
+			if _, _, err := apply(record.Body); err != nil {
+				slog.Error("error replaying batch", slog.String("error", err.Error()))
+			}
+		case finishedRecord, expiredRecord, cancelledRecord:
+			r.closeSession(record.ClientID)
+		case movedRecord:
+			r.moveSession(record)
+		}
+	}
+	// The idle time before a restart is not known, recovered sessions get a whole ttl
+	for clientID := range r.sessions {
+		r.expiry.Touch(clientID)
+	}
+
+	slog.Info("state recovered", slog.Int("sessions", len(r.sessions)), slog.Int("replayed records", len(records)))
+	return nil
+}
+
+// finishCompleted finishes the sessions that were completed but whose result may not have been sent,
+// either by this node before a restart or by the replica it took over from. The gateway drops the
+// results of a query it already has, so a result sent twice does not reach the client twice
+func (r *FinalReducer) finishCompleted(finishAndSendBatch func(clientId string)) error {
+	for clientID, session := range r.sessions {
+		if session.IsFinished() {
+			slog.Info("finishing recovered session", slog.String("client id", clientID))
+			if err := r.finishSession(clientID, finishAndSendBatch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *FinalReducer) maybeSnapshot() error {
+	if r.wal.Entries() < r.snapshotEvery {
+		return nil
+	}
+	state := reducerState{Sessions: make([]sessionState, 0, len(r.sessions)), Dedup: r.dedup.State()}
+	for id, session := range r.sessions {
+		data, err := encodeSessionData(session.GetData())
+		if err != nil {
+			return fmt.Errorf("error encoding session %s: %w", id, err)
+		}
+		state.Sessions = append(state.Sessions, sessionState{
+			ID:      id,
+			Gateway: session.gatewayID,
+			Eof:     session.eof,
+			Data:    data,
+		})
+	}
+
+	snapshot, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error marshalling snapshot: %w", err)
+	}
+	if err := r.wal.Snapshot(snapshot); err != nil {
+		return err
+	}
+	slog.Debug("snapshot taken", slog.Int("sessions", len(state.Sessions)))
+	return nil
+}
+
+func (r *FinalReducer) restore(snapshot []byte) error {
+	var state reducerState
+	if err := json.Unmarshal(snapshot, &state); err != nil {
+		return err
+	}
+	for _, saved := range state.Sessions {
+		data, err := r.decodeSessionData(saved.Data)
+		if err != nil {
+			return fmt.Errorf("error decoding session %s: %w", saved.ID, err)
+		}
+		session := NewClientSession(saved.ID, 1)
+		session.gatewayID = saved.Gateway
+		if saved.Eof != nil {
+			session.eof = saved.Eof
+		}
+		session.SetData(data)
+		r.sessions[saved.ID] = session
+	}
+	r.dedup.Restore(state.Dedup)
+	return nil
+}
+
+// encodeSessionData serializes the partial aggregate of a session. Country keys can not be json keys,
+// so the budgets of query 2 are stored as a list
+func encodeSessionData(data any) (json.RawMessage, error) {
+	if countries, ok := data.(map[pkg.Country]uint64); ok {
+		budgets := make([]common.CountryBudget, 0, len(countries))
+		for country, budget := range countries {
+			budgets = append(budgets, common.CountryBudget{Country: country, Budget: budget})
+		}
+		data = budgets
+	}
+	return json.Marshal(data)
+}
+
+func (r *FinalReducer) decodeSessionData(raw json.RawMessage) (any, error) {
+	switch r.queryNum {
+	case 2:
+		var budgets []common.CountryBudget
+		if err := json.Unmarshal(raw, &budgets); err != nil {
+			return nil, err
+		}
+		countries := make(map[pkg.Country]uint64, len(budgets))
+		for _, countryBudget := range budgets {
+			countries[countryBudget.Country] = countryBudget.Budget
+		}
+		return countries, nil
+	case 3:
+		return decodeAs[map[string]common.MovieAvgRating](raw)
+	case 4:
+		return decodeAs[map[string]common.ActorMoviesAmount](raw)
+	case 5:
+		return decodeAs[common.SentimentProfitRatioAccumulator](raw)
+	default:
+		return nil, fmt.Errorf("query number %d not found", r.queryNum)
+	}
+}
+
+func decodeAs[T any](raw json.RawMessage) (any, error) {
+	var data T
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pkg "pkg/models"
+	"tp-sistemas-distribuidos/server/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestReducer(t *testing.T, dir string) *FinalReducer {
+	wal, err := common.OpenWAL(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = wal.Close() })
+	return &FinalReducer{
+		queryNum:      2,
+		sessions:      make(map[string]*ClientSession),
+		dedup:         common.NewDedupFilter(0),
+		wal:           wal,
+		snapshotEvery: 2,
+		expiry:        common.NewSessionExpiry(time.Minute),
+	}
+}
+
+func TestFinalReducerRecoversSessions(t *testing.T) {
+	dir := t.TempDir()
+	usa := pkg.Country{Code: "US", Name: "USA"}
+
+	reducer := newTestReducer(t, dir)
+	session := NewClientSession("client", 1)
+	session.Observe(common.Header{Weight: 3, ClientID: "client", ProducerID: "gateway", GatewayID: "gateway-2"})
+	session.SetData(map[pkg.Country]uint64{usa: 1000})
+	reducer.sessions["client"] = session
+	reducer.dedup.IsDuplicate(common.Header{ClientID: "client", ProducerID: "gateway", Seq: 1})
+
+	require.NoError(t, reducer.wal.Append([]byte(`{"kind":"noop"}`)))
+	require.NoError(t, reducer.wal.Append([]byte(`{"kind":"noop"}`)))
+	require.NoError(t, reducer.maybeSnapshot())
+	require.Equal(t, 0, reducer.wal.Entries())
+
+	recovered := newTestReducer(t, dir)
+	require.NoError(t, recovered.recover(nil))
+	require.NoError(t, recovered.finishCompleted(func(string) { t.Fatal("session is not finished") }))
+
+	require.Contains(t, recovered.sessions, "client")
+	require.Equal(t, map[string]uint32{"gateway": 3}, recovered.sessions["client"].eof.Received)
+	require.Equal(t, map[pkg.Country]uint64{usa: 1000}, recovered.sessions["client"].GetData())
+	require.Equal(t, "gateway-2", recovered.sessions["client"].GatewayID())
+	require.True(t, recovered.dedup.IsDuplicate(common.Header{ClientID: "client", ProducerID: "gateway", Seq: 1}))
+}
+
+func TestFinalReducerDoesNotLogDuplicates(t *testing.T) {
+	reducer := newTestReducer(t, t.TempDir())
+	reducer.snapshotEvery = 10
+	applied := 0
+	apply := newApplier(reducer, func(batch common.Batch[common.CountryBudget]) {
+		applied++
+		if _, ok := reducer.sessions[batch.ClientID]; !ok {
+			reducer.sessions[batch.ClientID] = reducer.newSession(batch.Header)
+		}
+	})
+
+	msg := common.Message{Body: []byte(`{"header":{"weight":1,"client_id":"client","producer_id":"reducer-1","seq":1},"data":[]}`)}
+	for range 3 {
+		require.NoError(t, reducer.handleMessage(msg, apply, func(string) { t.Fatal("session is not finished") }))
+	}
+	require.Equal(t, 1, applied)
+	require.Equal(t, 1, reducer.wal.Entries())
+}
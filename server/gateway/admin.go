@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// AdminServer lets the operators see the sessions of the gateway over HTTP, dump the results received
+// for one and cancel it, and change the joiner shards new sessions are spread over:
+//
+//	GET  /sessions
+//	GET  /sessions/{id}/results
+//	POST /sessions/{id}/cancel
+//	GET  /ring
+//	PUT  /ring {"shards": [1, 2, 3]}
+type AdminServer struct {
+	registry   *Registry
+	ring       *JoinerRing
+	cancel     func(id string) (bool, error)
+	changeRing func(shards []int) error
+	server     *http.Server
+}
+
+type ringBody struct {
+	Shards   []int `json:"shards"`
+	Draining []int `json:"draining,omitempty"` // out of the ring, until their sessions are over
+}
+
+// NewAdminServer serves the registry on the port, cancel ends a session and reports if it was open
+// and changeRing replaces the joiner ring
+func NewAdminServer(port string, registry *Registry, ring *JoinerRing, cancel func(id string) (bool, error), changeRing func(shards []int) error) *AdminServer {
+	a := &AdminServer{registry: registry, ring: ring, cancel: cancel, changeRing: changeRing}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", a.handleSessions)
+	mux.HandleFunc("GET /sessions/{id}/results", a.handleResults)
+	mux.HandleFunc("POST /sessions/{id}/cancel", a.handleCancel)
+	mux.HandleFunc("GET /ring", a.handleRing)
+	mux.HandleFunc("PUT /ring", a.handleChangeRing)
+	a.server = &http.Server{Addr: ":" + port, Handler: mux}
+
+	return a
+}
+
+func (a *AdminServer) Start() {
+	go func() {
+		slog.Info("starting admin server", slog.String("address", a.server.Addr))
+		if err := a.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("error serving admin endpoints", slog.String("error", err.Error()))
+		}
+	}()
+}
+
+func (a *AdminServer) Close() error {
+	if err := a.server.Close(); err != nil {
+		return fmt.Errorf("error closing admin server: %w", err)
+	}
+	return nil
+}
+
+func (a *AdminServer) handleSessions(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, a.registry.Sessions())
+}
+
+func (a *AdminServer) handleResults(w http.ResponseWriter, r *http.Request) {
+	results, ok := a.registry.Results(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (a *AdminServer) handleCancel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	found, err := a.cancel(id)
+	if err != nil {
+		slog.Error("error cancelling session", slog.String("id", id), slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminServer) handleRing(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, ringBody{Shards: a.ring.Shards(), Draining: a.ring.Draining()})
+}
+
+func (a *AdminServer) handleChangeRing(w http.ResponseWriter, r *http.Request) {
+	var body ringBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid ring: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := a.changeRing(body.Shards); errors.Is(err, errInvalidRing) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		slog.Error("error changing joiner ring", slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, ringBody{Shards: a.ring.Shards(), Draining: a.ring.Draining()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("error writing admin response", slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"pkg/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminListsDumpsAndCancelsSessions(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, store.Save(NewSession("waiting", "gateway")))
+	registry, err := NewRegistry(store, "gateway", time.Minute, 1)
+	require.NoError(t, err)
+	_, err = registry.AddResults("waiting", models.RawQueryResults{QueryId: 3, Items: json.RawMessage(`[]`), Last: true}, "")
+	require.NoError(t, err)
+
+	var cancelled []string
+	admin := NewAdminServer("0", registry, nil, func(id string) (bool, error) {
+		client, ok := registry.Cancel(id)
+		require.Nil(t, client)
+		if ok {
+			cancelled = append(cancelled, id)
+		}
+		return ok, nil
+	}, nil)
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		admin.server.Handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+
+	response := serve(http.MethodGet, "/sessions")
+	require.Equal(t, http.StatusOK, response.Code)
+	var sessions []SessionInfo
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 1)
+	require.Equal(t, StateDelivering, sessions[0].State)
+	require.Equal(t, []int{3}, sessions[0].CompletedQueries)
+	require.False(t, sessions[0].Connected)
+
+	response = serve(http.MethodGet, "/sessions/waiting/results")
+	require.Equal(t, http.StatusOK, response.Code)
+	var results []models.RawQueryResults
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &results))
+	require.Len(t, results, 1)
+
+	require.Equal(t, http.StatusNoContent, serve(http.MethodPost, "/sessions/waiting/cancel").Code)
+	require.Equal(t, http.StatusNotFound, serve(http.MethodPost, "/sessions/waiting/cancel").Code)
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/sessions/waiting/results").Code)
+	require.Equal(t, []string{"waiting"}, cancelled)
+
+	stored, err := store.Load()
+	require.NoError(t, err)
+	require.Empty(t, stored)
+}
+
+func TestAdminChangesTheJoinerRing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ring.json")
+	ring, err := NewJoinerRing(path, 2)
+	require.NoError(t, err)
+	admin := NewAdminServer("0", nil, ring, nil, func(shards []int) error {
+		_, err := ring.Set(shards)
+		return err
+	})
+	serve := func(method, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		admin.server.Handler.ServeHTTP(recorder, httptest.NewRequest(method, "/ring", strings.NewReader(body)))
+		return recorder
+	}
+
+	response := serve(http.MethodGet, "")
+	require.Equal(t, http.StatusOK, response.Code)
+	require.JSONEq(t, `{"shards":[1,2]}`, response.Body.String())
+
+	response = serve(http.MethodPut, `{"shards":[3,1,2]}`)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.JSONEq(t, `{"shards":[1,2,3]}`, response.Body.String())
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPut, `{"shards":[1,1]}`).Code)
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPut, `{"shards":[]}`).Code)
+
+	restarted, err := NewJoinerRing(path, 2)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3}, restarted.Shards())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pkg/models"
+	"slices"
+	"sync"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits what a session can push through the gateway, a zero limit is unlimited
+type Quota struct {
+	MaxRecords int   // per dataset
+	MaxBytes   int64 // over the whole session
+	bytes      int64
+}
+
+// charge accounts a batch of the dataset, records is the total of the dataset so far
+func (q *Quota) charge(dataset string, records int, bytes int) error {
+	if q.MaxRecords > 0 && records > q.MaxRecords {
+		return fmt.Errorf("%w: %s has more than %d records", errQuotaExceeded, dataset, q.MaxRecords)
+	}
+	q.bytes += int64(bytes)
+	if q.MaxBytes > 0 && q.bytes > q.MaxBytes {
+		return fmt.Errorf("%w: the session sent more than %d bytes", errQuotaExceeded, q.MaxBytes)
+	}
+	return nil
+}
+
+// resume accounts the bytes already uploaded by a session resumed
+func (q *Quota) resume(uploaded map[string]models.UploadProgress) {
+	for _, progress := range uploaded {
+		q.bytes += progress.Bytes
+	}
+}
+
+// Admission limits the sessions served at once. Clients over capacity wait in line in arrival
+// order, and are told their position whenever it changes. A capacity of 0 admits everyone
+type Admission struct {
+	mu       sync.Mutex
+	capacity int
+	active   int
+	queue    []*ticket
+}
+
+type ticket struct {
+	admitted bool
+	wake     chan struct{}
+}
+
+func NewAdmission(capacity int) *Admission {
+	return &Admission{capacity: capacity}
+}
+
+// Enter waits until the client can be served, calling notify with its position while it waits.
+// The returned function frees the place once the session ends
+func (a *Admission) Enter(ctx context.Context, notify func(position int) error) (func(), error) {
+	a.mu.Lock()
+	if a.capacity <= 0 || (a.active < a.capacity && len(a.queue) == 0) {
+		a.active++
+		a.mu.Unlock()
+		return a.release, nil
+	}
+	t := &ticket{wake: make(chan struct{}, 1)}
+	a.queue = append(a.queue, t)
+	a.mu.Unlock()
+
+	notified := 0
+	for {
+		a.mu.Lock()
+		admitted, position := t.admitted, slices.Index(a.queue, t)+1
+		a.mu.Unlock()
+		if admitted {
+			return a.release, nil
+		}
+
+		if position != notified {
+			if err := notify(position); err != nil {
+				a.leave(t)
+				return nil, err
+			}
+			notified = position
+		}
+
+		select {
+		case <-t.wake:
+		case <-ctx.Done():
+			a.leave(t)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (a *Admission) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.capacity <= 0 {
+		return
+	}
+	a.active--
+	a.admitNext()
+}
+
+// leave takes a waiting client out of the line, or frees its place if it was admitted meanwhile
+func (a *Admission) leave(t *ticket) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if t.admitted {
+		a.active--
+	} else {
+		a.queue = slices.DeleteFunc(a.queue, func(queued *ticket) bool { return queued == t })
+	}
+	a.admitNext()
+}
+
+// admitNext fills the free places with the head of the line and wakes up the rest to update their position
+func (a *Admission) admitNext() {
+	for a.active < a.capacity && len(a.queue) > 0 {
+		head := a.queue[0]
+		a.queue = a.queue[1:]
+		head.admitted = true
+		a.active++
+		wake(head)
+	}
+	for _, t := range a.queue {
+		wake(t)
+	}
+}
+
+func wake(t *ticket) {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
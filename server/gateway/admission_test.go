@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type waiter struct {
+	positions chan int
+	admitted  chan func()
+}
+
+func enter(admission *Admission) waiter {
+	w := waiter{positions: make(chan int, 10), admitted: make(chan func(), 1)}
+	go func() {
+		release, err := admission.Enter(context.Background(), func(position int) error {
+			w.positions <- position
+			return nil
+		})
+		if err == nil {
+			w.admitted <- release
+		}
+	}()
+	return w
+}
+
+func TestAdmissionQueuesClientsOverCapacity(t *testing.T) {
+	admission := NewAdmission(1)
+	release, err := admission.Enter(context.Background(), func(int) error { return nil })
+	require.NoError(t, err)
+
+	second := enter(admission)
+	require.Equal(t, 1, <-second.positions)
+	third := enter(admission)
+	require.Equal(t, 2, <-third.positions)
+
+	release()
+	releaseSecond := <-second.admitted
+	require.Equal(t, 1, <-third.positions)
+	require.Empty(t, third.admitted)
+
+	releaseSecond()
+	select {
+	case releaseThird := <-third.admitted:
+		releaseThird()
+	case <-time.After(time.Second):
+		t.Fatal("third client was not admitted")
+	}
+}
+
+func TestQuotaRejectsSessionsOverTheLimits(t *testing.T) {
+	quota := Quota{MaxRecords: 10, MaxBytes: 100}
+	require.NoError(t, quota.charge("movies", 10, 60))
+	require.ErrorIs(t, quota.charge("movies", 11, 0), errQuotaExceeded)
+	require.ErrorIs(t, quota.charge("reviews", 1, 50), errQuotaExceeded)
+}
@@ -6,53 +6,111 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"os"
 	"os/signal"
+	"path/filepath"
+	"pkg/communication"
+	"pkg/config"
 	"pkg/models"
 	"sync"
 	"syscall"
+	"time"
 	"tp-sistemas-distribuidos/server/common"
 )
 
 const (
-	rabbitHost = "rabbitmq"
-	nextStep   = "to-preprocess"
+	nextStep = "to-preprocess"
 )
 
 type GatewayConfig struct {
-	RabbitUser string
-	RabbitPass string
-	port       string
-}
-
-func NewGatewayConfig(rabbitUser, rabbitPass, port string) GatewayConfig {
-	return GatewayConfig{
-		RabbitUser: rabbitUser,
-		RabbitPass: rabbitPass,
-		port:       port,
-	}
+	config.Node
+	config.Persistence
+	config.Sessions
+	Port      string `env:"GATEWAY_PORT" json:"gateway_port" default:"12345"`
+	AdminPort string `env:"ADMIN_PORT" json:"admin_port" default:"8090"`
+	// Limits of the clients, 0 is unlimited. Clients over MaxSessions wait in the admission queue
+	MaxSessions     int   `env:"MAX_SESSIONS" json:"max_sessions" default:"0" min:"0"`
+	MaxRecords      int   `env:"MAX_RECORDS_PER_DATASET" json:"max_records_per_dataset" default:"0" min:"0"`
+	MaxSessionBytes int64 `env:"MAX_SESSION_BYTES" json:"max_session_bytes" default:"0" min:"0"`
+	// Batches between two saves of the upload progress, a resumed upload sends again the ones after the last save
+	UploadCheckpoint int `env:"UPLOAD_CHECKPOINT" json:"upload_checkpoint" default:"100" min:"1"`
+	// Results waiting for a slow client: OutboxSize in memory, then up to OutboxSpillBytes on disk. Past
+	// that the gateway waits for the client if OutboxBlock is set, or fails its session
+	OutboxSize       int   `env:"OUTBOX_SIZE" json:"outbox_size" default:"64" min:"1"`
+	OutboxSpillBytes int64 `env:"OUTBOX_SPILL_BYTES" json:"outbox_spill_bytes" default:"67108864" min:"0"`
+	OutboxBlock      bool  `env:"OUTBOX_BLOCK" json:"outbox_block" default:"false"`
+	// Joiner shards of the first ring, the admin api changes it later
+	JoinerShards int `env:"JOINER_SHARDS" json:"joiner_shards" required:"true" min:"1"`
 }
 
 type Gateway struct {
 	middleware    *common.Middleware
+	health        *common.HealthServer
+	admin         *AdminServer
 	resultsQueues map[int]<-chan common.Message
+	forward       map[int]*common.ResultsRouter
 	toPreprocess  chan<- []byte
+	control       chan<- []byte
+	controlQueue  <-chan common.Message
 	config        GatewayConfig
 	listener      net.Listener
-	clients       map[string]*Client
+	registry      *Registry
+	admission     *Admission
+	outbox        OutboxLimits
+	ring          *JoinerRing
+	store         *SessionStore
+	idleShards    map[int]bool // draining and unused by any session at the last sweep
+	sessions      sync.WaitGroup
+	connsMu       sync.Mutex
+	conns         map[net.Conn]struct{} // accepted and not closed yet
 	running       bool
 	ctx           context.Context
 }
 
-func NewGateway(rabbitUser, rabbitPass, port string) (*Gateway, error) {
-	config := NewGatewayConfig(rabbitUser, rabbitPass, port)
+func NewGateway(cfg GatewayConfig) (*Gateway, error) {
 	gateway := &Gateway{
-		config:        config,
+		config:        cfg,
 		running:       true,
 		resultsQueues: make(map[int]<-chan common.Message),
-		clients:       make(map[string]*Client),
+		forward:       make(map[int]*common.ResultsRouter),
+		conns:         make(map[net.Conn]struct{}),
+		admission:     NewAdmission(cfg.MaxSessions),
 	}
 
-	listener, err := net.Listen("tcp", ":"+port)
+	store, err := NewSessionStore(filepath.Join(cfg.StateDir, "gateway"))
+	if err != nil {
+		return nil, err
+	}
+	registry, err := NewRegistry(store, cfg.ID(), cfg.SessionTTL, cfg.UploadCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+	registry.OnTransition(func(id string, from, to SessionState) {
+		slog.Info("session state changed", slog.String("id", id), slog.String("from", string(from)), slog.String("to", string(to)))
+	})
+	registry.OnClaim(gateway.announceMove)
+	gateway.registry = registry
+	gateway.store = store
+
+	ring, err := NewJoinerRing(filepath.Join(cfg.StateDir, "ring.json"), cfg.JoinerShards)
+	if err != nil {
+		return nil, err
+	}
+	gateway.ring = ring
+
+	// Spill files are only useful to the connection that wrote them. The state dir may be shared with the
+	// other gateways, each one only clears its own spill dir
+	spillDir := filepath.Join(cfg.StateDir, "outbox", cfg.ID())
+	if err := os.RemoveAll(spillDir); err != nil {
+		return nil, fmt.Errorf("error cleaning outbox spill dir: %w", err)
+	}
+	if err := os.MkdirAll(spillDir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating outbox spill dir: %w", err)
+	}
+	gateway.outbox = OutboxLimits{Size: cfg.OutboxSize, Dir: spillDir, SpillBytes: cfg.OutboxSpillBytes, Block: cfg.OutboxBlock}
+	gateway.admin = NewAdminServer(cfg.AdminPort, registry, ring, gateway.cancelSession, gateway.changeRing)
+
+	listener, err := net.Listen("tcp", ":"+cfg.Port)
 	if err != nil {
 		slog.Error("error starting gateway", slog.String("error", err.Error()))
 		return nil, err
@@ -69,12 +127,13 @@ func NewGateway(rabbitUser, rabbitPass, port string) (*Gateway, error) {
 }
 
 func (g *Gateway) middlewareSetup() error {
-	middleware, err := common.NewMiddleware(g.config.RabbitUser, g.config.RabbitPass, rabbitHost)
+	middleware, err := common.NewMiddleware(g.config.Node)
 	if err != nil {
 		slog.Error("error creating middleware", slog.String("error", err.Error()))
 		return err
 	}
 	g.middleware = middleware
+	g.health = common.NewHealthServer(g.config.Node, middleware)
 
 	processorChan, err := g.middleware.GetChanToSend(nextStep)
 	if err != nil {
@@ -82,23 +141,40 @@ func (g *Gateway) middlewareSetup() error {
 		return err
 	}
 
+	// Every gateway gets only the results of its own clients, so several of them can serve at once
 	for i := 1; i <= 5; i++ {
-		resultsChan, err := g.middleware.GetChanToRecv(fmt.Sprintf("q%d-results", i))
+		topic := common.ResultsTopic(i, g.config.ID())
+		resultsChan, err := g.middleware.GetChanWithTopicToRecv(common.ResultsExchange, topic)
 		if err != nil {
-			slog.Error("error getting channel to receive", slog.String("queue", fmt.Sprintf("q%d-results", i)), slog.String("error", err.Error()))
+			slog.Error("error getting channel to receive", slog.String("topic", topic), slog.String("error", err.Error()))
 			return err
 		}
 		g.resultsQueues[i] = resultsChan
+		g.forward[i] = common.NewResultsRouter(g.middleware, i)
 	}
 
 	g.toPreprocess = processorChan
 
+	controlChan, err := g.middleware.GetChanToBroadcast(common.ControlExchange)
+	if err != nil {
+		slog.Error("error getting channel to broadcast", slog.String("exchange", common.ControlExchange), slog.String("error", err.Error()))
+		return err
+	}
+	g.control = controlChan
+
+	controlQueue, err := g.middleware.GetBroadcastChanToRecv(common.ControlExchange, g.config.ID())
+	if err != nil {
+		slog.Error("error getting channel to receive", slog.String("exchange", common.ControlExchange), slog.String("error", err.Error()))
+		return err
+	}
+	g.controlQueue = controlQueue
+
 	return nil
 }
 
 func (g *Gateway) listen() {
 	for g.running {
-		g.reapDeadClients()
+		g.registry.ReapDeadClients()
 		slog.Info("Waiting for client connection")
 		conn, err := g.listener.Accept()
 		if err != nil {
@@ -107,22 +183,77 @@ func (g *Gateway) listen() {
 			}
 			return
 		}
-		client := NewClient(conn, &g.toPreprocess)
 		slog.Info("Client connected", slog.String("address", conn.RemoteAddr().String()))
-		g.clients[client.GetId()] = client
-		fmt.Printf("Client %s connected\n", client.GetId())
-		go client.Run()
+		g.connsMu.Lock()
+		g.conns[conn] = struct{}{}
+		g.connsMu.Unlock()
+		g.sessions.Add(1)
+		go func() {
+			defer g.sessions.Done()
+			g.serve(conn)
+			g.connsMu.Lock()
+			delete(g.conns, conn)
+			g.connsMu.Unlock()
+		}()
 	}
 }
 
+// serve runs the handshake of a connection, that opens a new session or claims a known one, and then the session
+func (g *Gateway) serve(conn net.Conn) {
+	hello, err := communication.RecvHello(conn)
+	if err != nil {
+		slog.Error("error in client handshake", slog.String("error", err.Error()))
+		_ = conn.Close()
+		return
+	}
+
+	release, err := g.admission.Enter(g.ctx, func(position int) error {
+		slog.Info("gateway at capacity, client waiting for admission", slog.Int("position", position))
+		return communication.SendWelcome(conn, models.Welcome{Position: position})
+	})
+	if err != nil {
+		slog.Error("client left the admission queue", slog.String("error", err.Error()))
+		_ = conn.Close()
+		return
+	}
+	defer release()
+
+	session, resumed, err := g.registry.Open(hello.SessionID, g.ring.Shards())
+	if err != nil {
+		slog.Error("error opening session", slog.String("error", err.Error()))
+		_ = conn.Close()
+		return
+	}
+
+	quota := Quota{MaxRecords: g.config.MaxRecords, MaxBytes: g.config.MaxSessionBytes}
+	var uploaded map[string]models.UploadProgress
+	client, err := g.registry.Attach(session.ID, func(replay []models.RawQueryResults, progress map[string]models.UploadProgress) *Client {
+		uploaded = progress
+		return NewClient(conn, &g.toPreprocess, origin{g.config.ID(), session.Shards}, session.ID, replay, progress, quota, NewOutbox(session.ID, g.outbox), g.registry)
+	})
+	if err != nil {
+		slog.Error("error attaching client", slog.String("error", err.Error()))
+		_ = conn.Close()
+		return
+	}
+	if err := communication.SendWelcome(conn, models.Welcome{SessionID: session.ID, Resumed: resumed, Uploaded: uploaded}); err != nil {
+		slog.Error("error in client handshake", slog.String("error", err.Error()))
+		client.Close()
+		return
+	}
+	fmt.Printf("Client %s connected\n", client.GetId())
+	client.Run()
+}
+
 func (g *Gateway) signalHandler(wg *sync.WaitGroup) {
 	defer wg.Done()
 	// Hears SIGINT and SIGTERM signals
-	// and closes the listener and current connection
+	// and closes the listener so no new clients are accepted
 	select {
 	case <-g.ctx.Done():
-		slog.Info("Received shutdown signal")
+		slog.Info("Received shutdown signal, draining")
 		g.running = false
+		g.health.SetReady(false)
 		if err := g.listener.Close(); err != nil {
 			slog.Error("error closing listener", slog.String("error", err.Error()))
 		}
@@ -140,39 +271,105 @@ func (g *Gateway) Start() {
 		}
 	}(g.middleware)
 
+	g.health.Start()
+	defer func(health *common.HealthServer) {
+		if err := health.Close(); err != nil {
+			slog.Error("error closing health server", slog.String("error", err.Error()))
+		}
+	}(g.health)
+
+	g.admin.Start()
+	defer func(admin *AdminServer) {
+		if err := admin.Close(); err != nil {
+			slog.Error("error closing admin server", slog.String("error", err.Error()))
+		}
+	}(g.admin)
+
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	g.ctx = ctx
 	defer cancel()
 
+	g.health.SetReady(true)
+
+	processCtx, stopProcessing := context.WithCancel(context.Background())
+	defer stopProcessing()
+
 	wg.Add(2)
 	go g.signalHandler(wg)
-	go g.processMessages(wg)
+	go g.processMessages(processCtx, wg)
 	g.listen()
+
+	// Active sessions keep receiving their results while draining
+	deadline := time.Now().Add(g.config.DrainTimeout)
+	g.waitForSessions(deadline)
+	stopProcessing()
 	wg.Wait()
 
-	g.closeClients()
+	// Every upload has to stop before the flush, the batches sent afterwards are not published
+	g.registry.CloseClients()
+	g.closeConns()
+	g.sessions.Wait()
+	g.flushMiddleware(deadline)
 
 	slog.Info("Gateway shut down")
 }
 
-func (g *Gateway) closeClients() {
-	for id, client := range g.clients {
-		if !client.IsDead() {
-			slog.Info("Closing client connection", slog.String("id", id))
-			client.Close()
-		}
-		delete(g.clients, id)
+// waitForSessions lets the active sessions finish until the deadline
+func (g *Gateway) waitForSessions(deadline time.Time) {
+	finished := make(chan struct{})
+	go func() {
+		g.sessions.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		slog.Info("All sessions finished")
+	case <-time.After(time.Until(deadline)):
+		slog.Warn("Drain timeout expired, closing active sessions")
+	}
+}
+
+// closeConns closes the connections still open, also the ones of clients in the handshake
+func (g *Gateway) closeConns() {
+	g.connsMu.Lock()
+	defer g.connsMu.Unlock()
+	for conn := range g.conns {
+		_ = conn.Close()
 	}
 }
 
-func (g *Gateway) processMessages(wg *sync.WaitGroup) {
+func (g *Gateway) flushMiddleware(deadline time.Time) {
+	g.middleware.StopConsuming()
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := g.middleware.Flush(ctx); err != nil {
+		slog.Error("error flushing middleware", slog.String("error", err.Error()))
+	}
+}
+
+func (g *Gateway) processMessages(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
+	ticker := time.NewTicker(common.HealthTickInterval)
+	defer ticker.Stop()
+	sweeper := time.NewTicker(g.config.SweepInterval)
+	defer sweeper.Stop()
 	for {
 		var err error
 		select {
-		case <-g.ctx.Done():
+		case <-ctx.Done():
 			return
 
+		case <-ticker.C:
+			g.health.Tick()
+
+		case <-sweeper.C:
+			g.registry.Expire()
+			err = g.retireShards()
+
+		case msg := <-g.controlQueue:
+			err = g.handleControl(msg)
+
 		case msg := <-g.resultsQueues[1]:
 			err = g.handleResult(msg, 1)
 		case msg := <-g.resultsQueues[2]:
@@ -187,16 +384,6 @@ func (g *Gateway) processMessages(wg *sync.WaitGroup) {
 
 		if err != nil {
 			slog.Error("error processing message", slog.String("error", err.Error()))
-			return
-		}
-	}
-}
-
-func (g *Gateway) reapDeadClients() {
-	for id, client := range g.clients {
-		if client.IsDead() {
-			slog.Info("Client is dead", slog.String("id", id))
-			delete(g.clients, id)
 		}
 	}
 }
@@ -305,26 +492,195 @@ func (g *Gateway) handleResult(msg common.Message, query int) error {
 	}
 
 	if err != nil {
+		// The message can not be processed again, so it is dropped
+		if ackErr := msg.Ack(); ackErr != nil {
+			slog.Error("error acknowledging message", slog.String("error", ackErr.Error()))
+		}
 		return fmt.Errorf("error handling results in query %d err: %s", query, err)
 	}
 
 	if results != nil { // can be nil due to empty results in query 1
 		slog.Info("Received results", slog.String("clientId", results.Id), slog.Int("query", query))
-		client, ok := g.clients[results.Id]
-		if !ok {
-			return fmt.Errorf("client %s not found", results.Id)
+		if err := g.routeResults(msg, query, results); err != nil {
+			// The results are kept by the broker and delivered again
+			if nackErr := msg.Nack(); nackErr != nil {
+				slog.Error("error requeueing message", slog.String("error", nackErr.Error()))
+			}
+			return fmt.Errorf("error routing results in query %d: %w", query, err)
+		}
+	}
+
+	if err := msg.Ack(); err != nil {
+		return fmt.Errorf("error acknowledging message: %w", err)
+	}
+	return nil
+}
+
+// routeResults forwards the results to the gateway serving their session, or stores them and hands them
+// to the client if it is served here
+func (g *Gateway) routeResults(msg common.Message, query int, results *models.ResultWithId) error {
+	owner, err := g.registry.Owner(results.Id)
+	if err != nil {
+		return err
+	}
+	if owner != "" && owner != g.config.ID() {
+		// The session moved to another gateway before the results were routed to it
+		slog.Info("forwarding results", slog.String("clientId", results.Id), slog.String("gateway", owner))
+		return g.forward[query].Send(owner, msg.Body)
+	}
+	client, err := g.storeResults(results, resultBatch(msg, query))
+	if err != nil {
+		return err
+	}
+	if client != nil && !client.IsDead() {
+		client.sendResult(&results.Results)
+	}
+	return nil
+}
+
+// cancelSession ends a session on an operator request. Every stateful node is told to drop what it keeps
+// for the client, and the client is rejected if it is still connected
+func (g *Gateway) cancelSession(id string) (bool, error) {
+	client, ok := g.registry.Cancel(id)
+	if !ok {
+		return false, nil
+	}
+
+	msg, err := json.Marshal(common.ControlMsg{Kind: common.CancelSession, ClientID: id})
+	if err != nil {
+		return true, fmt.Errorf("error marshalling cancel message: %w", err)
+	}
+	g.control <- msg
+	slog.Warn("session cancelled by an operator", slog.String("id", id))
+
+	rejectCancelled(client)
+	return true, nil
+}
+
+// changeRing spreads the sessions opened from now on over the joiner shards, and tells the other gateways
+func (g *Gateway) changeRing(shards []int) error {
+	changed, err := g.ring.Set(shards)
+	if err != nil || !changed {
+		return err
+	}
+
+	msg, err := json.Marshal(common.ControlMsg{Kind: common.RingChanged, Shards: g.ring.Shards()})
+	if err != nil {
+		return fmt.Errorf("error marshalling ring message: %w", err)
+	}
+	g.control <- msg
+	slog.Info("joiner ring changed", slog.Any("shards", g.ring.Shards()))
+	return nil
+}
+
+// retireShards retires the draining shards that no session uses anymore, and tells the other gateways
+// and the joiners. A shard has to be unused in two sweeps in a row, so a session opened by another
+// gateway before it heard of the ring change is already saved when the shard is retired
+func (g *Gateway) retireShards() error {
+	draining := g.ring.Draining()
+	if len(draining) == 0 {
+		return nil
+	}
+	inUse, err := g.store.ShardsInUse(common.DefaultShards(g.config.JoinerShards))
+	if err != nil {
+		return err
+	}
+
+	idle := make(map[int]bool)
+	for _, shard := range draining {
+		if inUse[shard] {
+			continue
 		}
-		if !client.IsDead() {
-			client.sendResult(&results.Results)
+		if !g.idleShards[shard] {
+			idle[shard] = true
+			continue
 		}
+		retired, err := g.ring.Retire(shard)
+		if err != nil {
+			return err
+		}
+		if !retired {
+			continue
+		}
+		msg, err := json.Marshal(common.ControlMsg{Kind: common.ShardRetired, Shards: []int{shard}})
+		if err != nil {
+			return fmt.Errorf("error marshalling retired shard message: %w", err)
+		}
+		g.control <- msg
+		slog.Info("joiner shard retired", slog.Int("shard", shard))
+	}
+	g.idleShards = idle
+	return nil
+}
+
+// rejectCancelled tells the client of a cancelled session, if it is still connected, that it is over
+func rejectCancelled(client *Client) {
+	if client != nil && !client.IsDead() {
+		go client.sendResult(&models.TotalQueryResults{Rejected: "session cancelled by an operator"})
 	}
+}
 
+// announceMove tells the other gateways and the final reducers that a session claimed from another
+// gateway is served by this one, so its results are routed here
+func (g *Gateway) announceMove(id, previous string) {
+	msg, err := json.Marshal(common.ControlMsg{Kind: common.MoveSession, ClientID: id, Gateway: g.config.ID()})
+	if err != nil {
+		slog.Error("error marshalling move message", slog.String("error", err.Error()))
+		return
+	}
+	g.control <- msg
+}
+
+// handleControl follows the orders broadcast by the gateways: a session cancelled or claimed by another
+// gateway is dropped here, and the ring follows the changes and retirements of the others
+func (g *Gateway) handleControl(msg common.Message) error {
+	control, err := common.DecodeControlMsg(msg.Body)
+	if err != nil {
+		slog.Error("dropping control message", slog.String("error", err.Error()))
+	} else if control.Kind == common.MoveSession && control.Gateway != g.config.ID() {
+		g.registry.Release(control.ClientID)
+	} else if control.Kind == common.CancelSession {
+		client, _ := g.registry.Cancel(control.ClientID)
+		rejectCancelled(client)
+	} else if control.Kind == common.RingChanged {
+		if _, err := g.ring.Set(control.Shards); err != nil {
+			slog.Error("error changing joiner ring", slog.String("error", err.Error()))
+		}
+	} else if control.Kind == common.ShardRetired {
+		for _, shard := range control.Shards {
+			if _, err := g.ring.Retire(shard); err != nil {
+				slog.Error("error retiring joiner shard", slog.String("error", err.Error()))
+			}
+		}
+	}
 	if err := msg.Ack(); err != nil {
 		return fmt.Errorf("error acknowledging message: %w", err)
 	}
 	return nil
 }
 
+// storeResults saves the results in their session before they are acked, and returns the client attached to it
+func (g *Gateway) storeResults(results *models.ResultWithId, batch string) (*Client, error) {
+	raw, err := communication.EncodeQueryResults(results.Results)
+	if err != nil {
+		return nil, err
+	}
+	return g.registry.AddResults(results.Id, raw, batch)
+}
+
+// resultBatch names the batch of query 1 the results were taken from, by its producer and sequence number.
+// Query 1 streams many results per client, the other queries send a single one and are not named
+func resultBatch(msg common.Message, query int) string {
+	if query != 1 {
+		return ""
+	}
+	header, err := common.HeaderOf(msg)
+	if err != nil || header.Seq == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", header.ProducerID, header.Seq)
+}
+
 func (g *Gateway) consumeBatch(msg []byte) (common.Batch[common.Movie], error) {
 	var batch common.Batch[common.Movie]
 	if err := json.Unmarshal(msg, &batch); err != nil {
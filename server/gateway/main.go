@@ -3,12 +3,10 @@ package main
 import (
 	"fmt"
 	"log/slog"
-	"os"
+	"pkg/config"
 	"pkg/log"
 )
 
-const PORT = "12345"
-
 func main() {
 	logger, err := log.SetupLogger("gateway", false, nil)
 	if err != nil {
@@ -17,15 +15,14 @@ func main() {
 	}
 	slog.SetDefault(logger)
 
-	rabbitUser := os.Getenv("RABBITMQ_DEFAULT_USER")
-	rabbitPass := os.Getenv("RABBITMQ_DEFAULT_PASS")
-
-	if rabbitUser == "" || rabbitPass == "" {
-		slog.Error("environment validation failed", slog.String("error", "RABBITMQ_DEFAULT_USER and RABBITMQ_DEFAULT_PASS must be set"))
+	var cfg GatewayConfig
+	if err := config.Load(&cfg); err != nil {
+		slog.Error("configuration validation failed", slog.String("error", err.Error()))
 		return
 	}
+	config.Log(cfg)
 
-	gateway, err := NewGateway(rabbitUser, rabbitPass, PORT)
+	gateway, err := NewGateway(cfg)
 	if err != nil {
 		slog.Error("error creating gateway", slog.String("error", err.Error()))
 		return
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"pkg/models"
+	"sync"
+)
+
+var errOutboxFull = errors.New("outbox full")
+
+// OutboxLimits bounds the results waiting to be written to a client: Size of them are kept in memory and
+// the rest spill to a file in Dir, up to SpillBytes. Past that Push waits for room if Block is set, or fails
+type OutboxLimits struct {
+	Size       int
+	Dir        string
+	SpillBytes int64
+	Block      bool
+}
+
+// Outbox queues the results of a client so the gateway hands them over without waiting for the client
+// to read them. They come out in the order they were pushed, the spilled ones after the ones in memory
+type Outbox struct {
+	mu      sync.Mutex
+	limits  OutboxLimits
+	prefix  string
+	memory  []models.RawQueryResults
+	spill   *os.File
+	written int64 // end of the spill file
+	read    int64 // first spilled result not taken yet
+	spilled int
+	closed  bool
+	ready   chan struct{}
+	room    chan struct{}
+}
+
+// NewOutbox creates the outbox of a connection of the session, its spill file is created on first use
+func NewOutbox(sessionID string, limits OutboxLimits) *Outbox {
+	return &Outbox{
+		limits: limits,
+		prefix: sessionID + "-*.spill",
+		ready:  make(chan struct{}, 1),
+		room:   make(chan struct{}, 1),
+	}
+}
+
+// Push queues the results. If the outbox is full it fails with errOutboxFull, or waits for the client to
+// take some when the limits block
+func (o *Outbox) Push(ctx context.Context, results models.RawQueryResults) error {
+	for {
+		o.mu.Lock()
+		if o.closed {
+			// The session keeps the results for a client resuming it
+			o.mu.Unlock()
+			return nil
+		}
+		queued, err := o.tryPush(results)
+		o.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if queued {
+			nudge(o.ready)
+			return nil
+		}
+		if !o.limits.Block {
+			return errOutboxFull
+		}
+
+		select {
+		case <-o.room:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// tryPush keeps the results in memory while nothing is spilled, so the order is kept, or else spills them
+func (o *Outbox) tryPush(results models.RawQueryResults) (bool, error) {
+	if o.spilled == 0 && len(o.memory) < o.limits.Size {
+		o.memory = append(o.memory, results)
+		return true, nil
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		return false, fmt.Errorf("error marshalling spilled results: %w", err)
+	}
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	record = append(record, data...)
+	if o.written+int64(len(record)) > o.limits.SpillBytes {
+		return false, nil
+	}
+
+	if o.spill == nil {
+		if o.spill, err = os.CreateTemp(o.limits.Dir, o.prefix); err != nil {
+			return false, fmt.Errorf("error creating spill file: %w", err)
+		}
+	}
+	if _, err := o.spill.WriteAt(record, o.written); err != nil {
+		return false, fmt.Errorf("error spilling results: %w", err)
+	}
+	o.written += int64(len(record))
+	o.spilled++
+	return true, nil
+}
+
+// Next waits for the next results to write to the client
+func (o *Outbox) Next(ctx context.Context) (models.RawQueryResults, error) {
+	for {
+		o.mu.Lock()
+		results, ok, err := o.pop()
+		o.mu.Unlock()
+		if err != nil {
+			return models.RawQueryResults{}, err
+		}
+		if ok {
+			nudge(o.room)
+			return results, nil
+		}
+
+		select {
+		case <-o.ready:
+		case <-ctx.Done():
+			return models.RawQueryResults{}, ctx.Err()
+		}
+	}
+}
+
+func (o *Outbox) pop() (models.RawQueryResults, bool, error) {
+	var results models.RawQueryResults
+	if o.closed {
+		return results, false, nil
+	}
+	if len(o.memory) > 0 {
+		results, o.memory = o.memory[0], o.memory[1:]
+		return results, true, nil
+	}
+	if o.spilled == 0 {
+		return results, false, nil
+	}
+
+	var size [4]byte
+	if _, err := o.spill.ReadAt(size[:], o.read); err != nil {
+		return results, false, fmt.Errorf("error reading spilled results: %w", err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := o.spill.ReadAt(data, o.read+int64(len(size))); err != nil {
+		return results, false, fmt.Errorf("error reading spilled results: %w", err)
+	}
+	if err := json.Unmarshal(data, &results); err != nil {
+		return results, false, fmt.Errorf("error unmarshalling spilled results: %w", err)
+	}
+	o.read += int64(len(size) + len(data))
+	o.spilled--
+
+	// The file is reused from the start once every spilled result was taken
+	if o.spilled == 0 {
+		o.read, o.written = 0, 0
+		if err := o.spill.Truncate(0); err != nil {
+			return results, false, fmt.Errorf("error truncating spill file: %w", err)
+		}
+	}
+	return results, true, nil
+}
+
+// Close drops what is left and removes the spill file
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	o.memory = nil
+	nudge(o.room)
+	if o.spill == nil {
+		return nil
+	}
+	_ = o.spill.Close()
+	if err := os.Remove(o.spill.Name()); err != nil {
+		return fmt.Errorf("error removing spill file: %w", err)
+	}
+	return nil
+}
+
+func nudge(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"pkg/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func resultsOf(query int) models.RawQueryResults {
+	return models.RawQueryResults{QueryId: query, Items: json.RawMessage(`[]`)}
+}
+
+func TestOutboxSpillsInOrder(t *testing.T) {
+	dir := t.TempDir()
+	outbox := NewOutbox("client", OutboxLimits{Size: 2, Dir: dir, SpillBytes: 1024})
+	ctx := context.Background()
+
+	for query := 1; query <= 5; query++ {
+		require.NoError(t, outbox.Push(ctx, resultsOf(query)))
+		if query == 3 {
+			// Taking one frees memory, but the next results still go after the spilled ones
+			results, err := outbox.Next(ctx)
+			require.NoError(t, err)
+			require.Equal(t, 1, results.QueryId)
+		}
+	}
+	for query := 2; query <= 5; query++ {
+		results, err := outbox.Next(ctx)
+		require.NoError(t, err)
+		require.Equal(t, query, results.QueryId)
+	}
+
+	require.NoError(t, outbox.Close())
+	spilled, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, spilled)
+}
+
+func TestOutboxOverflow(t *testing.T) {
+	ctx := context.Background()
+	failing := NewOutbox("client", OutboxLimits{Size: 1})
+	require.NoError(t, failing.Push(ctx, resultsOf(1)))
+	require.ErrorIs(t, failing.Push(ctx, resultsOf(2)), errOutboxFull)
+
+	blocking := NewOutbox("client", OutboxLimits{Size: 1, Block: true})
+	require.NoError(t, blocking.Push(ctx, resultsOf(1)))
+	pushed := make(chan error)
+	go func() { pushed <- blocking.Push(ctx, resultsOf(2)) }()
+	select {
+	case <-pushed:
+		t.Fatal("push did not wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	results, err := blocking.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, results.QueryId)
+	require.NoError(t, <-pushed)
+	results, err = blocking.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, results.QueryId)
+}
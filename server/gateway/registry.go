@@ -0,0 +1,477 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"pkg/models"
+	"slices"
+	"sync"
+	"time"
+	"tp-sistemas-distribuidos/server/common"
+
+	"github.com/google/uuid"
+)
+
+type SessionState string
+
+const (
+	StateUploading  SessionState = "uploading"  // the client is sending its datasets
+	StateProcessing SessionState = "processing" // every dataset was received, no result yet
+	StateDelivering SessionState = "delivering" // results are arriving
+	StateDone       SessionState = "done"       // the client received every result
+	StateFailed     SessionState = "failed"     // rejected, or abandoned by its client
+	StateCancelled  SessionState = "cancelled"  // stopped on purpose
+)
+
+// transitions are the states each state can move to. A client that attaches again to its session
+// uploads its datasets again, and the last results may arrive before the upload is marked as over
+var transitions = map[SessionState][]SessionState{
+	StateUploading:  {StateProcessing, StateDelivering, StateDone, StateFailed, StateCancelled},
+	StateProcessing: {StateUploading, StateDelivering, StateFailed, StateCancelled},
+	StateDelivering: {StateUploading, StateDone, StateFailed, StateCancelled},
+}
+
+func (s SessionState) IsFinal() bool {
+	return s == StateDone || s == StateFailed || s == StateCancelled
+}
+
+// TransitionHook is called after a session changes its state, outside the lock of the registry
+type TransitionHook func(id string, from, to SessionState)
+
+// ClaimHook is called after the gateway claims a session that another gateway was serving
+type ClaimHook func(id, previous string)
+
+type registryEntry struct {
+	session  *Session
+	client   *Client
+	state    SessionState
+	uploaded bool
+	records  map[string]int // uploaded by the client attached, per dataset
+}
+
+// SessionInfo is what the registry tells about a session to the operators
+type SessionInfo struct {
+	ID               string         `json:"id"`
+	State            SessionState   `json:"state"`
+	Connected        bool           `json:"connected"`
+	Records          map[string]int `json:"records"`
+	CompletedQueries []int          `json:"completed_queries"`
+	Age              string         `json:"age"`
+}
+
+// Registry keeps the sessions of the gateway, the client attached to each one and the state of
+// its lifecycle. Sessions are saved in the store on every change and deleted once they end, their
+// results are appended as they arrive and the upload progress is saved every checkpoint batches
+type Registry struct {
+	mu         sync.Mutex
+	store      *SessionStore
+	gatewayID  string
+	checkpoint uint64
+	entries    map[string]*registryEntry
+	expiry     *common.SessionExpiry
+	hooks      []TransitionHook
+	claimHooks []ClaimHook
+	closed     bool // no client is attached after CloseClients
+}
+
+// NewRegistry loads the sessions of the store served by the gateway. Their clients are gone, so they
+// wait in processing or delivering until one claims them again
+func NewRegistry(store *SessionStore, gatewayID string, ttl time.Duration, checkpoint int) (*Registry, error) {
+	sessions, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Registry{
+		store:      store,
+		gatewayID:  gatewayID,
+		checkpoint: uint64(max(checkpoint, 1)),
+		entries:    make(map[string]*registryEntry, len(sessions)),
+		expiry:     common.NewSessionExpiry(ttl),
+	}
+	for id, session := range sessions {
+		if session.Gateway != "" && session.Gateway != gatewayID {
+			continue
+		}
+		r.entries[id] = &registryEntry{session: session, state: waitingState(session)}
+		r.expiry.Touch(id)
+	}
+	slog.Info("sessions loaded", slog.Int("sessions", len(r.entries)))
+	return r, nil
+}
+
+// waitingState is the state of a session without client
+func waitingState(session *Session) SessionState {
+	if len(session.Results) > 0 {
+		return StateDelivering
+	}
+	return StateProcessing
+}
+
+func (r *Registry) OnTransition(hook TransitionHook) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, hook)
+}
+
+func (r *Registry) OnClaim(hook ClaimHook) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.claimHooks = append(r.claimHooks, hook)
+}
+
+// Open returns the session claimed by the client, or a new one spread over the joiner shards if the id
+// is empty or unknown. A session served by another gateway is taken from the store and served by this
+// one from now on. Ids that are not uuids are rejected
+func (r *Registry) Open(id string, shards []int) (*Session, bool, error) {
+	if id != "" {
+		if err := validateSessionID(id); err != nil {
+			return nil, false, err
+		}
+	}
+	r.mu.Lock()
+	if entry, ok := r.entries[id]; ok {
+		slog.Info("session resumed", slog.String("id", id), slog.Int("results", len(entry.session.Results)))
+		r.expiry.Touch(id)
+		r.mu.Unlock()
+		return entry.session, true, nil
+	}
+	if id != "" {
+		session, err := r.store.Get(id)
+		if err != nil {
+			r.mu.Unlock()
+			return nil, false, err
+		}
+		if session != nil {
+			previous := session.Gateway
+			session.Gateway = r.gatewayID
+			if err := r.store.Save(session); err != nil {
+				r.mu.Unlock()
+				return nil, false, err
+			}
+			r.entries[id] = &registryEntry{session: session, state: waitingState(session)}
+			r.expiry.Touch(id)
+			hooks := slices.Clone(r.claimHooks)
+			r.mu.Unlock()
+
+			slog.Info("session claimed from another gateway", slog.String("id", id), slog.String("previous", previous))
+			for _, hook := range hooks {
+				hook(id, previous)
+			}
+			return session, true, nil
+		}
+		slog.Warn("unknown session claimed, opening a new one", slog.String("id", id))
+	}
+	defer r.mu.Unlock()
+
+	session := NewSession(uuid.NewString(), r.gatewayID)
+	session.Shards = shards
+	if err := r.store.Save(session); err != nil {
+		return nil, false, err
+	}
+	r.entries[session.ID] = &registryEntry{session: session, state: StateUploading}
+	r.expiry.Touch(session.ID)
+	return session, false, nil
+}
+
+// Attach makes the client built by newClient the one receiving the results of the session. It gets the
+// results received while no client was attached to replay them and the progress of the upload to resume
+// it, and a previous client is closed
+func (r *Registry) Attach(id string, newClient func(replay []models.RawQueryResults, uploaded map[string]models.UploadProgress) *Client) (*Client, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("gateway is shutting down, session %s not attached", id)
+	}
+	entry, ok := r.entries[id]
+	if !ok {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("session %s is not open", id)
+	}
+	if entry.client != nil && !entry.client.IsDead() {
+		slog.Info("closing previous connection of the session", slog.String("id", id))
+		entry.client.Close()
+	}
+	entry.client = newClient(slices.Clone(entry.session.Results), maps.Clone(entry.session.Uploaded))
+	entry.uploaded = false
+	entry.records = make(map[string]int)
+	for dataset, progress := range entry.session.Uploaded {
+		entry.records[dataset] = progress.Records
+	}
+	client := entry.client
+	notify := r.transition(id, entry, StateUploading)
+	r.mu.Unlock()
+
+	notify()
+	return client, nil
+}
+
+// Received updates how much of the dataset the client of the session uploaded. The progress is saved
+// on every checkpoint and once the dataset is over, a client resuming the upload sends again what was
+// received after the last save
+func (r *Registry) Received(id, dataset string, records int, progress models.UploadProgress) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.entries[id]
+	if !ok || entry.records == nil {
+		return nil
+	}
+	entry.records[dataset] = records
+	if entry.session.Uploaded == nil {
+		entry.session.Uploaded = make(map[string]models.UploadProgress)
+	}
+	entry.session.Uploaded[dataset] = progress
+	if progress.Done || progress.Batches%r.checkpoint == 0 {
+		return r.store.Save(entry.session)
+	}
+	return nil
+}
+
+// Uploaded marks that the client sent every dataset of the session
+func (r *Registry) Uploaded(id string) {
+	r.mu.Lock()
+	entry, ok := r.entries[id]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	entry.uploaded = true
+	next := StateProcessing
+	if len(entry.session.Results) > 0 {
+		next = StateDelivering
+	}
+	notify := r.transition(id, entry, next)
+	r.mu.Unlock()
+
+	notify()
+}
+
+// AddResults saves the results in their session before they are acked, and returns the client
+// attached to it. Results of unknown sessions, of queries already finished or of a batch already
+// received are dropped
+func (r *Registry) AddResults(id string, results models.RawQueryResults, batch string) (*Client, error) {
+	r.mu.Lock()
+	entry, ok := r.entries[id]
+	if !ok {
+		r.mu.Unlock()
+		slog.Warn("dropping results of unknown session", slog.String("id", id), slog.Int("query", results.QueryId))
+		return nil, nil
+	}
+	if entry.session.QueryFinished(results.QueryId) {
+		r.mu.Unlock()
+		slog.Warn("dropping results of finished query", slog.String("id", id), slog.Int("query", results.QueryId))
+		return nil, nil
+	}
+	if entry.session.HasBatch(batch) {
+		r.mu.Unlock()
+		slog.Warn("dropping results already received", slog.String("id", id), slog.Int("query", results.QueryId), slog.String("batch", batch))
+		return nil, nil
+	}
+
+	entry.session.AddResults(results, batch)
+	r.expiry.Touch(id)
+	if err := r.store.AppendResults(id, results, batch); err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+	notify := func() {}
+	if entry.uploaded || entry.client == nil {
+		notify = r.transition(id, entry, StateDelivering)
+	}
+	client := entry.client
+	r.mu.Unlock()
+
+	notify()
+	return client, nil
+}
+
+// Finish ends a session in a final state and forgets it, along with its stored results
+func (r *Registry) Finish(id string, state SessionState) {
+	if !state.IsFinal() {
+		slog.Error("sessions can only finish in a final state", slog.String("id", id), slog.String("state", string(state)))
+		return
+	}
+	r.mu.Lock()
+	entry, ok := r.entries[id]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	notify := r.transition(id, entry, state)
+	r.forget(id)
+	r.mu.Unlock()
+
+	notify()
+}
+
+// Cancel ends a session on purpose and returns the client attached to it, if any
+func (r *Registry) Cancel(id string) (*Client, bool) {
+	r.mu.Lock()
+	entry, ok := r.entries[id]
+	if !ok {
+		r.mu.Unlock()
+		return nil, false
+	}
+	client := entry.client
+	notify := r.transition(id, entry, StateCancelled)
+	r.forget(id)
+	r.mu.Unlock()
+
+	notify()
+	return client, true
+}
+
+// Sessions describes every open session, the oldest first
+func (r *Registry) Sessions() []SessionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions := make([]*Session, 0, len(r.entries))
+	for _, entry := range r.entries {
+		sessions = append(sessions, entry.session)
+	}
+	slices.SortFunc(sessions, func(a, b *Session) int { return a.OpenedAt.Compare(b.OpenedAt) })
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		entry := r.entries[session.ID]
+		records := make(map[string]int, len(entry.records))
+		maps.Copy(records, entry.records)
+		infos = append(infos, SessionInfo{
+			ID:               session.ID,
+			State:            entry.state,
+			Connected:        entry.client != nil && !entry.client.IsDead(),
+			Records:          records,
+			CompletedQueries: session.CompletedQueries(),
+			Age:              time.Since(session.OpenedAt).Truncate(time.Second).String(),
+		})
+	}
+	return infos
+}
+
+// Release forgets a session that another gateway claimed, it stays in the store. Its client is closed
+func (r *Registry) Release(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.entries[id]
+	if !ok {
+		return
+	}
+	if entry.client != nil && !entry.client.IsDead() {
+		entry.client.Close()
+	}
+	delete(r.entries, id)
+	r.expiry.Forget(id)
+	slog.Info("session released to another gateway", slog.String("id", id))
+}
+
+// Owner returns the gateway serving the session, or an empty id if there is no such session
+func (r *Registry) Owner(id string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[id]; ok {
+		return r.gatewayID, nil
+	}
+	if validateSessionID(id) != nil {
+		return "", nil
+	}
+	session, err := r.store.Get(id)
+	if err != nil || session == nil {
+		return "", err
+	}
+	return session.Gateway, nil
+}
+
+// Results returns the results received so far for the session
+func (r *Registry) Results(id string) ([]models.RawQueryResults, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.entries[id]; ok {
+		return slices.Clone(entry.session.Results), true
+	}
+	return nil, false
+}
+
+func (r *Registry) State(id string) (SessionState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.entries[id]; ok {
+		return entry.state, true
+	}
+	return "", false
+}
+
+// Expire fails the sessions idle for longer than the ttl whose client is gone. Sessions with a client
+// attached are kept
+func (r *Registry) Expire() {
+	for _, id := range r.expiry.Expired() {
+		r.mu.Lock()
+		entry, ok := r.entries[id]
+		if ok && entry.client != nil && !entry.client.IsDead() {
+			r.expiry.Touch(id)
+			ok = false
+		} else if ok {
+			slog.Warn("session expired, evicting it", slog.String("id", id), slog.Int("results", len(entry.session.Results)))
+		}
+		r.mu.Unlock()
+
+		if ok {
+			r.Finish(id, StateFailed)
+		}
+	}
+}
+
+// ReapDeadClients detaches the clients whose connection was closed, their sessions stay open
+func (r *Registry) ReapDeadClients() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, entry := range r.entries {
+		if entry.client != nil && entry.client.IsDead() {
+			slog.Info("Client is dead", slog.String("id", id))
+			entry.client = nil
+		}
+	}
+}
+
+// CloseClients closes every connection and attaches no client from then on, the sessions stay in the
+// store to be claimed after a restart
+func (r *Registry) CloseClients() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for id, entry := range r.entries {
+		if entry.client != nil && !entry.client.IsDead() {
+			slog.Info("Closing client connection", slog.String("id", id))
+			entry.client.Close()
+		}
+		entry.client = nil
+	}
+}
+
+// transition moves the entry to the state if it is allowed. It must be called with the lock held,
+// and returns the function that runs the hooks once the lock is released
+func (r *Registry) transition(id string, entry *registryEntry, to SessionState) func() {
+	from := entry.state
+	if from == to {
+		return func() {}
+	}
+	if !slices.Contains(transitions[from], to) {
+		slog.Warn("ignoring invalid session transition", slog.String("id", id), slog.String("from", string(from)), slog.String("to", string(to)))
+		return func() {}
+	}
+	entry.state = to
+	hooks := slices.Clone(r.hooks)
+	return func() {
+		for _, hook := range hooks {
+			hook(id, from, to)
+		}
+	}
+}
+
+func (r *Registry) forget(id string) {
+	delete(r.entries, id)
+	r.expiry.Forget(id)
+	if err := r.store.Delete(id); err != nil {
+		slog.Error("error deleting session", slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"pkg/communication"
+	"pkg/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryFollowsTheSessionLifecycle(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	require.NoError(t, err)
+	registry, err := NewRegistry(store, "gateway", time.Minute, 1)
+	require.NoError(t, err)
+	var transitions []SessionState
+	registry.OnTransition(func(_ string, _, to SessionState) { transitions = append(transitions, to) })
+
+	session, resumed, err := registry.Open("", []int{1, 2})
+	require.NoError(t, err)
+	require.False(t, resumed)
+	client, err := registry.Attach(session.ID, func(replay []models.RawQueryResults, uploaded map[string]models.UploadProgress) *Client {
+		return NewClient(nil, nil, origin{gateway: "gateway"}, session.ID, replay, uploaded, Quota{}, NewOutbox(session.ID, OutboxLimits{Size: 1}), registry)
+	})
+	require.NoError(t, err)
+
+	// Query 1 results arrive while the client is still uploading
+	attached, err := registry.AddResults(session.ID, models.RawQueryResults{QueryId: 1, Items: json.RawMessage(`[]`)}, "")
+	require.NoError(t, err)
+	require.Same(t, client, attached)
+	state, _ := registry.State(session.ID)
+	require.Equal(t, StateUploading, state)
+
+	registry.Uploaded(session.ID)
+	registry.Finish(session.ID, StateDone)
+	_, ok := registry.State(session.ID)
+	require.False(t, ok)
+	require.Equal(t, []SessionState{StateDelivering, StateDone}, transitions)
+
+	stored, err := store.Load()
+	require.NoError(t, err)
+	require.Empty(t, stored)
+}
+
+func TestRegistryReloadsSessionsWithoutClient(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, store.Save(NewSession("waiting", "gateway")))
+
+	registry, err := NewRegistry(store, "gateway", time.Minute, 1)
+	require.NoError(t, err)
+	state, ok := registry.State("waiting")
+	require.True(t, ok)
+	require.Equal(t, StateProcessing, state)
+
+	_, err = registry.AddResults("waiting", models.RawQueryResults{QueryId: 2, Items: json.RawMessage(`[]`), Last: true}, "")
+	require.NoError(t, err)
+	state, _ = registry.State("waiting")
+	require.Equal(t, StateDelivering, state)
+
+	registry.Finish("waiting", StateProcessing)
+	state, _ = registry.State("waiting")
+	require.Equal(t, StateDelivering, state)
+}
+
+func TestRegistryClaimsSessionsFromAnotherGateway(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	require.NoError(t, err)
+	first, err := NewRegistry(store, "gateway-1", time.Minute, 2)
+	require.NoError(t, err)
+	second, err := NewRegistry(store, "gateway-2", time.Minute, 2)
+	require.NoError(t, err)
+
+	session, _, err := first.Open("", []int{1, 2})
+	require.NoError(t, err)
+	conn, _ := net.Pipe()
+	_, err = first.Attach(session.ID, func(replay []models.RawQueryResults, uploaded map[string]models.UploadProgress) *Client {
+		return NewClient(conn, nil, origin{gateway: "gateway-1"}, session.ID, replay, uploaded, Quota{}, NewOutbox(session.ID, OutboxLimits{Size: 1}), first)
+	})
+	require.NoError(t, err)
+	// Only the checkpoint is saved, the third batch is sent again after a failover
+	require.NoError(t, first.Received(session.ID, "movies", 10, models.UploadProgress{Batches: 2}))
+	require.NoError(t, first.Received(session.ID, "movies", 15, models.UploadProgress{Batches: 3}))
+
+	var claimed []string
+	second.OnClaim(func(id, previous string) { claimed = append(claimed, id, previous) })
+	resumed, ok, err := second.Open(session.ID, []int{1, 2, 3})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []string{session.ID, "gateway-1"}, claimed)
+	require.Equal(t, map[string]models.UploadProgress{"movies": {Batches: 2}}, resumed.Uploaded)
+	require.Equal(t, []int{1, 2}, resumed.Shards)
+
+	first.Release(session.ID)
+	owner, err := first.Owner(session.ID)
+	require.NoError(t, err)
+	require.Equal(t, "gateway-2", owner)
+}
+
+func TestRegistryAttachesNoClientOnceClosed(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	require.NoError(t, err)
+	registry, err := NewRegistry(store, "gateway", time.Minute, 1)
+	require.NoError(t, err)
+	session, _, err := registry.Open("", []int{1})
+	require.NoError(t, err)
+
+	registry.CloseClients()
+	_, err = registry.Attach(session.ID, func(replay []models.RawQueryResults, uploaded map[string]models.UploadProgress) *Client {
+		t.Fatal("no client is built while the gateway shuts down")
+		return nil
+	})
+	require.Error(t, err)
+}
+
+func TestRegistryRejectsSessionIdsThatAreNotUuids(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewSessionStore(filepath.Join(dir, "sessions"))
+	require.NoError(t, err)
+	registry, err := NewRegistry(store, "gateway", time.Minute, 1)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "outside.json"), []byte(`{"id":"outside"}`), 0o644))
+
+	_, _, err = registry.Open("../outside", []int{1})
+	require.ErrorIs(t, err, errInvalidSessionID)
+	owner, err := registry.Owner("../outside")
+	require.NoError(t, err)
+	require.Empty(t, owner)
+}
+
+func TestResumedUploadGoesOnFromTheSavedQuota(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	require.NoError(t, err)
+	registry, err := NewRegistry(store, "gateway", time.Minute, 1)
+	require.NoError(t, err)
+	session, _, err := registry.Open("", []int{1})
+	require.NoError(t, err)
+
+	// A previous connection uploaded 8 movies in 40 bytes
+	saved := map[string]models.UploadProgress{"movies": {Batches: 2, Records: 8, Bytes: 40}}
+	client := NewClient(nil, nil, origin{gateway: "gateway"}, session.ID, nil, saved, Quota{MaxRecords: 10, MaxBytes: 100}, NewOutbox(session.ID, OutboxLimits{Size: 1}), registry)
+	require.Equal(t, int64(40), client.quota.bytes)
+
+	server, conn := net.Pipe()
+	defer conn.Close()
+	go func() {
+		_ = communication.SendData(conn, []models.RawMovie{{}, {}, {}})
+	}()
+	toPreprocess := make(chan []byte, 1)
+	err = receiveData[models.RawMovie](toPreprocess, "movies", &server, session.ID, origin{}, saved["movies"], &client.quota, registry)
+	require.ErrorIs(t, err, errQuotaExceeded)
+	require.Empty(t, toPreprocess)
+}
+
+func TestRegistryDropsResultsOfABatchAlreadyReceived(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	require.NoError(t, err)
+	registry, err := NewRegistry(store, "gateway", time.Minute, 1)
+	require.NoError(t, err)
+	session, _, err := registry.Open("", []int{1})
+	require.NoError(t, err)
+	results := models.RawQueryResults{QueryId: 1, Items: json.RawMessage(`[{"title":"movie"}]`)}
+	_, err = registry.AddResults(session.ID, results, "gateway/1")
+	require.NoError(t, err)
+
+	// The batch is redelivered after the gateway that received it restarted
+	restarted, err := NewRegistry(store, "gateway", time.Minute, 1)
+	require.NoError(t, err)
+	_, err = restarted.AddResults(session.ID, results, "gateway/1")
+	require.NoError(t, err)
+	_, err = restarted.AddResults(session.ID, results, "gateway/2")
+	require.NoError(t, err)
+
+	stored, err := store.Get(session.ID)
+	require.NoError(t, err)
+	require.Len(t, stored.Results, 2)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"tp-sistemas-distribuidos/server/common"
+)
+
+var errInvalidRing = errors.New("invalid joiner ring")
+
+// JoinerRing is the set of joiner shards new sessions are spread over. Every session keeps the ring it
+// was opened with, so changing it only affects the sessions opened afterwards. There is no hand-off of
+// the movies of a session in flight to another joiner: a shard taken out of the ring drains instead, it
+// keeps serving the sessions opened before and is retired once none of them is left. So a long session
+// keeps a drained shard running for as long as it lasts, and a session left in the store by a gateway
+// that went away keeps it until the session is cancelled or claimed and finished
+type JoinerRing struct {
+	mu       sync.Mutex
+	path     string
+	shards   []int
+	draining []int
+}
+
+// ringState is the ring saved on disk. Rings saved before shards drained are a bare list of shards
+type ringState struct {
+	Shards   []int `json:"shards"`
+	Draining []int `json:"draining,omitempty"`
+}
+
+// NewJoinerRing loads the ring saved in the file, or starts with the shards 1 to count
+func NewJoinerRing(path string, count int) (*JoinerRing, error) {
+	r := &JoinerRing{path: path, shards: common.DefaultShards(count)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading joiner ring: %w", err)
+	}
+	var state ringState
+	if err := json.Unmarshal(data, &state); err != nil {
+		if err := json.Unmarshal(data, &state.Shards); err != nil {
+			return nil, fmt.Errorf("error unmarshalling joiner ring: %w", err)
+		}
+	}
+	r.shards, r.draining = state.Shards, state.Draining
+	return r, nil
+}
+
+func (r *JoinerRing) Shards() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.shards)
+}
+
+// Draining returns the shards taken out of the ring that were not retired yet
+func (r *JoinerRing) Draining() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.draining)
+}
+
+// Set replaces the shards of the ring and saves them. The shards taken out of it drain, and the ones
+// put back stop draining. It reports whether the ring changed
+func (r *JoinerRing) Set(shards []int) (bool, error) {
+	if len(shards) == 0 {
+		return false, fmt.Errorf("%w: it needs at least one shard", errInvalidRing)
+	}
+	shards = slices.Clone(shards)
+	slices.Sort(shards)
+	if shards[0] < 1 {
+		return false, fmt.Errorf("%w: shard %d", errInvalidRing, shards[0])
+	}
+	if len(slices.Compact(slices.Clone(shards))) != len(shards) {
+		return false, fmt.Errorf("%w: repeated shards", errInvalidRing)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if slices.Equal(r.shards, shards) {
+		return false, nil
+	}
+	var draining []int
+	for _, shard := range append(slices.Clone(r.draining), r.shards...) {
+		if !slices.Contains(shards, shard) && !slices.Contains(draining, shard) {
+			draining = append(draining, shard)
+		}
+	}
+	slices.Sort(draining)
+	if err := r.save(shards, draining); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Retire forgets a drained shard, no session uses it anymore. It reports whether the shard was draining
+func (r *JoinerRing) Retire(shard int) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !slices.Contains(r.draining, shard) {
+		return false, nil
+	}
+	draining := slices.DeleteFunc(slices.Clone(r.draining), func(s int) bool { return s == shard })
+	if err := r.save(r.shards, draining); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *JoinerRing) save(shards, draining []int) error {
+	data, err := json.Marshal(ringState{Shards: shards, Draining: draining})
+	if err != nil {
+		return fmt.Errorf("error marshalling joiner ring: %w", err)
+	}
+	if err := common.WriteFileAtomic(r.path, data); err != nil {
+		return fmt.Errorf("error saving joiner ring: %w", err)
+	}
+	r.shards, r.draining = shards, draining
+	return nil
+}
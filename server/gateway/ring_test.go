@@ -0,0 +1,72 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+	"tp-sistemas-distribuidos/server/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGatewayRetiresShardsOnceTheirSessionsAreOver(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewSessionStore(filepath.Join(dir, "sessions"))
+	require.NoError(t, err)
+	registry, err := NewRegistry(store, "gateway", time.Minute, 1)
+	require.NoError(t, err)
+	ring, err := NewJoinerRing(filepath.Join(dir, "ring.json"), 2)
+	require.NoError(t, err)
+	control := make(chan []byte, 4)
+	gateway := &Gateway{config: GatewayConfig{JoinerShards: 2}, registry: registry, store: store, ring: ring, control: control}
+	broadcast := func() common.ControlMsg {
+		msg, err := common.DecodeControlMsg(<-control)
+		require.NoError(t, err)
+		return msg
+	}
+
+	inFlight, _, err := registry.Open("", ring.Shards())
+	require.NoError(t, err)
+
+	// The ring changes while the session is in flight, the shard taken out drains
+	require.NoError(t, gateway.changeRing([]int{1, 3}))
+	require.Equal(t, common.ControlMsg{Kind: common.RingChanged, Shards: []int{1, 3}}, broadcast())
+	require.Equal(t, []int{2}, ring.Draining())
+	opened, _, err := registry.Open("", ring.Shards())
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 3}, opened.Shards)
+
+	for range 3 {
+		require.NoError(t, gateway.retireShards())
+	}
+	require.Equal(t, []int{2}, ring.Draining())
+	require.Empty(t, control)
+
+	// Once the session is over the shard is retired after a second sweep finds it unused
+	registry.Finish(inFlight.ID, StateDone)
+	require.NoError(t, gateway.retireShards())
+	require.Equal(t, []int{2}, ring.Draining())
+	require.NoError(t, gateway.retireShards())
+	require.Empty(t, ring.Draining())
+	require.Equal(t, common.ControlMsg{Kind: common.ShardRetired, Shards: []int{2}}, broadcast())
+
+	restarted, err := NewJoinerRing(filepath.Join(dir, "ring.json"), 2)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 3}, restarted.Shards())
+	require.Empty(t, restarted.Draining())
+}
+
+func TestJoinerRingPutsBackDrainingShards(t *testing.T) {
+	ring, err := NewJoinerRing(filepath.Join(t.TempDir(), "ring.json"), 3)
+	require.NoError(t, err)
+	_, err = ring.Set([]int{1})
+	require.NoError(t, err)
+	require.Equal(t, []int{2, 3}, ring.Draining())
+
+	_, err = ring.Set([]int{1, 3})
+	require.NoError(t, err)
+	require.Equal(t, []int{2}, ring.Draining())
+	retired, err := ring.Retire(3)
+	require.NoError(t, err)
+	require.False(t, retired)
+}
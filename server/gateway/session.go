@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"pkg/models"
+	"slices"
+	"strings"
+	"time"
+	"tp-sistemas-distribuidos/server/common"
+
+	"github.com/google/uuid"
+)
+
+// errInvalidSessionID rejects the ids that are not uuids, they name files in the store
+var errInvalidSessionID = errors.New("invalid session id")
+
+const (
+	totalQueries  = 5
+	sessionSuffix = ".json"
+	resultsSuffix = ".results"
+)
+
+// Session is what the gateway knows about a client job: how much of each dataset was uploaded and the
+// results received so far for each query. It is kept on disk, in a directory that the gateways can share,
+// so a client can claim it by id after its gateway restarts or through another gateway. The results are
+// appended to a log of their own as they arrive, the rest is saved on every change
+type Session struct {
+	ID       string                           `json:"id"`
+	Gateway  string                           `json:"gateway,omitempty"` // the one serving the client
+	OpenedAt time.Time                        `json:"opened_at"`
+	Uploaded map[string]models.UploadProgress `json:"uploaded,omitempty"`
+	Shards   []int                            `json:"shards,omitempty"` // joiner ring of the session
+	Results  []models.RawQueryResults         `json:"-"`
+	batches  map[string]struct{}              // the results were taken from
+}
+
+// resultsRecord is an entry of the results log. Batch names the batch the results were taken from, so
+// the one redelivered after a failover is not added twice
+type resultsRecord struct {
+	Batch string `json:"batch,omitempty"`
+	models.RawQueryResults
+}
+
+func NewSession(id, gateway string) *Session {
+	// Kept in UTC to the second, so the session reads back the same from its file
+	return &Session{ID: id, Gateway: gateway, OpenedAt: time.Now().UTC().Truncate(time.Second)}
+}
+
+// QueryFinished reports whether the last results of the query were already received
+func (s *Session) QueryFinished(query int) bool {
+	for _, results := range s.Results {
+		if results.QueryId == query && results.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// CompletedQueries returns the queries whose last results were received, in order
+func (s *Session) CompletedQueries() []int {
+	completed := []int{}
+	for _, results := range s.Results {
+		if results.Last {
+			completed = append(completed, results.QueryId)
+		}
+	}
+	slices.Sort(completed)
+	return completed
+}
+
+// AddResults adds the results taken from the batch, an empty batch is not remembered
+func (s *Session) AddResults(results models.RawQueryResults, batch string) {
+	s.Results = append(s.Results, results)
+	if batch == "" {
+		return
+	}
+	if s.batches == nil {
+		s.batches = make(map[string]struct{})
+	}
+	s.batches[batch] = struct{}{}
+}
+
+// HasBatch reports whether the results of the batch were already added
+func (s *Session) HasBatch(batch string) bool {
+	_, ok := s.batches[batch]
+	return ok
+}
+
+// SessionStore saves every session in its own file, replaced atomically on each change, next to the log
+// of its results
+type SessionStore struct {
+	dir string
+}
+
+func NewSessionStore(dir string) (*SessionStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating sessions directory: %w", err)
+	}
+	return &SessionStore{dir: dir}, nil
+}
+
+func validateSessionID(id string) error {
+	if err := uuid.Validate(id); err != nil {
+		return fmt.Errorf("%w %q: %w", errInvalidSessionID, id, err)
+	}
+	return nil
+}
+
+func (s *SessionStore) path(id string) string {
+	return filepath.Join(s.dir, id+sessionSuffix)
+}
+
+func (s *SessionStore) resultsPath(id string) string {
+	return filepath.Join(s.dir, id+resultsSuffix)
+}
+
+func (s *SessionStore) Save(session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("error marshalling session %s: %w", session.ID, err)
+	}
+	if err := common.WriteFileAtomic(s.path(session.ID), data); err != nil {
+		return fmt.Errorf("error saving session %s: %w", session.ID, err)
+	}
+	return nil
+}
+
+// AppendResults adds the results to the log of the session. Every record starts on a new line, so one
+// torn by a crash is skipped on load and does not spoil the next one
+func (s *SessionStore) AppendResults(id string, results models.RawQueryResults, batch string) error {
+	data, err := json.Marshal(resultsRecord{Batch: batch, RawQueryResults: results})
+	if err != nil {
+		return fmt.Errorf("error marshalling results of session %s: %w", id, err)
+	}
+	file, err := os.OpenFile(s.resultsPath(id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening results of session %s: %w", id, err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append([]byte("\n"), data...)); err != nil {
+		return fmt.Errorf("error appending results of session %s: %w", id, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("error syncing results of session %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *SessionStore) Delete(id string) error {
+	for _, path := range []string{s.path(id), s.resultsPath(id)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error deleting session %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// readResults reads the log of results of the session, skipping a record torn by a crash
+func (s *SessionStore) readResults(session *Session) error {
+	data, err := os.ReadFile(s.resultsPath(session.ID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading results of session %s: %w", session.ID, err)
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var record resultsRecord
+		if len(line) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			slog.Warn("skipping torn results record", slog.String("id", session.ID), slog.String("error", err.Error()))
+			continue
+		}
+		session.AddResults(record.RawQueryResults, record.Batch)
+	}
+	return nil
+}
+
+// Get reads a single session, it returns nil if there is none with the id
+func (s *SessionStore) Get(id string) (*Session, error) {
+	if err := validateSessionID(id); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading session %s: %w", id, err)
+	}
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("error parsing session %s: %w", id, err)
+	}
+	if err := s.readResults(&session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *SessionStore) Load() (map[string]*Session, error) {
+	return s.readSessions(true)
+}
+
+// ShardsInUse returns the joiner shards of the sessions in the store, served by any gateway. Sessions
+// opened without a ring use the fallback one. Only the sessions are read, not their results
+func (s *SessionStore) ShardsInUse(fallback []int) (map[int]bool, error) {
+	sessions, err := s.readSessions(false)
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[int]bool)
+	for _, session := range sessions {
+		shards := session.Shards
+		if len(shards) == 0 {
+			shards = fallback
+		}
+		for _, shard := range shards {
+			inUse[shard] = true
+		}
+	}
+	return inUse, nil
+}
+
+func (s *SessionStore) readSessions(withResults bool) (map[string]*Session, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading sessions directory: %w", err)
+	}
+
+	sessions := make(map[string]*Session, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), sessionSuffix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			continue // finished meanwhile by the gateway serving it
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading session %s: %w", entry.Name(), err)
+		}
+		var session Session
+		if err := json.Unmarshal(data, &session); err != nil {
+			return nil, fmt.Errorf("error parsing session %s: %w", entry.Name(), err)
+		}
+		if withResults {
+			if err := s.readResults(&session); err != nil {
+				return nil, err
+			}
+		}
+		sessions[session.ID] = &session
+	}
+	return sessions, nil
+}
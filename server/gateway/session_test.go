@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"pkg/models"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionStoreReloadsResults(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewSessionStore(dir)
+	require.NoError(t, err)
+
+	session := NewSession("client", "gateway")
+	require.NoError(t, store.Save(session))
+	for _, results := range []models.RawQueryResults{
+		{QueryId: 2, Items: json.RawMessage(`[]`), Last: true},
+		{QueryId: 1, Items: json.RawMessage(`[{"title":"Tetro"}]`)},
+	} {
+		session.AddResults(results, "")
+		require.NoError(t, store.AppendResults(session.ID, results, ""))
+	}
+	require.NoError(t, store.Save(NewSession("finished", "gateway")))
+	require.NoError(t, store.AppendResults("finished", models.RawQueryResults{QueryId: 3, Items: json.RawMessage(`[]`)}, ""))
+	require.NoError(t, store.Delete("finished"))
+
+	// A torn write leaves only the temporary file behind, which is ignored
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "torn.json.tmp"), []byte("{"), 0o644))
+	// A torn results record is skipped, the ones appended after it are kept
+	file, err := os.OpenFile(filepath.Join(dir, "client.results"), os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = file.WriteString("\n" + `{"query_id":4,"ite`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	last := models.RawQueryResults{QueryId: 3, Items: json.RawMessage(`[]`), Last: true}
+	session.AddResults(last, "")
+	require.NoError(t, store.AppendResults(session.ID, last, ""))
+
+	restarted, err := NewSessionStore(dir)
+	require.NoError(t, err)
+	sessions, err := restarted.Load()
+	require.NoError(t, err)
+	require.Equal(t, map[string]*Session{"client": session}, sessions)
+	require.True(t, sessions["client"].QueryFinished(2))
+	require.False(t, sessions["client"].QueryFinished(1))
+}
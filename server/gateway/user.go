@@ -5,107 +5,181 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/google/uuid"
 	"io"
 	"log/slog"
 	"net"
 	"pkg/communication"
 	"pkg/models"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"tp-sistemas-distribuidos/server/common"
 )
 
+// uploadProducer is the producer of the batches uploaded by the clients. Every gateway numbers the batches
+// of a session the same way, so the ones sent again by a client resuming through another gateway are dropped
+const uploadProducer = "gateway"
+
+// origin is stamped on every batch uploaded for the session: the gateway that gets its results and the
+// joiner shards its movies are spread over
+type origin struct {
+	gateway string
+	shards  []int
+}
+
 type Client struct {
 	id           string
 	conn         net.Conn
-	dead         bool
-	recvChannel  chan *models.TotalQueryResults
+	dead         atomic.Bool
+	outbox       *Outbox
 	toPreprocess *chan<- []byte
+	origin       origin
+	replay       []models.RawQueryResults
+	uploaded     map[string]models.UploadProgress
+	registry     *Registry
+	quota        Quota
 	done         uint8
+	sending      sync.WaitGroup
 	ctx          context.Context
 	cancel       context.CancelFunc
 }
 
-func NewClient(conn net.Conn, toPreprocess *chan<- []byte) *Client {
+// NewClient attaches a connection to a session. The replayed results are sent before any new one, the
+// upload goes on from the progress already saved, and the registry follows the session as the client
+// uploads its datasets and receives the results. New results wait in the outbox until they are written
+func NewClient(conn net.Conn, toPreprocess *chan<- []byte, origin origin, sessionID string, replay []models.RawQueryResults, uploaded map[string]models.UploadProgress, quota Quota, outbox *Outbox, registry *Registry) *Client {
 	ctx, cancel := context.WithCancel(context.Background())
+	quota.resume(uploaded)
 	return &Client{
-		id:           uuid.NewString(),
+		id:           sessionID,
 		conn:         conn,
-		dead:         false,
-		recvChannel:  make(chan *models.TotalQueryResults),
+		outbox:       outbox,
 		toPreprocess: toPreprocess,
+		origin:       origin,
+		replay:       replay,
+		uploaded:     uploaded,
+		registry:     registry,
+		quota:        quota,
 		ctx:          ctx,
 		cancel:       cancel,
 	}
 }
 
+// Run serves the client until it received every result or its connection is closed. It only returns once
+// the upload stopped, so nothing is sent to the preprocessors after it
 func (c *Client) Run() {
-	defer c.Close()
-	go c.sendHandler()
+	c.sending.Add(1)
+	go func() {
+		defer c.sending.Done()
+		c.sendHandler()
+	}()
 	c.recvHandler()
+	c.Close()
+	c.sending.Wait()
 }
 
+// sendResult queues the results for the client. If its outbox overflows the client is too slow to keep
+// up and its session fails
 func (c *Client) sendResult(results *models.TotalQueryResults) {
-	c.recvChannel <- results
+	raw, err := communication.EncodeQueryResults(*results)
+	if err != nil {
+		slog.Error("error encoding query results", slog.String("error", err.Error()), slog.String("id", c.id))
+		return
+	}
+	err = c.outbox.Push(c.ctx, raw)
+	if errors.Is(err, errOutboxFull) {
+		slog.Warn("client outbox overflowed, failing session", slog.String("id", c.id))
+		c.registry.Finish(c.id, StateFailed)
+		c.Close()
+		return
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		slog.Error("error queueing query results", slog.String("error", err.Error()), slog.String("id", c.id))
+	}
 }
 
 func (c *Client) Close() {
 	if err := c.conn.Close(); err != nil {
 		slog.Error("Failed to close connection", slog.String("error", err.Error()))
 	}
-	c.dead = true
+	c.dead.Store(true)
 	c.cancel()
+	if err := c.outbox.Close(); err != nil {
+		slog.Error("error closing outbox", slog.String("error", err.Error()), slog.String("id", c.id))
+	}
 }
 
 func (c *Client) IsDead() bool {
-	return c.dead
+	return c.dead.Load()
 }
 
 func (c *Client) sendHandler() {
 
-	err := receiveData[models.RawMovie](*c.toPreprocess, "movies", &c.conn, c.id)
+	err := receiveData[models.RawMovie](*c.toPreprocess, "movies", &c.conn, c.id, c.origin, c.uploaded["movies"], &c.quota, c.registry)
 	if err != nil {
 		c.checkSendError(err, "error receiving movies")
 		return
 	}
 
-	err = receiveData[models.RawReview](*c.toPreprocess, "reviews", &c.conn, c.id)
+	err = receiveData[models.RawReview](*c.toPreprocess, "reviews", &c.conn, c.id, c.origin, c.uploaded["reviews"], &c.quota, c.registry)
 	if err != nil {
 		c.checkSendError(err, "error receiving reviews")
 		return
 	}
 
-	err = receiveData[models.RawCredits](*c.toPreprocess, "credits", &c.conn, c.id)
+	err = receiveData[models.RawCredits](*c.toPreprocess, "credits", &c.conn, c.id, c.origin, c.uploaded["credits"], &c.quota, c.registry)
 	if err != nil {
 		c.checkSendError(err, "error receiving credits")
 		return
 	}
+	c.registry.Uploaded(c.id)
 }
 
 func (c *Client) recvHandler() {
+	for _, results := range c.replay {
+		if err := communication.SendRawQueryResults(c.conn, results); err != nil {
+			c.checkRecvError(err)
+			return
+		}
+		if results.Last {
+			c.done++
+		}
+	}
+
 	for {
-		if c.done == 5 {
+		if c.done == totalQueries {
 			slog.Info("client finished receiving all data", slog.String("id", c.id))
+			c.registry.Finish(c.id, StateDone)
 			break
 		}
-		select {
-		case <-c.ctx.Done():
-		case results := <-c.recvChannel:
-			if results.Last {
-				c.done++
-			}
-			err := communication.SendQueryResults(c.conn, *results)
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					slog.Info("Client Disconnected", slog.String("id", c.id))
-				} else if errors.Is(err, net.ErrClosed) {
-					slog.Error("Client Conn was already closed", slog.String("id", c.id))
-				} else {
-					slog.Error("error sending query results", slog.String("error", err.Error()), slog.String("id", c.id))
-				}
-				return
+		results, err := c.outbox.Next(c.ctx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				slog.Error("error taking results from the outbox", slog.String("error", err.Error()), slog.String("id", c.id))
 			}
+			return
 		}
+		if err := communication.SendRawQueryResults(c.conn, results); err != nil {
+			c.checkRecvError(err)
+			return
+		}
+		if results.Rejected != "" {
+			c.registry.Finish(c.id, StateFailed)
+			return
+		}
+		if results.Last {
+			c.done++
+		}
+	}
+}
+
+func (c *Client) checkRecvError(err error) {
+	if errors.Is(err, io.EOF) {
+		slog.Info("Client Disconnected", slog.String("id", c.id))
+	} else if errors.Is(err, net.ErrClosed) {
+		slog.Error("Client Conn was already closed", slog.String("id", c.id))
+	} else {
+		slog.Error("error sending query results", slog.String("error", err.Error()), slog.String("id", c.id))
 	}
 }
 
@@ -113,20 +187,41 @@ func (c *Client) GetId() string {
 	return c.id
 }
 
-func receiveData[T any](toPreprocess chan<- []byte, batchType string, client *net.Conn, id string) error {
-	total := 0
+func receiveData[T any](toPreprocess chan<- []byte, batchType string, client *net.Conn, id string, origin origin, resume models.UploadProgress, quota *Quota, registry *Registry) error {
+	if resume.Done {
+		slog.Info("dataset already uploaded", slog.String("type", batchType), slog.String("id", id))
+		return nil
+	}
+	total := resume.Records
+	bytes := resume.Bytes
+	// Every stream of the client is numbered from 1 so the stateful nodes can drop redeliveries,
+	// a resumed upload goes on after the batches already received
+	seq := resume.Batches
 	for {
 		batch, err := communication.RecvBatch[T](*client)
 		if err != nil {
 			return fmt.Errorf("error receiving %s: %w", batchType, err)
 		}
 
-		err = publishBatch(batch, batchType, toPreprocess, id)
+		seq++
+		batchToSend, err := encodeBatch(batch, batchType, id, origin, seq)
 		if err != nil {
-			return fmt.Errorf("error publishing %s batch: %w", batchType, err)
+			return fmt.Errorf("error encoding %s batch: %w", batchType, err)
 		}
 
 		total += int(batch.Header.Weight)
+		bytes += int64(len(batchToSend))
+		if err := quota.charge(batchType, total, len(batchToSend)); err != nil {
+			return err
+		}
+		toPreprocess <- batchToSend
+		progress := models.UploadProgress{Batches: seq, Done: batch.IsEof(), Records: total, Bytes: bytes}
+		if progress.Done {
+			progress.Batches--
+		}
+		if err := registry.Received(id, batchType, total, progress); err != nil {
+			return fmt.Errorf("error saving upload progress: %w", err)
+		}
 
 		if batch.IsEof() {
 			break
@@ -136,31 +231,38 @@ func receiveData[T any](toPreprocess chan<- []byte, batchType string, client *ne
 	return nil
 }
 
-func publishBatch[T any](batch models.RawBatch[T], batchType string, toPreprocess chan<- []byte, clientId string) error {
+func encodeBatch[T any](batch models.RawBatch[T], batchType string, clientId string, origin origin, seq uint64) ([]byte, error) {
 	bodyBytes, err := json.Marshal(batch)
 	if err != nil {
-		return fmt.Errorf("error marshalling batch: %w", err)
+		return nil, fmt.Errorf("error marshalling batch: %w", err)
 	}
 
 	rawBatch := common.ToProcessMsg{
 		Type:     batchType,
 		ClientId: clientId,
+		Producer: uploadProducer,
+		Seq:      seq,
+		Gateway:  origin.gateway,
+		Shards:   origin.shards,
 		Body:     bodyBytes,
 	}
 
 	batchToSend, err := json.Marshal(rawBatch)
 	if err != nil {
-		return fmt.Errorf("error marshalling raw batch: %w", err)
+		return nil, fmt.Errorf("error marshalling raw batch: %w", err)
 	}
-
-	toPreprocess <- batchToSend
-	return nil
+	return batchToSend, nil
 }
 
 func (c *Client) checkSendError(err error, msg string) {
+	if errors.Is(err, errQuotaExceeded) {
+		slog.Warn("rejecting session", slog.String("id", c.id), slog.String("reason", err.Error()))
+		c.sendResult(&models.TotalQueryResults{Rejected: err.Error()})
+		return
+	}
 	if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, syscall.EPIPE) {
 		slog.Error(msg, slog.String("error", err.Error()))
 	} else {
-		c.dead = true
+		c.dead.Store(true)
 	}
 }
@@ -3,15 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"syscall"
+	"time"
 	"tp-sistemas-distribuidos/server/common"
 )
 
 const (
-	rabbitHost      = "rabbitmq" //"127.0.0.1"
 	moviesExchange  = "movies-exchange"
 	moviestopic     = "movies-to-join-%d"
 	reviewsExchange = "reviews-exchange"
@@ -23,24 +26,57 @@ const (
 )
 
 type JoinerController struct {
-	joinerId            int
-	middleware          *common.Middleware
-	sessions            map[string]*JoinerService
-	storedReviewBatches map[string][]common.Batch[common.Review]
+	joinerId      int
+	nodeID        string
+	middleware    *common.Middleware
+	health        *common.HealthServer
+	drainTimeout  time.Duration
+	sessions      map[string]*JoinerService
+	pending       *PendingBuffer
+	moviesDedup   *common.DedupFilter
+	reviewsDedup  *common.DedupFilter
+	creditsDedup  *common.DedupFilter
+	q3ToReduce    chan<- []byte
+	q4ToReduce    chan<- []byte
+	filters       chan<- []byte
+	wal           *common.WAL
+	snapshotEvery int
+	expiry        *common.SessionExpiry
+	sweepInterval time.Duration
 }
 
-func NewJoinerController(joinerId int, rabbitUser, rabbitPass string) (*JoinerController, error) {
-	middleware, err := common.NewMiddleware(rabbitUser, rabbitPass, rabbitHost)
+func NewJoinerController(cfg JoinerConfig) (*JoinerController, error) {
+	middleware, err := common.NewMiddleware(cfg.Node)
 	if err != nil {
 		slog.Error("error creating middleware", slog.String("error", err.Error()))
 		return nil, err
 	}
 
+	stateDir := filepath.Join(cfg.StateDir, fmt.Sprintf("joiner-%d", cfg.JoinerID))
+	wal, err := common.OpenWAL(stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("error opening wal: %w", err)
+	}
+	pending, err := NewPendingBuffer(filepath.Join(stateDir, "pending"), cfg.PendingBatches)
+	if err != nil {
+		return nil, err
+	}
+
 	return &JoinerController{
-		joinerId:            joinerId,
-		middleware:          middleware,
-		sessions:            map[string]*JoinerService{},
-		storedReviewBatches: map[string][]common.Batch[common.Review]{},
+		joinerId:      cfg.JoinerID,
+		nodeID:        cfg.ID(),
+		middleware:    middleware,
+		health:        common.NewHealthServer(cfg.Node, middleware),
+		drainTimeout:  cfg.DrainTimeout,
+		sessions:      map[string]*JoinerService{},
+		pending:       pending,
+		moviesDedup:   common.NewDedupFilter(cfg.SessionTTL),
+		reviewsDedup:  common.NewDedupFilter(cfg.SessionTTL),
+		creditsDedup:  common.NewDedupFilter(cfg.SessionTTL),
+		wal:           wal,
+		snapshotEvery: cfg.SnapshotEvery,
+		expiry:        common.NewSessionExpiry(cfg.SessionTTL),
+		sweepInterval: cfg.SweepInterval,
 	}, nil
 }
 
@@ -50,6 +86,8 @@ func (j *JoinerController) Start() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	j.health.Start()
+
 	moviesChan, err := j.middleware.GetChanWithTopicToRecv(moviesExchange, fmt.Sprintf(moviestopic, j.joinerId))
 	if err != nil {
 		slog.Error("Error creating channel", slog.String("queue", moviesExchange), slog.String("error", err.Error()))
@@ -68,28 +106,49 @@ func (j *JoinerController) Start() {
 		return
 	}
 
-	q3ToReduce, err := j.middleware.GetChanToSend(q3ToReduceQueue)
+	controlChan, err := j.middleware.GetBroadcastChanToRecv(common.ControlExchange, fmt.Sprintf("joiner-%d", j.joinerId))
+	if err != nil {
+		slog.Error("Error creating channel", slog.String("exchange", common.ControlExchange), slog.String("error", err.Error()))
+		return
+	}
+
+	j.q3ToReduce, err = j.middleware.GetChanToSend(q3ToReduceQueue)
 	if err != nil {
 		slog.Error("error creating channel", slog.String("queue", q3ToReduceQueue), slog.String("error", err.Error()))
 		return
 	}
 
-	q4ToReduce, err := j.middleware.GetChanToSend(q4ToReduceQueue)
+	j.q4ToReduce, err = j.middleware.GetChanToSend(q4ToReduceQueue)
 	if err != nil {
 		slog.Error("error creating channel", slog.String("queue", q4ToReduceQueue), slog.String("error", err.Error()))
 		return
 	}
 
-	j.run(ctx, moviesChan, reviewsChan, creditChan, q3ToReduce, q4ToReduce)
+	j.filters, err = j.middleware.GetChanToBroadcast(common.JoinFiltersExchange)
+	if err != nil {
+		slog.Error("error creating channel", slog.String("exchange", common.JoinFiltersExchange), slog.String("error", err.Error()))
+		return
+	}
+
+	if err := j.recover(); err != nil {
+		slog.Error("error recovering state", slog.String("error", err.Error()))
+		return
+	}
+
+	j.health.SetReady(true)
+
+	drainer := common.NewDrainer(ctx, j.middleware, j.drainTimeout)
+	j.run(drainer, moviesChan, reviewsChan, creditChan, controlChan)
+	drainer.Finish()
 }
 
-func (j *JoinerController) joinReviewBatch(clientId string, batch common.Batch[common.Review], q3ToReduce chan<- []byte) {
+func (j *JoinerController) joinReviewBatch(clientId string, batch common.Batch[common.Review]) {
 	session := j.getSession(clientId)
 	session.NotifyReview(batch.Header)
 
 	reviewXMovies := session.Join(batch.Data)
 	reviewsXMoviesBatch := common.Batch[common.MovieReview]{
-		Header: batch.Header,
+		Header: batch.Header.WithProducer(j.nodeID),
 		Data:   reviewXMovies,
 	}
 
@@ -97,110 +156,254 @@ func (j *JoinerController) joinReviewBatch(clientId string, batch common.Batch[c
 	if err != nil {
 		slog.Error("error marshalling batch", slog.String("error", err.Error()))
 	}
-	q3ToReduce <- response
-}
-
-func (j *JoinerController) storeReviewBatch(clientId string, batch common.Batch[common.Review]) {
-	j.storedReviewBatches[clientId] = append(j.storedReviewBatches[clientId], batch)
+	j.q3ToReduce <- response
 }
 
-func (j *JoinerController) joinStoredReviewBatches(clientId string, q3ToReduce chan<- []byte) {
-	slog.Info("joining stored review batches", slog.String("clientId", clientId))
-	batches := j.storedReviewBatches[clientId]
-	j.storedReviewBatches[clientId] = []common.Batch[common.Review]{}
-	for _, batch := range batches {
-		j.joinReviewBatch(clientId, batch, q3ToReduce)
-		j.exorciseSession(clientId)
+// joinPending joins the reviews and credits that arrived before the movies of the client were complete
+func (j *JoinerController) joinPending(clientId string) error {
+	batches, err := j.pending.Take(clientId)
+	if err != nil {
+		return err
 	}
+	if len(batches) > 0 {
+		slog.Info("joining pending batches", slog.String("clientId", clientId), slog.Int("batches", len(batches)))
+	}
+	for _, pending := range batches {
+		switch pending.Kind {
+		case reviewsRecord:
+			var batch common.Batch[common.Review]
+			if err := json.Unmarshal(pending.Body, &batch); err != nil {
+				return fmt.Errorf("error unmarshalling pending reviews: %w", err)
+			}
+			j.joinReviewBatch(clientId, batch)
+		case creditsRecord:
+			var batch common.Batch[common.Credit]
+			if err := json.Unmarshal(pending.Body, &batch); err != nil {
+				return fmt.Errorf("error unmarshalling pending credits: %w", err)
+			}
+			j.filterCreditsBatch(clientId, batch)
+		}
+	}
+	j.exorciseSession(clientId)
+	return nil
 }
 
-func (j *JoinerController) run(
-	ctx context.Context,
-	_moviesChan, _reviewsChan, _creditChan <-chan common.Message,
-	q3ToReduce, q4ToReduce chan<- []byte,
-) {
-	dummyChan := make(<-chan common.Message)
-	movies := _moviesChan
-	reviews := dummyChan
-	credits := dummyChan
-	for {
+// run consumes every input from the start, the reviews and credits of a client wait in the pending
+// buffer until its movies are complete
+func (j *JoinerController) run(drainer *common.Drainer, movies, reviews, credits, control <-chan common.Message) {
+	ticker := time.NewTicker(common.HealthTickInterval)
+	defer ticker.Stop()
+	sweeper := time.NewTicker(j.sweepInterval)
+	defer sweeper.Stop()
+	for movies != nil || reviews != nil || credits != nil {
+		var err error
 		select {
-		case <-ctx.Done():
-			slog.Info("received termination signal, stopping joiner")
+		case <-drainer.Signal():
+			slog.Info("received termination signal, draining joiner")
+			j.health.SetReady(false)
+			drainer.Start()
+		case <-drainer.Expired():
+			slog.Warn("drain timeout expired, stopping joiner")
 			return
-		case msg := <-movies:
-			var batch common.Batch[common.Movie]
-			if err := json.Unmarshal(msg.Body, &batch); err != nil {
-				slog.Error("error unmarshalling message", slog.String("error", err.Error()))
+		case <-ticker.C:
+			j.health.Tick()
+		case <-sweeper.C:
+			err = j.expireSessions()
+		case msg, ok := <-control:
+			if !ok {
+				control = nil
 				continue
 			}
-			clientId := batch.GetClientID()
-			session := j.getSession(clientId)
-			session.SaveMovies(batch)
-			if session.AllMoviesReceived() {
-				slog.Info("Received all movies. starting to pop reviews")
-				reviews = _reviewsChan
-				credits = _creditChan
-				j.joinStoredReviewBatches(clientId, q3ToReduce) // Joins all reviews stored
-			}
-			if err := msg.Ack(); err != nil {
-				slog.Error("error acknowledging message", slog.String("error", err.Error()))
+			err = j.handleControl(msg)
+		case msg, ok := <-movies:
+			if !ok {
+				movies = nil
+				continue
 			}
-
-		case msg := <-reviews:
-			var batch common.Batch[common.Review]
-			if err := json.Unmarshal(msg.Body, &batch); err != nil {
-				slog.Error("error unmarshalling message", slog.String("error", err.Error()))
+			err = j.process(msg, moviesRecord)
+		case msg, ok := <-reviews:
+			if !ok {
+				reviews = nil
 				continue
 			}
-			clientId := batch.GetClientID()
-			session := j.getSession(clientId)
-
-			if !session.AllMoviesReceived() {
-				j.storeReviewBatch(clientId, batch)
-				if err := msg.Ack(); err != nil {
-					slog.Error("error acknowledging message", slog.String("error", err.Error()))
-				}
+			err = j.process(msg, reviewsRecord)
+		case msg, ok := <-credits:
+			if !ok {
+				credits = nil
 				continue
 			}
+			err = j.process(msg, creditsRecord)
+		}
 
-			j.joinReviewBatch(clientId, batch, q3ToReduce)
+		if err != nil {
+			slog.Error("error persisting state, stopping joiner", slog.String("error", err.Error()))
+			return
+		}
+	}
+	slog.Info("joiner drained")
+}
 
-			if err := msg.Ack(); err != nil {
-				slog.Error("error acknowledging message", slog.String("error", err.Error()))
-			}
-			j.exorciseSession(clientId)
+const (
+	// crashAfterSaveMovies leaves a movies batch logged and applied in memory only
+	crashAfterSaveMovies = "joiner.after-save-movies"
+	// crashAfterApplyBeforeAck leaves the joined batches sent but the delivery unacked
+	crashAfterApplyBeforeAck = "joiner.after-apply-before-ack"
+)
 
-		case msg := <-credits:
-			var batch common.Batch[common.Credit]
-			if err := json.Unmarshal(msg.Body, &batch); err != nil {
-				slog.Error("error unmarshalling message", slog.String("error", err.Error()))
-				continue
-			}
-			clientId := batch.GetClientID()
-			session := j.getSession(clientId)
-			session.NotifyCredit(batch.Header)
-
-			actors := session.filterCredits(batch.Data)
-			actorsBatch := common.Batch[common.Credit]{
-				Header: batch.Header,
-				Data:   actors,
-			}
+// process logs a delivery in the wal, applies it and only then acks it
+func (j *JoinerController) process(msg common.Message, kind string) error {
+	if !json.Valid(msg.Body) {
+		slog.Error("dropping malformed message", slog.String("kind", kind))
+		if err := msg.Ack(); err != nil {
+			slog.Error("error acknowledging message", slog.String("error", err.Error()))
+		}
+		return nil
+	}
 
-			response, err := json.Marshal(actorsBatch)
-			if err != nil {
-				slog.Error("error marshalling batch", slog.String("error", err.Error()))
-				continue
-			}
-			q4ToReduce <- response
+	if err := j.logRecord(walRecord{Kind: kind, Body: msg.Body}); err != nil {
+		return fmt.Errorf("error logging %s batch: %w", kind, err)
+	}
 
-			if err := msg.Ack(); err != nil {
-				slog.Error("error acknowledging message", slog.String("error", err.Error()))
-			}
-			j.exorciseSession(clientId)
+	if err := j.apply(kind, msg.Body); errors.Is(err, errSpill) {
+		return err
+	} else if err != nil {
+		slog.Error("error processing message", slog.String("kind", kind), slog.String("error", err.Error()))
+	}
+	common.CrashPoint(crashAfterApplyBeforeAck)
+	if err := msg.Ack(); err != nil {
+		slog.Error("error acknowledging message", slog.String("error", err.Error()))
+	}
+	return j.maybeSnapshot()
+}
+
+// apply updates the sessions with a batch. It is used both for deliveries and for the records
+// replayed on recovery; the joined batches sent again keep their producer and sequence number,
+// so the final reducers drop the ones they already had
+func (j *JoinerController) apply(kind string, body []byte) error {
+	switch kind {
+	case moviesRecord:
+		var batch common.Batch[common.Movie]
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return fmt.Errorf("error unmarshalling movies: %w", err)
+		}
+		return j.applyMovies(batch)
+	case reviewsRecord:
+		var batch common.Batch[common.Review]
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return fmt.Errorf("error unmarshalling reviews: %w", err)
+		}
+		return j.applyReviews(batch, body)
+	case creditsRecord:
+		var batch common.Batch[common.Credit]
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return fmt.Errorf("error unmarshalling credits: %w", err)
+		}
+		return j.applyCredits(batch, body)
+	case expiredRecord, cancelledRecord:
+		var clientId string
+		if err := json.Unmarshal(body, &clientId); err != nil {
+			return fmt.Errorf("error unmarshalling %s session: %w", kind, err)
 		}
+		j.evictSession(clientId)
+	default:
+		return fmt.Errorf("unknown record kind %q", kind)
+	}
+	return nil
+}
 
+func (j *JoinerController) applyMovies(batch common.Batch[common.Movie]) error {
+	if j.isDuplicate(j.moviesDedup, batch.Header) {
+		return nil
 	}
+	clientId := batch.GetClientID()
+	session := j.getSession(clientId)
+	session.SaveMovies(batch)
+	common.CrashPoint(crashAfterSaveMovies)
+	if session.AllMoviesReceived() {
+		j.publishFilter(clientId, session)
+		return j.joinPending(clientId)
+	}
+	return nil
+}
+
+// publishFilter tells the preprocessors which movies of the client this shard holds, so they stop
+// sending the reviews and credits of other movies. Losing it only costs traffic
+func (j *JoinerController) publishFilter(clientId string, session *JoinerService) {
+	filter := common.JoinFilter{
+		ClientID: clientId,
+		Shard:    j.joinerId,
+		Movies:   common.NewBloomFilter(session.MovieIDs()),
+	}
+	data, err := json.Marshal(filter)
+	if err != nil {
+		slog.Error("error marshalling join filter", slog.String("error", err.Error()))
+		return
+	}
+	j.filters <- data
+}
+
+// publishDone tells the preprocessors that the shard finished the client, so they drop its filter
+func (j *JoinerController) publishDone(clientId string) {
+	data, err := json.Marshal(common.JoinFilter{ClientID: clientId, Shard: j.joinerId, Done: true})
+	if err != nil {
+		slog.Error("error marshalling join filter", slog.String("error", err.Error()))
+		return
+	}
+	j.filters <- data
+}
+
+func (j *JoinerController) applyReviews(batch common.Batch[common.Review], body []byte) error {
+	if j.isDuplicate(j.reviewsDedup, batch.Header) {
+		return nil
+	}
+	clientId := batch.GetClientID()
+	if !j.getSession(clientId).AllMoviesReceived() {
+		return j.pending.Add(clientId, pendingBatch{Kind: reviewsRecord, Body: body})
+	}
+
+	j.joinReviewBatch(clientId, batch)
+	j.exorciseSession(clientId)
+	return nil
+}
+
+func (j *JoinerController) applyCredits(batch common.Batch[common.Credit], body []byte) error {
+	if j.isDuplicate(j.creditsDedup, batch.Header) {
+		return nil
+	}
+	clientId := batch.GetClientID()
+	if !j.getSession(clientId).AllMoviesReceived() {
+		return j.pending.Add(clientId, pendingBatch{Kind: creditsRecord, Body: body})
+	}
+
+	j.filterCreditsBatch(clientId, batch)
+	j.exorciseSession(clientId)
+	return nil
+}
+
+func (j *JoinerController) filterCreditsBatch(clientId string, batch common.Batch[common.Credit]) {
+	session := j.getSession(clientId)
+	session.NotifyCredit(batch.Header)
+
+	actors := session.filterCredits(batch.Data)
+	actorsBatch := common.Batch[common.Credit]{
+		Header: batch.Header.WithProducer(j.nodeID),
+		Data:   actors,
+	}
+
+	response, err := json.Marshal(actorsBatch)
+	if err != nil {
+		slog.Error("error marshalling batch", slog.String("error", err.Error()))
+		return
+	}
+	j.q4ToReduce <- response
+}
+
+func (j *JoinerController) isDuplicate(dedup *common.DedupFilter, header common.Header) bool {
+	if !dedup.IsDuplicate(header) {
+		return false
+	}
+	slog.Debug("dropping duplicate batch", slog.String("clientId", header.ClientID), slog.String("producer", header.ProducerID), slog.Uint64("seq", header.Seq))
+	return true
 }
 
 func (j *JoinerController) getSession(clientId string) *JoinerService {
@@ -208,6 +411,7 @@ func (j *JoinerController) getSession(clientId string) *JoinerService {
 		slog.Info("New client detected. creating session", slog.String("clientId", string(clientId)))
 		j.sessions[clientId] = NewJoinerService()
 	}
+	j.expiry.Touch(clientId)
 	return j.sessions[clientId]
 }
 
@@ -215,14 +419,101 @@ func (j *JoinerController) getSession(clientId string) *JoinerService {
 func (j *JoinerController) exorciseSession(id string) {
 	if j.sessions[id].IsDone() {
 		slog.Info("Done for client", slog.String("clientId", id))
-		delete(j.sessions, id)
+		j.publishDone(id)
+		j.evictSession(id)
 		slog.Info("Successfully deleted session", slog.String("clientId", id))
 	}
 }
 
+// evictSession drops everything kept for the client, later batches of it are dropped as duplicates
+func (j *JoinerController) evictSession(id string) {
+	delete(j.sessions, id)
+	j.pending.Drop(id)
+	j.moviesDedup.Close(id)
+	j.reviewsDedup.Close(id)
+	j.creditsDedup.Close(id)
+	j.expiry.Forget(id)
+}
+
+// expireSessions evicts the sessions whose client stopped sending batches for longer than the ttl.
+// The eviction is logged, so a restart does not bring the sessions back. Clients finished for longer
+// than the ttl are forgotten
+func (j *JoinerController) expireSessions() error {
+	j.moviesDedup.Expire()
+	j.reviewsDedup.Expire()
+	j.creditsDedup.Expire()
+	for _, id := range j.expiry.Expired() {
+		if _, ok := j.sessions[id]; !ok {
+			continue
+		}
+		slog.Warn("session expired, evicting it", slog.String("clientId", id), slog.Int("pending batches", j.pending.Len(id)))
+		if err := j.logEviction(expiredRecord, id); err != nil {
+			return err
+		}
+	}
+	return j.maybeSnapshot()
+}
+
+// retire follows the retirement of this shard: the gateways found no session using it, so the sessions
+// still kept here are leftovers of clients that went away and are evicted before the shard is removed.
+// Their movies are not handed to another shard, so such a session ends without the results of the
+// joined queries; a client coming back for it has to start a new one
+func (j *JoinerController) retire() error {
+	for clientId := range j.sessions {
+		slog.Warn("evicting session left on a retired shard", slog.String("clientId", clientId))
+		if err := j.logEviction(cancelledRecord, clientId); err != nil {
+			return err
+		}
+	}
+	slog.Info("joiner shard retired, it can be removed", slog.Int("shard", j.joinerId))
+	return nil
+}
+
+// handleControl follows an order broadcast by the gateways. A cancelled session is evicted even if it
+// was not seen yet, so the batches of it still on their way are dropped. Moved sessions do not matter here
+func (j *JoinerController) handleControl(msg common.Message) error {
+	control, err := common.DecodeControlMsg(msg.Body)
+	if err != nil {
+		slog.Error("dropping control message", slog.String("error", err.Error()))
+	} else if control.Kind == common.CancelSession {
+		slog.Warn("session cancelled, evicting it", slog.String("clientId", control.ClientID), slog.Int("pending batches", j.pending.Len(control.ClientID)))
+		if err := j.logEviction(cancelledRecord, control.ClientID); err != nil {
+			return err
+		}
+	} else if control.Kind == common.ShardRetired && slices.Contains(control.Shards, j.joinerId) {
+		if err := j.retire(); err != nil {
+			return err
+		}
+	}
+	if err := msg.Ack(); err != nil {
+		slog.Error("error acknowledging message", slog.String("error", err.Error()))
+	}
+	return j.maybeSnapshot()
+}
+
+// logEviction logs that the session was evicted before evicting it, so a restart does not bring it back
+func (j *JoinerController) logEviction(kind, id string) error {
+	body, err := json.Marshal(id)
+	if err != nil {
+		return fmt.Errorf("error marshalling %s session: %w", kind, err)
+	}
+	if err := j.logRecord(walRecord{Kind: kind, Body: body}); err != nil {
+		return fmt.Errorf("error logging %s session: %w", kind, err)
+	}
+	j.evictSession(id)
+	return nil
+}
+
 func (j *JoinerController) stop() {
+	if err := j.health.Close(); err != nil {
+		slog.Error("error closing health server", slog.String("error", err.Error()))
+	}
 	if err := j.middleware.Close(); err != nil {
 		slog.Error("error closing middleware", slog.String("error", err.Error()))
 	}
+	if err := j.wal.Close(); err != nil {
+		slog.Error("error closing wal", slog.String("error", err.Error()))
+	}
+	j.pending.Close()
 	slog.Info("joiner stopped")
 }
@@ -3,11 +3,19 @@ package main
 import (
 	"fmt"
 	"log/slog"
-	"os"
+	"pkg/config"
 	"pkg/log"
-	"strconv"
 )
 
+type JoinerConfig struct {
+	config.Node
+	config.Persistence
+	config.Sessions
+	JoinerID int `env:"JOINER_ID" json:"joiner_id" required:"true" min:"1"`
+	// Batches waiting for the movies of their client kept in memory across every client, the rest spill to disk
+	PendingBatches int `env:"PENDING_BATCHES" json:"pending_batches" default:"1000" min:"0"`
+}
+
 func main() {
 	logger, err := log.SetupLogger("joiner", false, nil)
 	if err != nil {
@@ -16,22 +24,14 @@ func main() {
 	}
 	slog.SetDefault(logger)
 
-	rabbitUser := os.Getenv("RABBITMQ_DEFAULT_USER")
-	rabbitPass := os.Getenv("RABBITMQ_DEFAULT_PASS")
-	joinerId := os.Getenv("JOINER_ID")
-
-	if rabbitUser == "" || rabbitPass == "" || joinerId == "" {
-		slog.Error("environment validation failed", slog.String("error", "RABBITMQ_DEFAULT_USER and RABBITMQ_DEFAULT_PASS and JOINER_ID must be set"))
-		return
-	}
-
-	joinerIdInt, err := strconv.Atoi(joinerId)
-	if err != nil {
-		slog.Error("error converting JOINER_ID env var to int", slog.String("error", err.Error()))
+	var cfg JoinerConfig
+	if err := config.Load(&cfg); err != nil {
+		slog.Error("configuration validation failed", slog.String("error", err.Error()))
 		return
 	}
+	config.Log(cfg)
 
-	joiner, err := NewJoinerController(joinerIdInt, rabbitUser, rabbitPass)
+	joiner, err := NewJoinerController(cfg)
 	if err != nil {
 		slog.Error("error creating joiner", slog.String("error", err.Error()))
 		return
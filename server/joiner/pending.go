@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// errSpill is a failure of the disk behind the pending batches, the joiner stops instead of losing them
+var errSpill = errors.New("pending batches spill failed")
+
+// pendingBatch is a reviews or credits batch of a client whose movies are not complete yet
+type pendingBatch struct {
+	Kind string          `json:"kind"`
+	Body json.RawMessage `json:"body"`
+}
+
+type spillState struct {
+	Size    int64 `json:"size"`
+	Batches int   `json:"batches"`
+}
+
+// pendingState is what a snapshot keeps of the pending batches. The spill files are cut back to the
+// recorded size on restore, the batches written after the snapshot are added again by the wal replay
+type pendingState struct {
+	Memory  map[string][]pendingBatch `json:"memory"`
+	Spilled map[string]spillState     `json:"spilled"`
+}
+
+type spillFile struct {
+	file *os.File
+	spillState
+}
+
+// PendingBuffer holds the batches that wait for the movies of their client. Up to limit of them are kept
+// in memory across every client, the rest are appended to a spill file of the client
+type PendingBuffer struct {
+	dir      string
+	limit    int
+	memory   map[string][]pendingBatch
+	inMemory int
+	spilled  map[string]*spillFile
+	released []string // spill files the last snapshot may still need
+}
+
+func NewPendingBuffer(dir string, limit int) (*PendingBuffer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating pending batches dir: %w", err)
+	}
+	return &PendingBuffer{
+		dir:     dir,
+		limit:   limit,
+		memory:  make(map[string][]pendingBatch),
+		spilled: make(map[string]*spillFile),
+	}, nil
+}
+
+func (p *PendingBuffer) path(clientID string) string {
+	return filepath.Join(p.dir, clientID+".spill")
+}
+
+// Add keeps the batch of the client until its movies are complete
+func (p *PendingBuffer) Add(clientID string, batch pendingBatch) error {
+	if p.inMemory < p.limit {
+		p.memory[clientID] = append(p.memory[clientID], batch)
+		p.inMemory++
+		return nil
+	}
+
+	spill, ok := p.spilled[clientID]
+	if !ok {
+		// The id names the spill file, only the uuids the gateways give to their clients are taken
+		if err := uuid.Validate(clientID); err != nil {
+			return fmt.Errorf("invalid client id %q: %w", clientID, err)
+		}
+		file, err := os.OpenFile(p.path(clientID), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errSpill, err)
+		}
+		spill = &spillFile{file: file}
+		p.spilled[clientID] = spill
+	}
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("error marshalling pending batch: %w", err)
+	}
+	if _, err := spill.file.WriteAt(data, spill.Size); err != nil {
+		return fmt.Errorf("%w: %w", errSpill, err)
+	}
+	spill.Size += int64(len(data))
+	spill.Batches++
+	return nil
+}
+
+// Take returns and forgets every batch kept for the client
+func (p *PendingBuffer) Take(clientID string) ([]pendingBatch, error) {
+	batches := p.memory[clientID]
+	p.inMemory -= len(batches)
+	delete(p.memory, clientID)
+
+	spill, ok := p.spilled[clientID]
+	if !ok {
+		return batches, nil
+	}
+	decoder := json.NewDecoder(io.NewSectionReader(spill.file, 0, spill.Size))
+	for range spill.Batches {
+		var batch pendingBatch
+		if err := decoder.Decode(&batch); err != nil {
+			return nil, fmt.Errorf("%w: reading batch: %w", errSpill, err)
+		}
+		batches = append(batches, batch)
+	}
+	p.release(clientID)
+	return batches, nil
+}
+
+// Drop forgets the batches kept for the client
+func (p *PendingBuffer) Drop(clientID string) {
+	p.inMemory -= len(p.memory[clientID])
+	delete(p.memory, clientID)
+	if _, ok := p.spilled[clientID]; ok {
+		p.release(clientID)
+	}
+}
+
+// release closes the spill file of the client. It is removed once a snapshot no longer refers to it
+func (p *PendingBuffer) release(clientID string) {
+	spill := p.spilled[clientID]
+	delete(p.spilled, clientID)
+	_ = spill.file.Close()
+	p.released = append(p.released, spill.file.Name())
+}
+
+// Prune removes the spill files released before the last snapshot
+func (p *PendingBuffer) Prune() error {
+	for _, path := range p.released {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %w", errSpill, err)
+		}
+	}
+	p.released = nil
+	return nil
+}
+
+// Len is the number of batches kept for the client
+func (p *PendingBuffer) Len(clientID string) int {
+	n := len(p.memory[clientID])
+	if spill, ok := p.spilled[clientID]; ok {
+		n += spill.Batches
+	}
+	return n
+}
+
+// State syncs the spill files, so the snapshot never records more than what is on disk
+func (p *PendingBuffer) State() (pendingState, error) {
+	state := pendingState{Memory: p.memory, Spilled: make(map[string]spillState, len(p.spilled))}
+	for clientID, spill := range p.spilled {
+		if err := spill.file.Sync(); err != nil {
+			return state, fmt.Errorf("%w: %w", errSpill, err)
+		}
+		state.Spilled[clientID] = spill.spillState
+	}
+	return state, nil
+}
+
+// Restore brings back the batches of a snapshot, spill files it does not know are removed
+func (p *PendingBuffer) Restore(state pendingState) error {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errSpill, err)
+	}
+	for _, entry := range entries {
+		clientID, ok := strings.CutSuffix(entry.Name(), ".spill")
+		saved, known := state.Spilled[clientID]
+		if !ok || !known || uuid.Validate(clientID) != nil {
+			if err := os.Remove(filepath.Join(p.dir, entry.Name())); err != nil {
+				return fmt.Errorf("%w: %w", errSpill, err)
+			}
+			continue
+		}
+		file, err := os.OpenFile(p.path(clientID), os.O_RDWR, 0o644)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errSpill, err)
+		}
+		if err := file.Truncate(saved.Size); err != nil {
+			_ = file.Close()
+			return fmt.Errorf("%w: %w", errSpill, err)
+		}
+		p.spilled[clientID] = &spillFile{file: file, spillState: saved}
+	}
+	if len(p.spilled) != len(state.Spilled) {
+		return fmt.Errorf("%w: %d spill files are missing", errSpill, len(state.Spilled)-len(p.spilled))
+	}
+
+	for clientID, batches := range state.Memory {
+		p.memory[clientID] = batches
+		p.inMemory += len(batches)
+	}
+	return nil
+}
+
+// Close closes the spill files, they stay on disk for the next start
+func (p *PendingBuffer) Close() {
+	for _, spill := range p.spilled {
+		_ = spill.file.Close()
+	}
+}
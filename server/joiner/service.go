@@ -6,7 +6,8 @@ import (
 )
 
 type JoinerService struct {
-	movies          []common.Movie
+	movies          []common.Movie            // received while the movies are not complete
+	moviesByID      map[string][]common.Movie // index of movies, built once they are complete
 	moviesReceived  uint32
 	reviewsReceived uint32
 	creditsReceived uint32
@@ -31,14 +32,44 @@ func (s *JoinerService) SaveMovies(batch common.Batch[common.Movie]) {
 	if batch.IsEof() {
 		slog.Info("movies Eof received", slog.Any("header", batch.Header))
 		s.moviesToExpect = batch.TotalWeight
+	} else {
+		s.movies = append(s.movies, batch.Data...)
+		s.moviesReceived += batch.Weight
+	}
+	s.indexMovies()
+}
+
+// indexMovies builds the index once the movies are complete, the EOF may arrive before the last batches.
+// Nothing is joined before, so the movies are only kept in the index from then on
+func (s *JoinerService) indexMovies() {
+	if s.moviesByID != nil || !s.AllMoviesReceived() {
 		return
 	}
-	s.movies = append(s.movies, batch.Data...)
-	s.moviesReceived += batch.Weight
+	s.moviesByID = make(map[string][]common.Movie, len(s.movies))
+	for _, m := range s.movies {
+		s.moviesByID[m.ID] = append(s.moviesByID[m.ID], m)
+	}
+	s.movies = nil
 }
 
+// GetMovies returns every movie received, indexed or not
 func (s *JoinerService) GetMovies() []common.Movie {
-	return s.movies
+	if s.moviesByID == nil {
+		return s.movies
+	}
+	movies := make([]common.Movie, 0, len(s.moviesByID))
+	for _, byID := range s.moviesByID {
+		movies = append(movies, byID...)
+	}
+	return movies
+}
+
+func (s *JoinerService) MovieIDs() []string {
+	ids := make([]string, 0, len(s.moviesByID))
+	for id := range s.moviesByID {
+		ids = append(ids, id)
+	}
+	return ids
 }
 
 func (s *JoinerService) AllMoviesReceived() bool {
@@ -88,10 +119,7 @@ func (s *JoinerService) Join(reviews []common.Review) []common.MovieReview {
 }
 
 func (s *JoinerService) joinReview(r common.Review) []common.MovieReview {
-
-	movies := s.GetMovies()
-	moviesForReview := common.Filter(movies, func(m common.Movie) bool { return m.ID == r.MovieID })
-	reviewXMovies := common.Map(moviesForReview, func(m common.Movie) common.MovieReview {
+	reviewXMovies := common.Map(s.moviesByID[r.MovieID], func(m common.Movie) common.MovieReview {
 		return common.MovieReview{
 			MovieID: m.ID,
 			Title:   m.Title,
@@ -102,14 +130,9 @@ func (s *JoinerService) joinReview(r common.Review) []common.MovieReview {
 }
 
 func (s *JoinerService) filterCredits(data []common.Credit) []common.Credit {
-	movies := s.GetMovies()
-	movieIds := common.Map(movies, func(m common.Movie) string { return m.ID })
-	ids := make(map[string]bool)
-	for _, id := range movieIds {
-		ids[id] = true
-	}
 	actors := common.Filter(data, func(c common.Credit) bool {
-		return ids[c.MovieId]
+		_, ok := s.moviesByID[c.MovieId]
+		return ok
 	})
 	return actors
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"tp-sistemas-distribuidos/server/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJoinerServiceJoinsThroughTheIndexBuiltAtTheEnd(t *testing.T) {
+	session := NewJoinerService()
+	header := common.Header{ClientID: "client", Weight: 2}
+	// The EOF overtakes the last batch, the index waits for it
+	session.SaveMovies(common.Batch[common.Movie]{Header: header, Data: []common.Movie{{ID: "1", Title: "Nueve reinas"}, {ID: "2", Title: "Relatos salvajes"}}})
+	session.SaveMovies(common.Batch[common.Movie]{Header: common.Header{ClientID: "client", TotalWeight: 3}})
+	require.Nil(t, session.moviesByID)
+
+	session.SaveMovies(common.Batch[common.Movie]{Header: common.Header{ClientID: "client", Weight: 1}, Data: []common.Movie{{ID: "3", Title: "El secreto de sus ojos"}}})
+	require.True(t, session.AllMoviesReceived())
+	require.Len(t, session.moviesByID, 3)
+	require.Nil(t, session.movies)
+	require.ElementsMatch(t, []string{"1", "2", "3"}, session.MovieIDs())
+
+	joined := session.Join([]common.Review{{ID: "u1", MovieID: "3", Rating: 4}, {ID: "u2", MovieID: "4", Rating: 1}})
+	require.Equal(t, []common.MovieReview{{MovieID: "3", Title: "El secreto de sus ojos", Rating: 4}}, joined)
+
+	credits := session.filterCredits([]common.Credit{{MovieId: "1"}, {MovieId: "4"}, {MovieId: "2"}})
+	require.Equal(t, []common.Credit{{MovieId: "1"}, {MovieId: "2"}}, credits)
+}
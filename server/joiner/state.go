@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"tp-sistemas-distribuidos/server/common"
+)
+
+const (
+	moviesRecord    = "movies"
+	reviewsRecord   = "reviews"
+	creditsRecord   = "credits"
+	expiredRecord   = "expired"
+	cancelledRecord = "cancelled"
+)
+
+// walRecord is a batch received by the joiner, logged before it is applied, or the id of a client
+// whose session expired or was cancelled
+type walRecord struct {
+	Kind string          `json:"kind"`
+	Body json.RawMessage `json:"body"`
+}
+
+type sessionState struct {
+	ClientID        string         `json:"client_id"`
+	Movies          []common.Movie `json:"movies"`
+	MoviesReceived  uint32         `json:"movies_received"`
+	ReviewsReceived uint32         `json:"reviews_received"`
+	CreditsReceived uint32         `json:"credits_received"`
+	MoviesToExpect  int32          `json:"movies_to_expect"`
+	ReviewsToExpect int32          `json:"reviews_to_expect"`
+	CreditsToExpect int32          `json:"credits_to_expect"`
+}
+
+type joinerState struct {
+	Sessions     []sessionState    `json:"sessions"`
+	Pending      pendingState      `json:"pending"`
+	MoviesDedup  common.DedupState `json:"movies_dedup"`
+	ReviewsDedup common.DedupState `json:"reviews_dedup"`
+	CreditsDedup common.DedupState `json:"credits_dedup"`
+}
+
+func (j *JoinerController) logRecord(record walRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error marshalling wal record: %w", err)
+	}
+	return j.wal.Append(data)
+}
+
+// recover reloads the movie tables and the pending batches from the last snapshot and replays the batches logged after it
+func (j *JoinerController) recover() error {
+	snapshot, records, err := j.wal.Recover()
+	if err != nil {
+		return err
+	}
+	if snapshot != nil {
+		if err := j.restore(snapshot); err != nil {
+			return fmt.Errorf("error restoring snapshot: %w", err)
+		}
+	} else if err := j.pending.Restore(pendingState{}); err != nil {
+		return err
+	}
+
+	for _, data := range records {
+		var record walRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("error unmarshalling wal record: %w", err)
+		}
+		if err := j.apply(record.Kind, record.Body); errors.Is(err, errSpill) {
+			return err
+		} else if err != nil {
+			slog.Error("error replaying batch", slog.String("kind", record.Kind), slog.String("error", err.Error()))
+		}
+	}
+
+	// The idle time before a restart is not known, recovered sessions get a whole ttl
+	for clientId := range j.sessions {
+		j.expiry.Touch(clientId)
+	}
+
+	slog.Info("state recovered", slog.Int("sessions", len(j.sessions)), slog.Int("replayed records", len(records)))
+	return nil
+}
+
+func (j *JoinerController) maybeSnapshot() error {
+	if j.wal.Entries() < j.snapshotEvery {
+		return nil
+	}
+
+	pending, err := j.pending.State()
+	if err != nil {
+		return err
+	}
+	state := joinerState{
+		Sessions:     make([]sessionState, 0, len(j.sessions)),
+		Pending:      pending,
+		MoviesDedup:  j.moviesDedup.State(),
+		ReviewsDedup: j.reviewsDedup.State(),
+		CreditsDedup: j.creditsDedup.State(),
+	}
+	for clientID, session := range j.sessions {
+		state.Sessions = append(state.Sessions, sessionState{
+			ClientID:        clientID,
+			Movies:          session.GetMovies(),
+			MoviesReceived:  session.moviesReceived,
+			ReviewsReceived: session.reviewsReceived,
+			CreditsReceived: session.creditsReceived,
+			MoviesToExpect:  session.moviesToExpect,
+			ReviewsToExpect: session.reviewsToExpect,
+			CreditsToExpect: session.creditsToExpect,
+		})
+	}
+
+	snapshot, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error marshalling snapshot: %w", err)
+	}
+	if err := j.wal.Snapshot(snapshot); err != nil {
+		return err
+	}
+	if err := j.pending.Prune(); err != nil {
+		return err
+	}
+	slog.Debug("snapshot taken", slog.Int("sessions", len(state.Sessions)))
+	return nil
+}
+
+func (j *JoinerController) restore(snapshot []byte) error {
+	var state joinerState
+	if err := json.Unmarshal(snapshot, &state); err != nil {
+		return err
+	}
+
+	for _, saved := range state.Sessions {
+		session := NewJoinerService()
+		session.movies = saved.Movies
+		session.moviesReceived = saved.MoviesReceived
+		session.reviewsReceived = saved.ReviewsReceived
+		session.creditsReceived = saved.CreditsReceived
+		session.moviesToExpect = saved.MoviesToExpect
+		session.reviewsToExpect = saved.ReviewsToExpect
+		session.creditsToExpect = saved.CreditsToExpect
+		session.indexMovies()
+		j.sessions[saved.ClientID] = session
+	}
+	if err := j.pending.Restore(state.Pending); err != nil {
+		return err
+	}
+	j.moviesDedup.Restore(state.MoviesDedup)
+	j.reviewsDedup.Restore(state.ReviewsDedup)
+	j.creditsDedup.Restore(state.CreditsDedup)
+	return nil
+}
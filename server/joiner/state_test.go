@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tp-sistemas-distribuidos/server/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestJoiner(t *testing.T, dir string) (*JoinerController, chan []byte) {
+	wal, err := common.OpenWAL(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = wal.Close() })
+
+	pending, err := NewPendingBuffer(filepath.Join(dir, "pending"), 1)
+	require.NoError(t, err)
+	t.Cleanup(pending.Close)
+
+	q3ToReduce := make(chan []byte, 10)
+	return &JoinerController{
+		nodeID:        "joiner-1",
+		sessions:      map[string]*JoinerService{},
+		pending:       pending,
+		moviesDedup:   common.NewDedupFilter(0),
+		reviewsDedup:  common.NewDedupFilter(0),
+		creditsDedup:  common.NewDedupFilter(0),
+		q3ToReduce:    q3ToReduce,
+		q4ToReduce:    make(chan []byte, 10),
+		filters:       make(chan []byte, 10),
+		wal:           wal,
+		snapshotEvery: 2,
+		expiry:        common.NewSessionExpiry(time.Minute),
+	}, q3ToReduce
+}
+
+func logAndApply(t *testing.T, j *JoinerController, kind string, batch any) {
+	body, err := json.Marshal(batch)
+	require.NoError(t, err)
+	require.NoError(t, j.logRecord(walRecord{Kind: kind, Body: body}))
+	require.NoError(t, j.apply(kind, body))
+	require.NoError(t, j.maybeSnapshot())
+}
+
+func TestJoinerResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	joiner, _ := newTestJoiner(t, dir)
+
+	header := common.Header{ClientID: "client", ProducerID: "gateway", Weight: 1, Seq: 1}
+	logAndApply(t, joiner, moviesRecord, common.Batch[common.Movie]{Header: header, Data: []common.Movie{{ID: "1", Title: "Nueve reinas"}}})
+	eof := common.Header{ClientID: "client", ProducerID: "gateway", TotalWeight: 1, Seq: 2}
+	logAndApply(t, joiner, moviesRecord, common.Batch[common.Movie]{Header: eof})
+
+	// Only the snapshot is left, the reviews are joined by the restarted joiner
+	require.Equal(t, 0, joiner.wal.Entries())
+	restarted, q3ToReduce := newTestJoiner(t, dir)
+	require.NoError(t, restarted.recover())
+	require.True(t, restarted.sessions["client"].AllMoviesReceived())
+
+	review := common.Batch[common.Review]{Header: header, Data: []common.Review{{ID: "u1", MovieID: "1", Rating: 5}}}
+	body, err := json.Marshal(review)
+	require.NoError(t, err)
+	require.NoError(t, restarted.apply(reviewsRecord, body))
+
+	var joined common.Batch[common.MovieReview]
+	require.NoError(t, json.Unmarshal(<-q3ToReduce, &joined))
+	require.Equal(t, "joiner-1", joined.ProducerID)
+	require.Equal(t, []common.MovieReview{{MovieID: "1", Title: "Nueve reinas", Rating: 5}}, joined.Data)
+}
+
+type crash struct{ point string }
+
+func TestJoinerRecoversMoviesAfterCrashingOnSave(t *testing.T) {
+	common.OnCrash(func(point string) { panic(crash{point}) })
+	require.NoError(t, common.ArmCrashPoints([]string{crashAfterSaveMovies}))
+	t.Cleanup(func() { _ = common.ArmCrashPoints(nil) })
+
+	dir := t.TempDir()
+	joiner, _ := newTestJoiner(t, dir)
+	header := common.Header{ClientID: "client", ProducerID: "gateway", Weight: 1, Seq: 1}
+	require.PanicsWithValue(t, crash{crashAfterSaveMovies}, func() {
+		logAndApply(t, joiner, moviesRecord, common.Batch[common.Movie]{Header: header, Data: []common.Movie{{ID: "1", Title: "Nueve reinas"}}})
+	})
+
+	restarted, _ := newTestJoiner(t, dir)
+	require.NoError(t, restarted.recover())
+	require.Equal(t, []common.Movie{{ID: "1", Title: "Nueve reinas"}}, restarted.sessions["client"].GetMovies())
+}
+
+func TestJoinerExpiredSessionStaysEvictedAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	joiner, _ := newTestJoiner(t, dir)
+	joiner.expiry = common.NewSessionExpiry(time.Millisecond)
+	joiner.snapshotEvery = 100 // the restart replays the eviction from the wal
+
+	header := common.Header{ClientID: "client", ProducerID: "gateway", Weight: 1, Seq: 1}
+	logAndApply(t, joiner, reviewsRecord, common.Batch[common.Review]{Header: header, Data: []common.Review{{ID: "u1", MovieID: "1", Rating: 5}}})
+	require.Equal(t, 1, joiner.pending.Len("client"))
+
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, joiner.expireSessions())
+	require.Empty(t, joiner.sessions)
+	require.Zero(t, joiner.pending.Len("client"))
+
+	restarted, _ := newTestJoiner(t, dir)
+	require.NoError(t, restarted.recover())
+	require.Empty(t, restarted.sessions)
+	require.Zero(t, restarted.pending.Len("client"))
+}
+
+func TestJoinerKeepsSpilledBatchesUntilTheMoviesOfTheClient(t *testing.T) {
+	dir := t.TempDir()
+	joiner, _ := newTestJoiner(t, dir)
+	joiner.snapshotEvery = 3
+	// Spill files are named after the client, whose id is a uuid
+	client := "3f7b1c2e-9a4d-4e8b-8c1f-2d6a5e9b0c47"
+
+	// The first batch stays in memory, the other ones spill. The restart replays the last one from the wal
+	header := func(seq uint64) common.Header {
+		return common.Header{ClientID: client, ProducerID: "gateway", Weight: 1, Seq: seq}
+	}
+	logAndApply(t, joiner, reviewsRecord, common.Batch[common.Review]{Header: header(1), Data: []common.Review{{ID: "u1", MovieID: "1", Rating: 5}}})
+	logAndApply(t, joiner, reviewsRecord, common.Batch[common.Review]{Header: header(2), Data: []common.Review{{ID: "u2", MovieID: "2", Rating: 3}}})
+	logAndApply(t, joiner, creditsRecord, common.Batch[common.Credit]{Header: header(1), Data: []common.Credit{{MovieId: "1"}, {MovieId: "2"}}})
+	logAndApply(t, joiner, reviewsRecord, common.Batch[common.Review]{Header: header(3), Data: []common.Review{{ID: "u3", MovieID: "1", Rating: 4}}})
+	require.Equal(t, 4, joiner.pending.Len(client))
+
+	restarted, q3ToReduce := newTestJoiner(t, dir)
+	require.NoError(t, restarted.recover())
+	require.Equal(t, 4, restarted.pending.Len(client))
+	q4ToReduce := make(chan []byte, 10)
+	restarted.q4ToReduce = q4ToReduce
+
+	logAndApply(t, restarted, moviesRecord, common.Batch[common.Movie]{Header: header(1), Data: []common.Movie{{ID: "1", Title: "Nueve reinas"}}})
+	logAndApply(t, restarted, moviesRecord, common.Batch[common.Movie]{Header: common.Header{ClientID: client, ProducerID: "gateway", TotalWeight: 1, Seq: 2}})
+	require.Zero(t, restarted.pending.Len(client))
+
+	var ratings []float64
+	for range 3 {
+		var joined common.Batch[common.MovieReview]
+		require.NoError(t, json.Unmarshal(<-q3ToReduce, &joined))
+		for _, review := range joined.Data {
+			ratings = append(ratings, review.Rating)
+		}
+	}
+	require.ElementsMatch(t, []float64{5, 4}, ratings)
+
+	var actors common.Batch[common.Credit]
+	require.NoError(t, json.Unmarshal(<-q4ToReduce, &actors))
+	require.Equal(t, []common.Credit{{MovieId: "1"}}, actors.Data)
+}
+
+func TestPendingBufferSpillsOnlyUuidClients(t *testing.T) {
+	pending, err := NewPendingBuffer(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer pending.Close()
+
+	require.Error(t, pending.Add("../outside", pendingBatch{Kind: reviewsRecord, Body: []byte(`{}`)}))
+	require.NoError(t, pending.Add("3f7b1c2e-9a4d-4e8b-8c1f-2d6a5e9b0c47", pendingBatch{Kind: reviewsRecord, Body: []byte(`{}`)}))
+}
+
+func TestJoinerEvictsLeftoversOnceItsShardIsRetired(t *testing.T) {
+	dir := t.TempDir()
+	joiner, _ := newTestJoiner(t, dir)
+	joiner.joinerId = 2
+	joiner.snapshotEvery = 100 // the restart replays the eviction from the wal
+
+	header := common.Header{ClientID: "client", ProducerID: "gateway", Weight: 1, Seq: 1}
+	logAndApply(t, joiner, moviesRecord, common.Batch[common.Movie]{Header: header, Data: []common.Movie{{ID: "1", Title: "Nueve reinas"}}})
+
+	retired := func(shards ...int) common.Message {
+		body, err := json.Marshal(common.ControlMsg{Kind: common.ShardRetired, Shards: shards})
+		require.NoError(t, err)
+		return common.Message{Body: body}
+	}
+	require.NoError(t, joiner.handleControl(retired(3)))
+	require.Contains(t, joiner.sessions, "client")
+
+	require.NoError(t, joiner.handleControl(retired(2)))
+	require.Empty(t, joiner.sessions)
+
+	restarted, _ := newTestJoiner(t, dir)
+	require.NoError(t, restarted.recover())
+	require.Empty(t, restarted.sessions)
+}
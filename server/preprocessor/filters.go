@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+	"tp-sistemas-distribuidos/server/common"
+)
+
+// joinFilters keeps the movies each joiner shard holds for a client, once it has all of them. Reviews
+// and credits of other movies can not join, so they are not sent. Shards without a filter get everything
+type joinFilters struct {
+	mu      sync.Mutex
+	filters map[string]map[int]*common.BloomFilter
+	expiry  *common.SessionExpiry
+}
+
+func newJoinFilters(ttl time.Duration) *joinFilters {
+	return &joinFilters{
+		filters: make(map[string]map[int]*common.BloomFilter),
+		expiry:  common.NewSessionExpiry(ttl),
+	}
+}
+
+func (f *joinFilters) Set(filter common.JoinFilter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.filters[filter.ClientID] == nil {
+		f.filters[filter.ClientID] = make(map[int]*common.BloomFilter)
+	}
+	f.filters[filter.ClientID][filter.Shard] = filter.Movies
+	f.expiry.Touch(filter.ClientID)
+}
+
+// Clear drops the filter of the shard for the client, once the shard finished it
+func (f *joinFilters) Clear(clientID string, shard int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.filters[clientID], shard)
+	if len(f.filters[clientID]) == 0 {
+		f.drop(clientID)
+	}
+}
+
+// Drop forgets every filter of the client
+func (f *joinFilters) Drop(clientID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.drop(clientID)
+}
+
+func (f *joinFilters) drop(clientID string) {
+	delete(f.filters, clientID)
+	f.expiry.Forget(clientID)
+}
+
+// Keep reports whether the item with the key can join in the shard
+func (f *joinFilters) Keep(clientID string, shard int, key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	filter, ok := f.filters[clientID][shard]
+	if !ok {
+		return true
+	}
+	f.expiry.Touch(clientID)
+	return filter.MayContain(key)
+}
+
+// Expire forgets the filters of the clients that sent nothing for longer than the ttl
+func (f *joinFilters) Expire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, clientID := range f.expiry.Expired() {
+		f.drop(clientID)
+	}
+}
@@ -3,9 +3,8 @@ package main
 import (
 	"fmt"
 	"log/slog"
-	"os"
+	"pkg/config"
 	"pkg/log"
-	"strconv"
 )
 
 func main() {
@@ -16,19 +15,16 @@ func main() {
 	}
 	slog.SetDefault(logger)
 
-	rabbitUser := os.Getenv("RABBITMQ_DEFAULT_USER")
-	rabbitPass := os.Getenv("RABBITMQ_DEFAULT_PASS")
-	joinerShards := os.Getenv("JOINER_SHARDS")
-	if rabbitUser == "" || rabbitPass == "" {
-		slog.Error("environment validation failed", slog.String("error", "RABBITMQ_DEFAULT_USER and RABBITMQ_DEFAULT_PASS must be set"))
+	var cfg PreprocessorConfig
+	if err := config.Load(&cfg); err != nil {
+		slog.Error("configuration validation failed", slog.String("error", err.Error()))
 		return
 	}
+	config.Log(cfg)
 
-	shards, err := strconv.Atoi(joinerShards)
-	if err != nil {
-		slog.Error("error converting JOINER_SHARDS env var to int", slog.String("error", err.Error()))
+	preprocessor := NewPreprocessor(cfg)
+	if preprocessor == nil {
+		return
 	}
-
-	preprocessor := NewPreprocessor(rabbitUser, rabbitPass, shards)
 	preprocessor.Start()
 }
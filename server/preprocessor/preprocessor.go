@@ -6,13 +6,14 @@ import (
 	"fmt"
 	"log/slog"
 	"os/signal"
+	"pkg/config"
 	"pkg/models"
 	"syscall"
+	"time"
 	"tp-sistemas-distribuidos/server/common"
 )
 
 const (
-	rabbitHost      = "rabbitmq"
 	toPreProcess    = "to-preprocess"
 	filterMoviesQ1  = "filter-year-q1"
 	filterMoviesQ2  = "filter-production-q2"
@@ -25,32 +26,32 @@ const (
 )
 
 type PreprocessorConfig struct {
-	RabbitUser string
-	RabbitPass string
+	config.Node
+	config.Pool
+	config.Sessions
+	// Joiner shards of the sessions whose batches do not carry their own ring
+	JoinerShards int `env:"JOINER_SHARDS" json:"joiner_shards" required:"true" min:"1"`
 }
 
 type Preprocessor struct {
 	config           PreprocessorConfig
 	middleware       *common.Middleware
+	health           *common.HealthServer
+	pool             *common.WorkerPool
 	toProcessChan    <-chan common.Message
-	shards           int
-	reviewsChans     map[int]chan<- []byte
-	creditsChans     map[int]chan<- []byte
+	reviews          *common.ShardRouter
+	credits          *common.ShardRouter
+	filters          *joinFilters
+	filtersChan      <-chan common.Message
+	controlChan      <-chan common.Message
 	moviesChans      []chan<- []byte
 	pesoTotalQuePaso int
 }
 
-func NewPreprocessor(rabbitUser string, rabbitPass string, shards int) *Preprocessor {
-	config := PreprocessorConfig{
-		RabbitUser: rabbitUser,
-		RabbitPass: rabbitPass,
-	}
-
+func NewPreprocessor(cfg PreprocessorConfig) *Preprocessor {
 	Preprocessor := &Preprocessor{
-		config:       config,
-		reviewsChans: map[int]chan<- []byte{},
-		creditsChans: map[int]chan<- []byte{},
-		shards:       shards,
+		config:  cfg,
+		filters: newJoinFilters(cfg.SessionTTL),
 	}
 
 	err := Preprocessor.middlewareSetup()
@@ -65,23 +66,14 @@ func NewPreprocessor(rabbitUser string, rabbitPass string, shards int) *Preproce
 
 func (p *Preprocessor) middlewareSetup() error {
 	// Setup middleware connection
-	middleware, err := common.NewMiddleware(p.config.RabbitUser, p.config.RabbitPass, rabbitHost)
+	middleware, err := common.NewMiddleware(p.config.Node)
 	if err != nil {
 		return fmt.Errorf("error creating middleware: %s", err)
 	}
 
-	for i := range p.shards {
-		shard := i + 1
-		slog.Info("Creating channel to send reviews", slog.Int("shard", shard))
-		p.reviewsChans[shard], err = middleware.GetChanWithTopicToSend(reviewsExchange, fmt.Sprintf(reviewsTopic, shard))
-		if err != nil {
-			return fmt.Errorf("error getting channel to send reviews: %s", err)
-		}
-		p.creditsChans[shard], err = middleware.GetChanWithTopicToSend(creditsExchange, fmt.Sprintf(creditsTopic, shard))
-		if err != nil {
-			return fmt.Errorf("error getting channel to send credits: %s", err)
-		}
-	}
+	shards := common.DefaultShards(p.config.JoinerShards)
+	p.reviews = common.NewShardRouter(middleware, reviewsExchange, reviewsTopic, shards)
+	p.credits = common.NewShardRouter(middleware, creditsExchange, creditsTopic, shards)
 
 	moviesChans := make([]chan<- []byte, 0, 4) // optional capacity hint
 	queues := []string{
@@ -104,7 +96,21 @@ func (p *Preprocessor) middlewareSetup() error {
 		return fmt.Errorf("error getting channel to receive: %s", err)
 	}
 
+	filtersChan, err := middleware.GetBroadcastChanToRecv(common.JoinFiltersExchange, p.config.ID())
+	if err != nil {
+		return fmt.Errorf("error getting channel to receive join filters: %s", err)
+	}
+	p.filtersChan = filtersChan
+
+	controlChan, err := middleware.GetBroadcastChanToRecv(common.ControlExchange, p.config.ID())
+	if err != nil {
+		return fmt.Errorf("error getting channel to receive control messages: %s", err)
+	}
+	p.controlChan = controlChan
+
 	p.middleware = middleware
+	p.health = common.NewHealthServer(p.config.Node, middleware)
+	p.pool = common.NewWorkerPoolWithOrder(p.config.Workers, p.config.PerClientOrder, clientIDOfRawBatch)
 	p.toProcessChan = toProcess
 	p.moviesChans = moviesChans
 
@@ -112,6 +118,9 @@ func (p *Preprocessor) middlewareSetup() error {
 }
 
 func (p *Preprocessor) close() {
+	if err := p.health.Close(); err != nil {
+		slog.Error("error closing health server", slog.String("error", err.Error()))
+	}
 	if err := p.middleware.Close(); err != nil {
 		slog.Error("error closing middleware", slog.String("error", err.Error()))
 	}
@@ -123,49 +132,120 @@ func (p *Preprocessor) Start() {
 	// Sigterm , sigint
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
-	p.processMessages(ctx)
+
+	p.health.Start()
+	p.health.SetReady(true)
+
+	drainer := common.NewDrainer(ctx, p.middleware, p.config.DrainTimeout)
+	p.processMessages(drainer)
+	drainer.Finish()
 }
 
-func (p *Preprocessor) processMessages(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			slog.Info("Received shutdown signal, stopping...")
-			return
-		case msg := <-p.toProcessChan:
+func (p *Preprocessor) processMessages(drainer *common.Drainer) {
+	ticker := time.NewTicker(common.HealthTickInterval)
+	defer ticker.Stop()
+	sweeper := time.NewTicker(p.config.SweepInterval)
+	defer sweeper.Stop()
+	done := p.pool.RunAll(common.Consumer{
+		Inbox: p.toProcessChan,
+		Handle: func(msg common.Message) error {
 			var batch common.ToProcessMsg
-
 			if err := json.Unmarshal(msg.Body, &batch); err != nil {
-				slog.Error("error unmarshalling message", slog.String("error", err.Error()))
-				return
+				return fmt.Errorf("%w: error unmarshalling message: %w", common.ErrUnprocessable, err)
 			}
 
 			if err := p.preprocessBatch(batch); err != nil {
-				slog.Error("error preprocessing batch", slog.String("error", err.Error()))
-				return
+				return fmt.Errorf("error preprocessing batch: %w", err)
 			}
-
-			if err := msg.Ack(); err != nil {
-				slog.Error("error acknowledging message", slog.String("error", err.Error()))
-				return
+			return nil
+		},
+	})
+	for {
+		select {
+		case <-drainer.Signal():
+			slog.Info("Received shutdown signal, draining...")
+			p.health.SetReady(false)
+			drainer.Start()
+		case <-drainer.Expired():
+			slog.Warn("Drain timeout expired, stopping...")
+			return
+		case <-ticker.C:
+			p.health.Tick()
+		case <-sweeper.C:
+			p.filters.Expire()
+		case msg, ok := <-p.filtersChan:
+			if !ok {
+				p.filtersChan = nil
+				continue
+			}
+			p.handleFilter(msg)
+		case msg, ok := <-p.controlChan:
+			if !ok {
+				p.controlChan = nil
+				continue
 			}
+			p.handleControl(msg)
+		case <-done:
+			slog.Info("Preprocessor drained")
+			return
 		}
 	}
 }
 
+func (p *Preprocessor) handleFilter(msg common.Message) {
+	var filter common.JoinFilter
+	err := json.Unmarshal(msg.Body, &filter)
+	switch {
+	case err != nil || (filter.Movies == nil && !filter.Done):
+		slog.Error("dropping malformed join filter")
+	case filter.Done:
+		p.filters.Clear(filter.ClientID, filter.Shard)
+		slog.Debug("join filter cleared", slog.String("clientId", filter.ClientID), slog.Int("shard", filter.Shard))
+	default:
+		p.filters.Set(filter)
+		slog.Debug("join filter received", slog.String("clientId", filter.ClientID), slog.Int("shard", filter.Shard))
+	}
+	if err := msg.Ack(); err != nil {
+		slog.Error("error acknowledging message", slog.String("error", err.Error()))
+	}
+}
+
+// handleControl drops the filters of a cancelled session, no more batches of it are sent
+func (p *Preprocessor) handleControl(msg common.Message) {
+	control, err := common.DecodeControlMsg(msg.Body)
+	if err != nil {
+		slog.Error("dropping control message", slog.String("error", err.Error()))
+	} else if control.Kind == common.CancelSession {
+		p.filters.Drop(control.ClientID)
+		slog.Debug("join filters dropped", slog.String("clientId", control.ClientID))
+	}
+	if err := msg.Ack(); err != nil {
+		slog.Error("error acknowledging message", slog.String("error", err.Error()))
+	}
+}
+
+// clientIDOfRawBatch extracts the client id of a message sent by the gateway
+func clientIDOfRawBatch(msg common.Message) string {
+	var batch common.ToProcessMsg
+	if err := json.Unmarshal(msg.Body, &batch); err != nil {
+		return ""
+	}
+	return batch.ClientId
+}
+
 func (p *Preprocessor) preprocessBatch(msg common.ToProcessMsg) error {
 	switch msg.Type {
 	case "movies":
 		var mb models.RawBatch[models.RawMovie]
 		if err := json.Unmarshal(msg.Body, &mb); err != nil {
-			return fmt.Errorf("movies unmarshal: %w", err)
+			return fmt.Errorf("%w: movies unmarshal: %w", common.ErrUnprocessable, err)
 		}
 
 		var payload any
 		if mb.IsEof() {
-			payload = makeEOFBatch[common.Movie](mb.Header.TotalWeight, msg.ClientId)
+			payload = withOrigin(makeEOFBatch[common.Movie](mb.Header.TotalWeight, msg.ClientId), msg)
 		} else {
-			payload = preprocessMovies(mb, msg.ClientId)
+			payload = withOrigin(preprocessMovies(mb, msg.ClientId), msg)
 		}
 
 		data, err := json.Marshal(payload)
@@ -181,16 +261,11 @@ func (p *Preprocessor) preprocessBatch(msg common.ToProcessMsg) error {
 	case "reviews":
 		var rb models.RawBatch[models.RawReview]
 		if err := json.Unmarshal(msg.Body, &rb); err != nil {
-			return fmt.Errorf("reviews unmarshal: %w", err)
+			return fmt.Errorf("%w: reviews unmarshal: %w", common.ErrUnprocessable, err)
 		}
 
-		batch := preprocessReviews(rb, msg.ClientId)
-		if err := sendBatchMap(
-			batch,
-			p.shards,
-			p.reviewsChans,
-			func(r common.Review) string { return r.MovieID },
-		); err != nil {
+		batch := withOrigin(preprocessReviews(rb, msg.ClientId), msg)
+		if err := sendBatchMap(batch, p.reviews, p.filters, func(r common.Review) string { return r.MovieID }); err != nil {
 			return fmt.Errorf("sending reviews: %w", err)
 		}
 		slog.Debug("preprocessing reviews", slog.Int("size", int(rb.Header.Weight)))
@@ -198,27 +273,32 @@ func (p *Preprocessor) preprocessBatch(msg common.ToProcessMsg) error {
 	case "credits":
 		var cb models.RawBatch[models.RawCredits]
 		if err := json.Unmarshal(msg.Body, &cb); err != nil {
-			return fmt.Errorf("credits unmarshal: %w", err)
+			return fmt.Errorf("%w: credits unmarshal: %w", common.ErrUnprocessable, err)
 		}
 
-		batch := preprocessCredits(cb, msg.ClientId)
-		if err := sendBatchMap(
-			batch,
-			p.shards,
-			p.creditsChans,
-			func(c common.Credit) string { return c.MovieId },
-		); err != nil {
+		batch := withOrigin(preprocessCredits(cb, msg.ClientId), msg)
+		if err := sendBatchMap(batch, p.credits, p.filters, func(c common.Credit) string { return c.MovieId }); err != nil {
 			return fmt.Errorf("sending credits: %w", err)
 		}
 		slog.Debug("preprocessing credits", slog.Int("size", int(cb.Header.Weight)))
 
 	default:
-		return fmt.Errorf("unknown batch type %q", msg.Type)
+		return fmt.Errorf("%w: unknown batch type %q", common.ErrUnprocessable, msg.Type)
 	}
 
 	return nil
 }
 
+// withOrigin keeps the producer and sequence number the gateway gave to the batch, the gateway that
+// gets the results of the client and the joiner shards of its session
+func withOrigin[T any](batch common.Batch[T], msg common.ToProcessMsg) common.Batch[T] {
+	batch.ProducerID = msg.Producer
+	batch.Seq = msg.Seq
+	batch.GatewayID = msg.Gateway
+	batch.Shards = msg.Shards
+	return batch
+}
+
 func makeEOFBatch[T any](totalWeight int32, id string) common.Batch[T] {
 	return common.Batch[T]{
 		Header: common.Header{
@@ -241,49 +321,58 @@ func makeBatchMsg[T any](weight uint32, data []T, totalWeight int32, clientID st
 	}
 }
 
-func divideBatchInShards[T any](batch common.Batch[T], shards int, getKey func(T) string) []common.Batch[T] {
-	bucketShards := make([]common.Batch[T], shards)
-	for i := 0; i < shards; i++ {
-		bucketShards[i] = common.Batch[T]{
-			Header: batch.Header,
-			Data: common.Filter(batch.Data, func(item T) bool {
-				shardID := common.GetShard(getKey(item), shards)
-				return shardID == i+1
-			}),
+// divideBatchInShards spreads the items over the shards of the ring, dropping the ones the filter of
+// their shard knows can not join
+func divideBatchInShards[T any](batch common.Batch[T], ring *common.Ring, filters *joinFilters, getKey func(T) string) map[int]common.Batch[T] {
+	bucketShards := make(map[int]common.Batch[T], len(ring.Shards()))
+	for _, shard := range ring.Shards() {
+		bucketShards[shard] = common.Batch[T]{Header: batch.Header}
+	}
+	for _, item := range batch.Data {
+		key := getKey(item)
+		shard := ring.Shard(key)
+		if !filters.Keep(batch.ClientID, shard, key) {
+			continue
 		}
+		bucket := bucketShards[shard]
+		bucket.Data = append(bucket.Data, item)
+		bucketShards[shard] = bucket
 	}
 	return bucketShards
 }
 
-// sendBatchMap marshals either an EOF batch or normal sharded batches and sends them
-// to chans[1]...chans[shards]. Assumes map keys 1..shards exist.
-func sendBatchMap[T any](batch common.Batch[T], shards int, chans map[int]chan<- []byte, getKey func(T) string) error {
+// sendBatchMap marshals either an EOF batch or normal sharded batches and sends them to every shard
+// of the ring of the session. Every shard counts the weight of every batch to know when it has all of
+// them, so it gets the batch even with every item filtered out. A batch without items nor weight is
+// not sent at all
+func sendBatchMap[T any](batch common.Batch[T], router *common.ShardRouter, filters *joinFilters, getKey func(T) string) error {
+	if !batch.IsEof() && len(batch.Data) == 0 && batch.Weight == 0 {
+		return nil
+	}
+	ring := router.Ring(batch.Shards)
 	if batch.IsEof() {
+		// Every shard forwards its own EOF marker, the ones downstream wait for all of them
+		batch.Header = batch.Header.WithProducers(len(ring.Shards()))
 		data, err := json.Marshal(batch)
 		if err != nil {
 			return fmt.Errorf("marshal EOF: %w", err)
 		}
-		for id := 1; id <= shards; id++ {
-			ch, ok := chans[id]
-			if !ok {
-				return fmt.Errorf("missing chan for shard %d", id)
+		for _, shard := range ring.Shards() {
+			if err := router.Send(shard, data); err != nil {
+				return err
 			}
-			ch <- data
 		}
 		return nil
 	}
 
-	shardsBatches := divideBatchInShards(batch, shards, getKey)
-	for id := 1; id <= shards; id++ {
-		data, err := json.Marshal(shardsBatches[id-1])
+	for shard, shardBatch := range divideBatchInShards(batch, ring, filters, getKey) {
+		data, err := json.Marshal(shardBatch)
 		if err != nil {
-			return fmt.Errorf("marshal shard %d: %w", id, err)
+			return fmt.Errorf("marshal shard %d: %w", shard, err)
 		}
-		ch, ok := chans[id]
-		if !ok {
-			return fmt.Errorf("missing chan for shard %d", id)
+		if err := router.Send(shard, data); err != nil {
+			return err
 		}
-		ch <- data
 	}
 	return nil
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+	"tp-sistemas-distribuidos/server/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+// movieOn finds a movie id on the shard that matches the condition
+func movieOn(t *testing.T, ring *common.Ring, shard int, matches func(id string) bool) string {
+	for i := range 1_000_000 {
+		id := fmt.Sprintf("movie-%d", i)
+		if ring.Shard(id) == shard && matches(id) {
+			return id
+		}
+	}
+	t.Fatalf("no movie found on shard %d", shard)
+	return ""
+}
+
+func TestDivideBatchInShardsDropsWhatCanNotJoin(t *testing.T) {
+	ring := common.NewRing([]int{1, 2})
+	var held []string
+	for len(held) < 10 {
+		held = append(held, movieOn(t, ring, 1, func(id string) bool { return !slices.Contains(held, id) }))
+	}
+	movies := common.NewBloomFilter(held)
+	filters := newJoinFilters(time.Minute)
+	filters.Set(common.JoinFilter{ClientID: "client", Shard: 1, Movies: movies})
+
+	// The filter may let through a movie the shard does not hold, never drops one it holds
+	falsePositive := movieOn(t, ring, 1, func(id string) bool { return !slices.Contains(held, id) && movies.MayContain(id) })
+	missing := movieOn(t, ring, 1, func(id string) bool { return !movies.MayContain(id) })
+	unfiltered := movieOn(t, ring, 2, func(string) bool { return true })
+
+	header := common.Header{ClientID: "client", Weight: 4}
+	reviews := []common.Review{{ID: "u1", MovieID: held[0]}, {ID: "u2", MovieID: falsePositive}, {ID: "u3", MovieID: missing}, {ID: "u4", MovieID: unfiltered}}
+	divided := divideBatchInShards(common.Batch[common.Review]{Header: header, Data: reviews}, ring, filters, func(r common.Review) string { return r.MovieID })
+	require.Equal(t, map[int]common.Batch[common.Review]{
+		1: {Header: header, Data: []common.Review{reviews[0], reviews[1]}},
+		2: {Header: header, Data: []common.Review{reviews[3]}},
+	}, divided)
+
+	// Once the shard finished the client nothing is dropped anymore
+	filters.Clear("client", 1)
+	require.True(t, filters.Keep("client", 1, missing))
+}
+
+func TestDivideBatchInShardsSendsTheWeightOfFilteredBatches(t *testing.T) {
+	ring := common.NewRing([]int{1})
+	filters := newJoinFilters(time.Minute)
+	filters.Set(common.JoinFilter{ClientID: "client", Shard: 1, Movies: common.NewBloomFilter(nil)})
+
+	header := common.Header{ClientID: "client", Weight: 1}
+	divided := divideBatchInShards(common.Batch[common.Credit]{Header: header, Data: []common.Credit{{MovieId: "1"}}}, ring, filters, func(c common.Credit) string { return c.MovieId })
+	require.Equal(t, map[int]common.Batch[common.Credit]{1: {Header: header}}, divided)
+}
+
+func TestSendBatchMapSkipsEmptyBatches(t *testing.T) {
+	// An empty batch has nothing to send, the router is not even asked for the ring
+	err := sendBatchMap(common.Batch[common.Review]{Header: common.Header{ClientID: "client"}}, nil, newJoinFilters(time.Minute), func(r common.Review) string { return r.MovieID })
+	require.NoError(t, err)
+}
+
+func TestJoinFiltersOfCancelledClientsAreDropped(t *testing.T) {
+	filters := newJoinFilters(time.Minute)
+	filters.Set(common.JoinFilter{ClientID: "client", Shard: 1, Movies: common.NewBloomFilter(nil)})
+	filters.Set(common.JoinFilter{ClientID: "client", Shard: 2, Movies: common.NewBloomFilter(nil)})
+	require.False(t, filters.Keep("client", 2, "1"))
+
+	filters.Drop("client")
+	require.True(t, filters.Keep("client", 1, "1"))
+	require.True(t, filters.Keep("client", 2, "1"))
+}
@@ -8,17 +8,16 @@ import (
 	"os/signal"
 	"slices"
 	"syscall"
+	"time"
 
 	pkg "pkg/models"
 	"tp-sistemas-distribuidos/server/common"
 )
 
 const (
-	rabbitHost          = "rabbitmq"
 	previousQueueQuery1 = "filter-production-q1"
 	previousQueueQuery2 = "filter-production-q2"
 	previousQueueQuery3 = "filter-production-q3q4"
-	nextQueueQuery1     = "q1-results"
 	nextQueueQuery2     = "q2-to-reduce"
 	topic               = "movies-to-join-%d"
 	moviesExchange      = "movies-exchange"
@@ -26,15 +25,17 @@ const (
 
 type ProductionFilter struct {
 	middleware              *common.Middleware
-	query1Connection        connection
+	health                  *common.HealthServer
+	drainTimeout            time.Duration
+	pool                    *common.WorkerPool
+	query1Connection        resultsConnection
 	query2Connection        connection
 	query3ShardsConnections shardConnection
 }
 
 type shardConnection struct {
 	previousChan <-chan common.Message
-	nextChan     map[int]chan<- []byte
-	shards       int
+	shards       *common.ShardRouter
 }
 
 type connection struct {
@@ -42,28 +43,38 @@ type connection struct {
 	ChanToSend chan<- []byte
 }
 
-func NewProductionFilter(rabbitUser, rabbitPass string, shards int) (*ProductionFilter, error) {
-	middleware, err := common.NewMiddleware(rabbitUser, rabbitPass, rabbitHost)
+// resultsConnection sends the batches straight to the gateway of each client
+type resultsConnection struct {
+	ChanToRecv <-chan common.Message
+	results    *common.ResultsRouter
+}
+
+func NewProductionFilter(cfg ProductionFilterConfig) (*ProductionFilter, error) {
+	middleware, err := common.NewMiddleware(cfg.Node)
 	if err != nil {
 		return nil, fmt.Errorf("error creating middleware: %w", err)
 	}
 
-	query1Connection, err := initializeConnection(middleware, previousQueueQuery1, nextQueueQuery1)
+	query1Chan, err := middleware.GetChanToRecv(previousQueueQuery1)
 	if err != nil {
-		return nil, fmt.Errorf("error initializing query 1 connection: %w", err)
+		return nil, fmt.Errorf("error getting channel %s to receive: %w", previousQueueQuery1, err)
 	}
+	query1Connection := resultsConnection{query1Chan, common.NewResultsRouter(middleware, 1)}
 
 	query2Connection, err := initializeConnection(middleware, previousQueueQuery2, nextQueueQuery2)
 	if err != nil {
 		return nil, fmt.Errorf("error initializing query 2 connection: %w", err)
 	}
 
-	query3ShardsConnections, err := initializeShardsConnections(middleware, previousQueueQuery3, shards)
+	query3ShardsConnections, err := initializeShardsConnections(middleware, previousQueueQuery3, cfg.JoinerShards)
 	if err != nil {
 		return nil, fmt.Errorf("error initializing query 3 shards connections: %w", err)
 	}
 
 	return &ProductionFilter{middleware: middleware,
+		health:                  common.NewHealthServer(cfg.Node, middleware),
+		drainTimeout:            cfg.DrainTimeout,
+		pool:                    common.NewWorkerPoolWithOrder(cfg.Workers, cfg.PerClientOrder, common.ClientIDOf),
 		query1Connection:        query1Connection,
 		query2Connection:        query2Connection,
 		query3ShardsConnections: query3ShardsConnections,
@@ -89,15 +100,8 @@ func initializeShardsConnections(middleware *common.Middleware, previousQueue st
 		return shardConnection{}, fmt.Errorf("error getting channel %s to receive: %w", previousQueue, err)
 	}
 
-	nextChan := make(map[int]chan<- []byte)
-	for i := 1; i <= shards; i++ {
-		nextChan[i], err = middleware.GetChanWithTopicToSend(moviesExchange, fmt.Sprintf(topic, i))
-		if err != nil {
-			return shardConnection{}, fmt.Errorf("error getting channel %s to receive: %w", fmt.Sprintf(topic, i), err)
-		}
-	}
-
-	return shardConnection{previousChan, nextChan, shards}, nil
+	router := common.NewShardRouter(middleware, moviesExchange, topic, common.DefaultShards(shards))
+	return shardConnection{previousChan, router}, nil
 }
 
 func (f *ProductionFilter) Start() {
@@ -107,51 +111,66 @@ func (f *ProductionFilter) Start() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	f.start(ctx)
+	f.health.Start()
+	f.health.SetReady(true)
+
+	drainer := common.NewDrainer(ctx, f.middleware, f.drainTimeout)
+	f.start(drainer)
+	drainer.Finish()
 }
 
-func (f *ProductionFilter) start(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			slog.Info("received termination signal, stopping production filter")
-			return
-		case msg := <-f.query1Connection.ChanToRecv:
-			batch, err := f.processQueryMessage(msg, f.filterByProductionQ1)
-			if err != nil {
-				slog.Error("error processing query message", slog.String("error", err.Error()))
-			} else {
-				if err := f.sendBatch(f.query1Connection.ChanToSend, batch); err != nil {
-					slog.Error("error sending batch", slog.String("error", err.Error()))
+func (f *ProductionFilter) start(drainer *common.Drainer) {
+	ticker := time.NewTicker(common.HealthTickInterval)
+	defer ticker.Stop()
+	done := f.pool.RunAll(
+		common.Consumer{
+			Inbox: f.query1Connection.ChanToRecv,
+			Handle: func(msg common.Message) error {
+				batch, err := f.processQueryMessage(msg, f.filterByProductionQ1)
+				if err != nil {
+					return fmt.Errorf("error processing query message: %w", err)
+				}
+				return f.sendResults(f.query1Connection.results, batch)
+			},
+		},
+		common.Consumer{
+			Inbox: f.query2Connection.ChanToRecv,
+			Handle: func(msg common.Message) error {
+				batch, err := f.processQueryMessage(msg, f.filterByProductionQ2)
+				if err != nil {
+					return fmt.Errorf("error processing query message: %w", err)
 				}
-			}
-			if err := msg.Ack(); err != nil {
-				slog.Error("error acknowledging message", slog.String("error", err.Error()))
-			}
-		case msg := <-f.query2Connection.ChanToRecv:
-			batch, err := f.processQueryMessage(msg, f.filterByProductionQ2)
-			if err != nil {
-				slog.Error("error processing query message", slog.String("error", err.Error()))
-			} else {
-				if err := f.sendBatch(f.query2Connection.ChanToSend, batch); err != nil {
-					slog.Error("error sending batch", slog.String("error", err.Error()))
+				return f.sendBatch(f.query2Connection.ChanToSend, batch)
+			},
+		},
+		common.Consumer{
+			Inbox: f.query3ShardsConnections.previousChan,
+			Handle: func(msg common.Message) error {
+				batch, err := f.processQueryMessage(msg, f.filterByProductionQ3)
+				if err != nil {
+					return fmt.Errorf("error processing query message: %w", err)
 				}
-			}
-			if err := msg.Ack(); err != nil {
-				slog.Error("error acknowledging message", slog.String("error", err.Error()))
-			}
-		case msg := <-f.query3ShardsConnections.previousChan:
-			batch, err := f.processQueryMessage(msg, f.filterByProductionQ3)
-			if err != nil {
-				slog.Error("error processing query message", slog.String("error", err.Error()))
-			} else {
 				if err := f.sendBatchToShards(f.query3ShardsConnections, batch); err != nil {
-					slog.Error("error sending batch to shards", slog.String("error", err.Error()))
+					return fmt.Errorf("error sending batch to shards: %w", err)
 				}
-			}
-			if err := msg.Ack(); err != nil {
-				slog.Error("error acknowledging message", slog.String("error", err.Error()))
-			}
+				return nil
+			},
+		},
+	)
+	for {
+		select {
+		case <-drainer.Signal():
+			slog.Info("received termination signal, draining production filter")
+			f.health.SetReady(false)
+			drainer.Start()
+		case <-drainer.Expired():
+			slog.Warn("drain timeout expired, stopping production filter")
+			return
+		case <-ticker.C:
+			f.health.Tick()
+		case <-done:
+			slog.Info("production filter drained")
+			return
 		}
 	}
 }
@@ -167,7 +186,7 @@ func (f *ProductionFilter) processQueryMessage(msg common.Message, filterFunc fu
 func (f *ProductionFilter) filterMessage(msg common.Message, filterFunc func(common.Movie) bool) (common.Batch[common.Movie], error) {
 	var batch common.Batch[common.Movie]
 	if err := json.Unmarshal(msg.Body, &batch); err != nil {
-		return common.Batch[common.Movie]{}, fmt.Errorf("error unmarshalling message: %w", err)
+		return common.Batch[common.Movie]{}, fmt.Errorf("%w: error unmarshalling message: %w", common.ErrUnprocessable, err)
 	}
 
 	filteredMovies := batch.Data
@@ -189,18 +208,34 @@ func (f *ProductionFilter) sendBatch(chanToSend chan<- []byte, batch common.Batc
 	return nil
 }
 
+func (f *ProductionFilter) sendResults(results *common.ResultsRouter, batch common.Batch[common.Movie]) error {
+	response, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("error marshalling batch: %w", err)
+	}
+	return results.Send(batch.GatewayID, response)
+}
+
+// sendBatchToShards spreads the movies over the joiner shards of the ring of the session
 func (f *ProductionFilter) sendBatchToShards(conn shardConnection, batch common.Batch[common.Movie]) error {
-	movies := make([][]common.Movie, conn.shards)
+	ring := conn.shards.Ring(batch.Shards)
+	movies := make(map[int][]common.Movie, len(ring.Shards()))
 	for _, movie := range batch.Data {
-		shard := common.GetShard(movie.ID, conn.shards)
-		movies[shard-1] = append(movies[shard-1], movie)
+		shard := ring.Shard(movie.ID)
+		movies[shard] = append(movies[shard], movie)
 	}
 
-	for i, moviesData := range movies {
-		shard := i + 1
+	if batch.IsEof() {
+		batch.Header = batch.Header.WithProducers(len(ring.Shards()))
+	}
+	for _, shard := range ring.Shards() {
 		currentBatch := batch
-		currentBatch.Data = moviesData
-		if err := f.sendBatch(conn.nextChan[shard], currentBatch); err != nil {
+		currentBatch.Data = movies[shard]
+		response, err := json.Marshal(currentBatch)
+		if err != nil {
+			return fmt.Errorf("error marshalling batch: %w", err)
+		}
+		if err := conn.shards.Send(shard, response); err != nil {
 			slog.Error("error sending batch", slog.String("error", err.Error()))
 		}
 	}
@@ -223,6 +258,9 @@ func (f *ProductionFilter) filterByProductionQ3(movie common.Movie) bool {
 }
 
 func (f *ProductionFilter) stop() {
+	if err := f.health.Close(); err != nil {
+		slog.Error("error closing health server", slog.String("error", err.Error()))
+	}
 	if err := f.middleware.Close(); err != nil {
 		slog.Error("error closing middleware", slog.String("error", err.Error()))
 	}
@@ -3,11 +3,17 @@ package main
 import (
 	"fmt"
 	"log/slog"
-	"os"
+	"pkg/config"
 	"pkg/log"
-	"strconv"
 )
 
+type ProductionFilterConfig struct {
+	config.Node
+	config.Pool
+	// Joiner shards of the sessions whose batches do not carry their own ring
+	JoinerShards int `env:"JOINER_SHARDS" json:"joiner_shards" required:"true" min:"1"`
+}
+
 func main() {
 	logger, err := log.SetupLogger("production-filter", false, nil)
 	if err != nil {
@@ -16,22 +22,14 @@ func main() {
 	}
 	slog.SetDefault(logger)
 
-	rabbitUser := os.Getenv("RABBITMQ_DEFAULT_USER")
-	rabbitPass := os.Getenv("RABBITMQ_DEFAULT_PASS")
-	joinerShards := os.Getenv("JOINER_SHARDS")
-
-	if rabbitUser == "" || rabbitPass == "" || joinerShards == "" {
-		slog.Error("environment validation failed", slog.String("error", "RABBITMQ_DEFAULT_USER and RABBITMQ_DEFAULT_PASS and JOINER_SHARDS must be set"))
-		return
-	}
-
-	shards, err := strconv.Atoi(joinerShards)
-	if err != nil {
-		slog.Error("error converting JOINER_SHARDS env var to int", slog.String("error", err.Error()))
+	var cfg ProductionFilterConfig
+	if err := config.Load(&cfg); err != nil {
+		slog.Error("configuration validation failed", slog.String("error", err.Error()))
 		return
 	}
+	config.Log(cfg)
 
-	filter, err := NewProductionFilter(rabbitUser, rabbitPass, shards)
+	filter, err := NewProductionFilter(cfg)
 	if err != nil {
 		slog.Error("error creating production filter", slog.String("error", err.Error()))
 		return
@@ -3,10 +3,14 @@ package main
 import (
 	"fmt"
 	"log/slog"
-	"os"
+	"pkg/config"
 	"pkg/log"
 )
 
+type ReducerConfig struct {
+	config.Node
+}
+
 func main() {
 	logger, err := log.SetupLogger("reducer", false, nil)
 	if err != nil {
@@ -15,20 +19,18 @@ func main() {
 	}
 	slog.SetDefault(logger)
 
-	rabbitUser := os.Getenv("RABBITMQ_DEFAULT_USER")
-	rabbitPass := os.Getenv("RABBITMQ_DEFAULT_PASS")
-
-	if rabbitUser == "" || rabbitPass == "" {
-		slog.Error("environment validation failed", slog.String("error", "RABBITMQ_DEFAULT_USER and RABBITMQ_DEFAULT_PASS must be set"))
+	var cfg ReducerConfig
+	if err := config.Load(&cfg); err != nil {
+		slog.Error("configuration validation failed", slog.String("error", err.Error()))
 		return
 	}
+	config.Log(cfg)
 
-	reducer, err := NewReducer(rabbitUser, rabbitPass)
+	reducer, err := NewReducer(cfg)
 	if err != nil {
 		slog.Error("error creating reducer", slog.String("error", err.Error()))
 		return
 	}
-	
 
 	reducer.Start()
 }
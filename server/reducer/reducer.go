@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	pkg "pkg/models"
 	"syscall"
+	"time"
 	"tp-sistemas-distribuidos/server/common"
 )
 
@@ -24,7 +25,6 @@ import (
 // }
 
 const (
-	rabbitHost      = "rabbitmq"
 	previousQueueQ2 = "q2-to-reduce"
 	nextQueueQ2     = "q2-to-final-reduce"
 	previousQueueQ3 = "q3-to-reduce"
@@ -37,6 +37,8 @@ const (
 
 type Reducer struct {
 	middleware       *common.Middleware
+	health           *common.HealthServer
+	drainTimeout     time.Duration
 	query2Connection connection
 	query3Connection connection
 	query4Connection connection
@@ -48,8 +50,8 @@ type connection struct {
 	ChanToSend chan<- []byte
 }
 
-func NewReducer(rabbitUser, rabbitPass string) (*Reducer, error) {
-	middleware, err := common.NewMiddleware(rabbitUser, rabbitPass, rabbitHost)
+func NewReducer(cfg ReducerConfig) (*Reducer, error) {
+	middleware, err := common.NewMiddleware(cfg.Node)
 	if err != nil {
 		return nil, fmt.Errorf("error creating middleware: %w", err)
 	}
@@ -76,6 +78,8 @@ func NewReducer(rabbitUser, rabbitPass string) (*Reducer, error) {
 
 	return &Reducer{
 		middleware:       middleware,
+		health:           common.NewHealthServer(cfg.Node, middleware),
+		drainTimeout:     cfg.DrainTimeout,
 		query2Connection: query2Connection,
 		query3Connection: query3Connection,
 		query4Connection: query4Connection,
@@ -102,16 +106,37 @@ func (r *Reducer) Start() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	r.startReceiving(ctx)
+	r.health.Start()
+	r.health.SetReady(true)
+
+	drainer := common.NewDrainer(ctx, r.middleware, r.drainTimeout)
+	r.startReceiving(drainer)
+	drainer.Finish()
 }
 
-func (r *Reducer) startReceiving(ctx context.Context) {
-	for {
+func (r *Reducer) startReceiving(drainer *common.Drainer) {
+	ticker := time.NewTicker(common.HealthTickInterval)
+	defer ticker.Stop()
+	query2Chan := r.query2Connection.ChanToRecv
+	query3Chan := r.query3Connection.ChanToRecv
+	query4Chan := r.query4Connection.ChanToRecv
+	query5Chan := r.query5Connection.ChanToRecv
+	for query2Chan != nil || query3Chan != nil || query4Chan != nil || query5Chan != nil {
 		select {
-		case <-ctx.Done():
-			slog.Info("received termination signal, stopping")
+		case <-drainer.Signal():
+			slog.Info("received termination signal, draining")
+			r.health.SetReady(false)
+			drainer.Start()
+		case <-drainer.Expired():
+			slog.Warn("drain timeout expired, stopping")
 			return
-		case msg := <-r.query2Connection.ChanToRecv:
+		case <-ticker.C:
+			r.health.Tick()
+		case msg, ok := <-query2Chan:
+			if !ok {
+				query2Chan = nil
+				continue
+			}
 			reduced, err := reduceMessage(msg, r.reduceQ2)
 			if err != nil {
 				slog.Error("error processing query2 message", slog.String("error", err.Error()))
@@ -120,10 +145,15 @@ func (r *Reducer) startReceiving(ctx context.Context) {
 					slog.Error("error sending response", slog.String("error", err.Error()))
 				}
 			}
+			common.CrashPoint(crashAfterPublishBeforeAck)
 			if err := msg.Ack(); err != nil {
 				slog.Error("error acknowledging query2 message", slog.String("error", err.Error()))
 			}
-		case msg := <-r.query3Connection.ChanToRecv:
+		case msg, ok := <-query3Chan:
+			if !ok {
+				query3Chan = nil
+				continue
+			}
 			reduced, err := reduceMessage(msg, r.reduceQ3)
 			if err != nil {
 				slog.Error("error processing query3 message", slog.String("error", err.Error()))
@@ -132,10 +162,15 @@ func (r *Reducer) startReceiving(ctx context.Context) {
 					slog.Error("error sending response", slog.String("error", err.Error()))
 				}
 			}
+			common.CrashPoint(crashAfterPublishBeforeAck)
 			if err := msg.Ack(); err != nil {
 				slog.Error("error acknowledging query3 message", slog.String("error", err.Error()))
 			}
-		case msg := <-r.query4Connection.ChanToRecv:
+		case msg, ok := <-query4Chan:
+			if !ok {
+				query4Chan = nil
+				continue
+			}
 			reduced, err := reduceMessage(msg, r.reduceQ4)
 			if err != nil {
 				slog.Error("error processing query4 message", slog.String("error", err.Error()))
@@ -144,10 +179,15 @@ func (r *Reducer) startReceiving(ctx context.Context) {
 					slog.Error("error sending response", slog.String("error", err.Error()))
 				}
 			}
+			common.CrashPoint(crashAfterPublishBeforeAck)
 			if err := msg.Ack(); err != nil {
 				slog.Error("error acknowledging query4 message", slog.String("error", err.Error()))
 			}
-		case msg := <-r.query5Connection.ChanToRecv:
+		case msg, ok := <-query5Chan:
+			if !ok {
+				query5Chan = nil
+				continue
+			}
 			reduced, err := reduceMessage(msg, r.reduceQ5)
 			if err != nil {
 				slog.Error("error processing query5 message", slog.String("error", err.Error()))
@@ -156,23 +196,30 @@ func (r *Reducer) startReceiving(ctx context.Context) {
 					slog.Error("error sending response", slog.String("error", err.Error()))
 				}
 			}
+			common.CrashPoint(crashAfterPublishBeforeAck)
 			if err := msg.Ack(); err != nil {
 				slog.Error("error acknowledging query5 message", slog.String("error", err.Error()))
 			}
 		}
 	}
+	slog.Info("reducer drained")
 }
 
+// crashAfterPublishBeforeAck leaves a reduced batch sent but its input unacked, so it is redelivered
+const crashAfterPublishBeforeAck = "reducer.after-publish-before-ack"
+
+// reduceMessage reduces a batch keeping its header. The replicas share the input, so none of them sees
+// every batch of a client: redeliveries are reduced again and dropped by the final reducer, which gets
+// them all
 func reduceMessage[T any, R any](msg common.Message, reduceFunc func(common.Batch[T]) (R, error)) (R, error) {
+	var zero R
 	var batch common.Batch[T]
 	if err := json.Unmarshal(msg.Body, &batch); err != nil {
-		var zero R
 		return zero, fmt.Errorf("error unmarshalling message: %w", err)
 	}
 
 	reduced, err := reduceFunc(batch)
 	if err != nil {
-		var zero R
 		return zero, fmt.Errorf("error reducing message: %w", err)
 	}
 
@@ -299,6 +346,9 @@ func (r *Reducer) reduceQ5(batch common.Batch[common.MovieWithSentiment]) (commo
 }
 
 func (r *Reducer) close() {
+	if err := r.health.Close(); err != nil {
+		slog.Error("error closing health server", slog.String("error", err.Error()))
+	}
 	if err := r.middleware.Close(); err != nil {
 		slog.Error("error closing middleware", slog.String("error", err.Error()))
 	}
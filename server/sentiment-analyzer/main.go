@@ -3,10 +3,15 @@ package main
 import (
 	"fmt"
 	"log/slog"
-	"os"
+	"pkg/config"
 	"pkg/log"
 )
 
+type AnalyzerConfig struct {
+	config.Node
+	config.Pool
+}
+
 func main() {
 	logger, err := log.SetupLogger("sentiment-analyzer", false, nil)
 	if err != nil {
@@ -15,15 +20,14 @@ func main() {
 	}
 	slog.SetDefault(logger)
 
-	rabbitUser := os.Getenv("RABBITMQ_DEFAULT_USER")
-	rabbitPass := os.Getenv("RABBITMQ_DEFAULT_PASS")
-
-	if rabbitUser == "" || rabbitPass == "" {
-		slog.Error("environment validation failed", slog.String("error", "RABBITMQ_DEFAULT_USER and RABBITMQ_DEFAULT_PASS must be set"))
+	var cfg AnalyzerConfig
+	if err := config.Load(&cfg); err != nil {
+		slog.Error("configuration validation failed", slog.String("error", err.Error()))
 		return
 	}
+	config.Log(cfg)
 
-	analyzer, err := NewAnalyzer(rabbitUser, rabbitPass)
+	analyzer, err := NewAnalyzer(cfg)
 	if err != nil {
 		slog.Error("error creating sentiment analyzer", slog.String("error", err.Error()))
 		return
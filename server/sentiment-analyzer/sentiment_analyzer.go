@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"os/signal"
 	"syscall"
+	"time"
 	"tp-sistemas-distribuidos/server/common"
 
 	cdipaoloSentiment "github.com/cdipaolo/sentiment"
@@ -14,17 +15,19 @@ import (
 
 const (
 	previousQueue = "sentiment-analyzer"
-	rabbitHost    = "rabbitmq"
 	nextQueue     = "q5-to-reduce"
 )
 
 type Analyzer struct {
-	middleware *common.Middleware
-	model      cdipaoloSentiment.Models
+	middleware   *common.Middleware
+	health       *common.HealthServer
+	drainTimeout time.Duration
+	pool         *common.WorkerPool
+	model        cdipaoloSentiment.Models
 }
 
-func NewAnalyzer(rabbitUser, rabbitPass string) (*Analyzer, error) {
-	middleware, err := common.NewMiddleware(rabbitUser, rabbitPass, rabbitHost)
+func NewAnalyzer(cfg AnalyzerConfig) (*Analyzer, error) {
+	middleware, err := common.NewMiddleware(cfg.Node)
 	if err != nil {
 		return nil, fmt.Errorf("error creating middleware: %w", err)
 	}
@@ -35,7 +38,13 @@ func NewAnalyzer(rabbitUser, rabbitPass string) (*Analyzer, error) {
 		return nil, fmt.Errorf("error restoring sentiment analyzer cdipaoloSentiment: %w", err)
 	}
 
-	return &Analyzer{middleware: middleware, model: model}, nil
+	return &Analyzer{
+		middleware:   middleware,
+		health:       common.NewHealthServer(cfg.Node, middleware),
+		drainTimeout: cfg.DrainTimeout,
+		pool:         common.NewWorkerPoolWithOrder(cfg.Workers, cfg.PerClientOrder, common.ClientIDOf),
+		model:        model,
+	}, nil
 }
 
 func (a *Analyzer) Start() {
@@ -45,6 +54,8 @@ func (a *Analyzer) Start() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	a.health.Start()
+
 	previousChan, err := a.middleware.GetChanToRecv(previousQueue)
 	if err != nil {
 		slog.Error("Error creating channel", slog.String("queue", previousQueue), slog.String("error", err.Error()))
@@ -57,23 +68,36 @@ func (a *Analyzer) Start() {
 		return
 	}
 
-	a.run(ctx, previousChan, nextChan)
+	a.health.SetReady(true)
+
+	drainer := common.NewDrainer(ctx, a.middleware, a.drainTimeout)
+	a.run(drainer, previousChan, nextChan)
+	drainer.Finish()
 }
 
-func (a *Analyzer) run(ctx context.Context, previousChan <-chan common.Message, nextChan chan<- []byte) {
+func (a *Analyzer) run(drainer *common.Drainer, previousChan <-chan common.Message, nextChan chan<- []byte) {
+	ticker := time.NewTicker(common.HealthTickInterval)
+	defer ticker.Stop()
+	done := a.pool.RunAll(common.Consumer{
+		Inbox: previousChan,
+		Handle: func(msg common.Message) error {
+			return a.processMessage(msg, nextChan)
+		},
+	})
 	for {
 		select {
-		case <-ctx.Done():
-			slog.Info("received termination signal, stopping sentiment analyzer")
+		case <-drainer.Signal():
+			slog.Info("received termination signal, draining sentiment analyzer")
+			a.health.SetReady(false)
+			drainer.Start()
+		case <-drainer.Expired():
+			slog.Warn("drain timeout expired, stopping sentiment analyzer")
+			return
+		case <-ticker.C:
+			a.health.Tick()
+		case <-done:
+			slog.Info("sentiment analyzer drained")
 			return
-		case msg := <-previousChan:
-			if err := a.processMessage(msg, nextChan); err != nil {
-				slog.Error("Error processing message", slog.String("error", err.Error()))
-				continue // TODO: ack?
-			}
-			if err := msg.Ack(); err != nil {
-				slog.Error("Error acknowledging message", slog.String("error", err.Error()))
-			}
 		}
 	}
 }
@@ -81,7 +105,7 @@ func (a *Analyzer) run(ctx context.Context, previousChan <-chan common.Message,
 func (a *Analyzer) processMessage(msg common.Message, nextChan chan<- []byte) error {
 	var batch common.Batch[common.Movie]
 	if err := json.Unmarshal(msg.Body, &batch); err != nil {
-		return fmt.Errorf("error unmarshalling message: %v", err)
+		return fmt.Errorf("%w: error unmarshalling message: %w", common.ErrUnprocessable, err)
 
 	}
 	slog.Debug("Received message", slog.String("message", string(msg.Body)))
@@ -119,6 +143,9 @@ func (a *Analyzer) calculateSentiment(movie common.Movie) common.Sentiment {
 }
 
 func (a *Analyzer) stop() {
+	if err := a.health.Close(); err != nil {
+		slog.Error("Error closing health server", slog.String("error", err.Error()))
+	}
 	err := a.middleware.Close()
 	if err != nil {
 		slog.Error("Error closing middleware", slog.String("error", err.Error()))
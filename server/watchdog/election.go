@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	electionMsg    = "election"
+	answerMsg      = "answer"
+	coordinatorMsg = "coordinator"
+	pingMsg        = "ping"
+
+	noLeader = 0
+)
+
+type electionMessage struct {
+	Type string `json:"type"`
+	From int    `json:"from"`
+}
+
+// Election runs the bully algorithm among the watchdog replicas. Every message is a request
+// and its reply over a short lived TCP connection. Followers ping the leader and start an
+// election when it does not answer, the replica with the highest alive id always wins.
+type Election struct {
+	id       int
+	peers    map[int]string
+	listener net.Listener
+	timeout  time.Duration
+
+	mu          sync.Mutex
+	leader      int
+	electing    bool
+	coordinated chan struct{}
+	closed      chan struct{}
+}
+
+// ParsePeers reads the replicas as id=host:port
+func ParsePeers(peers []string) (map[int]string, error) {
+	parsed := make(map[int]string, len(peers))
+	for _, peer := range peers {
+		idText, addr, ok := strings.Cut(peer, "=")
+		id, err := strconv.Atoi(idText)
+		if !ok || err != nil || id <= noLeader || addr == "" {
+			return nil, fmt.Errorf("invalid peer %q, expected id=host:port", peer)
+		}
+		parsed[id] = addr
+	}
+	return parsed, nil
+}
+
+func NewElection(id int, listenAddr string, peers map[int]string, timeout time.Duration) (*Election, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s: %w", listenAddr, err)
+	}
+	return newElection(id, listener, peers, timeout), nil
+}
+
+func newElection(id int, listener net.Listener, peers map[int]string, timeout time.Duration) *Election {
+	others := make(map[int]string, len(peers))
+	for peerID, addr := range peers {
+		if peerID != id {
+			others[peerID] = addr
+		}
+	}
+	return &Election{
+		id:          id,
+		peers:       others,
+		listener:    listener,
+		timeout:     timeout,
+		coordinated: make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+}
+
+// Start serves the other replicas, runs the first election and monitors the leader every interval
+func (e *Election) Start(interval time.Duration) {
+	go e.serve()
+	go e.Elect()
+	go e.monitor(interval)
+}
+
+func (e *Election) Leader() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+func (e *Election) IsLeader() bool {
+	return e.Leader() == e.id
+}
+
+// Elect asks the replicas with a higher id to take over, and becomes the leader if none of them answers
+func (e *Election) Elect() {
+	e.mu.Lock()
+	if e.electing {
+		e.mu.Unlock()
+		return
+	}
+	e.electing = true
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		e.electing = false
+		e.mu.Unlock()
+	}()
+
+	select {
+	case <-e.coordinated:
+	default:
+	}
+
+	answered := false
+	for peerID, addr := range e.peers {
+		if peerID < e.id {
+			continue
+		}
+		reply, err := e.send(addr, electionMsg)
+		if err == nil && reply.Type == answerMsg {
+			answered = true
+		}
+	}
+	if !answered {
+		e.becomeLeader()
+		return
+	}
+
+	select {
+	case <-e.coordinated:
+	case <-e.closed:
+	case <-time.After(e.timeout):
+		slog.Warn("no coordinator after election, retrying", slog.Int("id", e.id))
+		go e.Elect()
+	}
+}
+
+func (e *Election) becomeLeader() {
+	e.setLeader(e.id)
+	slog.Info("elected as leader", slog.Int("id", e.id))
+	for _, addr := range e.peers {
+		if _, err := e.send(addr, coordinatorMsg); err != nil {
+			slog.Debug("error announcing coordinator", slog.String("peer", addr), slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (e *Election) setLeader(leader int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leader != leader {
+		slog.Info("leader changed", slog.Int("id", e.id), slog.Int("leader", leader))
+	}
+	e.leader = leader
+}
+
+func (e *Election) monitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.closed:
+			return
+		case <-ticker.C:
+		}
+
+		leader := e.Leader()
+		if leader == e.id {
+			continue
+		}
+		addr, ok := e.peers[leader]
+		if !ok {
+			go e.Elect()
+			continue
+		}
+		if _, err := e.send(addr, pingMsg); err != nil {
+			slog.Warn("leader is not answering, starting election", slog.Int("leader", leader), slog.String("error", err.Error()))
+			e.setLeader(noLeader)
+			go e.Elect()
+		}
+	}
+}
+
+func (e *Election) serve() {
+	for {
+		conn, err := e.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("error accepting election connection", slog.String("error", err.Error()))
+			continue
+		}
+		go e.handle(conn)
+	}
+}
+
+func (e *Election) handle(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(e.timeout))
+
+	var msg electionMessage
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&msg); err != nil {
+		slog.Debug("error reading election message", slog.String("error", err.Error()))
+		return
+	}
+
+	switch msg.Type {
+	case electionMsg:
+		go e.Elect()
+	case coordinatorMsg:
+		e.setLeader(msg.From)
+		select {
+		case e.coordinated <- struct{}{}:
+		default:
+		}
+		// A lower replica took over while this one was down, the bully takes the leadership back
+		if msg.From < e.id {
+			go e.Elect()
+		}
+	}
+
+	if err := json.NewEncoder(conn).Encode(electionMessage{Type: answerMsg, From: e.id}); err != nil {
+		slog.Debug("error answering election message", slog.String("error", err.Error()))
+	}
+}
+
+func (e *Election) send(addr string, msgType string) (electionMessage, error) {
+	conn, err := net.DialTimeout("tcp", addr, e.timeout)
+	if err != nil {
+		return electionMessage{}, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(e.timeout))
+
+	if err := json.NewEncoder(conn).Encode(electionMessage{Type: msgType, From: e.id}); err != nil {
+		return electionMessage{}, err
+	}
+	var reply electionMessage
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&reply); err != nil {
+		return electionMessage{}, err
+	}
+	return reply, nil
+}
+
+func (e *Election) Close() error {
+	close(e.closed)
+	return e.listener.Close()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testInterval = 50 * time.Millisecond
+
+func startReplicas(t *testing.T, ids ...int) map[int]*Election {
+	listeners := make(map[int]net.Listener, len(ids))
+	peers := make(map[int]string, len(ids))
+	for _, id := range ids {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[id] = listener
+		peers[id] = listener.Addr().String()
+	}
+
+	replicas := make(map[int]*Election, len(ids))
+	for _, id := range ids {
+		replicas[id] = newElection(id, listeners[id], peers, 200*time.Millisecond)
+		replicas[id].Start(testInterval)
+	}
+	return replicas
+}
+
+func requireLeader(t *testing.T, replicas map[int]*Election, leader int) {
+	require.Eventually(t, func() bool {
+		for _, replica := range replicas {
+			if replica.Leader() != leader {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, testInterval)
+}
+
+func TestElectionFailsOverToTheNextReplica(t *testing.T) {
+	replicas := startReplicas(t, 1, 2, 3)
+	requireLeader(t, replicas, 3)
+
+	require.NoError(t, replicas[3].Close())
+	delete(replicas, 3)
+	requireLeader(t, replicas, 2)
+
+	for _, replica := range replicas {
+		require.NoError(t, replica.Close())
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := ParsePeers([]string{"1=watchdog-1:9100", "2=watchdog-2:9100"})
+	require.NoError(t, err)
+	require.Equal(t, map[int]string{1: "watchdog-1:9100", 2: "watchdog-2:9100"}, peers)
+
+	_, err = ParsePeers([]string{"watchdog-1:9100"})
+	require.Error(t, err)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"pkg/config"
+	"pkg/log"
+	"time"
+)
+
+type WatchdogConfig struct {
+	NodeID        string        `env:"NODE_ID" json:"node_id" default:"watchdog"`
+	ListenAddr    string        `env:"WATCHDOG_LISTEN" json:"watchdog_listen" default:":9000"`
+	Nodes         []string      `env:"WATCHED_NODES" json:"watched_nodes"`
+	Timeout       time.Duration `env:"HEARTBEAT_TIMEOUT" json:"heartbeat_timeout" default:"10s"`
+	CheckInterval time.Duration `env:"CHECK_INTERVAL" json:"check_interval" default:"2s"`
+	StartupGrace  time.Duration `env:"STARTUP_GRACE" json:"startup_grace" default:"30s"`
+	RestartAction string        `env:"RESTART_ACTION" json:"restart_action" default:"docker"`
+	DockerSocket  string        `env:"DOCKER_SOCKET" json:"docker_socket" default:"/var/run/docker.sock"`
+	// WatchdogAddrs are the heartbeat addresses of every replica, replicas revive each other as any other node
+	WatchdogAddrs   []string      `env:"WATCHDOG_ADDRS" json:"watchdog_addrs"`
+	WatchdogID      int           `env:"WATCHDOG_ID" json:"watchdog_id" default:"1" min:"1"`
+	ElectionAddr    string        `env:"ELECTION_LISTEN" json:"election_listen" default:":9100"`
+	ElectionTimeout time.Duration `env:"ELECTION_TIMEOUT" json:"election_timeout" default:"2s"`
+	// Peers are the election addresses of the replicas as id=host:port, without peers the watchdog always leads
+	Peers []string `env:"WATCHDOG_PEERS" json:"watchdog_peers"`
+	// RestartCommand is run by the exec action, {node} is replaced by the id of the dead node
+	RestartCommand []string `env:"RESTART_COMMAND" json:"restart_command"`
+}
+
+func main() {
+	logger, err := log.SetupLogger("watchdog", false, nil)
+	if err != nil {
+		fmt.Printf("error creating logger: %v", err)
+		return
+	}
+	slog.SetDefault(logger)
+
+	var cfg WatchdogConfig
+	if err := config.Load(&cfg); err != nil {
+		slog.Error("configuration validation failed", slog.String("error", err.Error()))
+		return
+	}
+	config.Log(cfg)
+
+	restarter, err := NewRestarter(cfg)
+	if err != nil {
+		slog.Error("error creating restart action", slog.String("error", err.Error()))
+		return
+	}
+
+	watchdog, err := NewWatchdog(cfg, restarter)
+	if err != nil {
+		slog.Error("error creating watchdog", slog.String("error", err.Error()))
+		return
+	}
+
+	watchdog.Start()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	dockerAction = "docker"
+	execAction   = "exec"
+
+	nodePlaceholder = "{node}"
+	dockerTimeout   = 30 * time.Second
+)
+
+// Restarter revives a node that stopped sending heartbeats
+type Restarter interface {
+	Restart(node string) error
+}
+
+func NewRestarter(cfg WatchdogConfig) (Restarter, error) {
+	switch cfg.RestartAction {
+	case dockerAction:
+		return NewDockerRestarter(cfg.DockerSocket), nil
+	case execAction:
+		if len(cfg.RestartCommand) == 0 {
+			return nil, fmt.Errorf("RESTART_COMMAND is required by the %s action", execAction)
+		}
+		return NewExecRestarter(cfg.RestartCommand), nil
+	default:
+		return nil, fmt.Errorf("unknown restart action %q", cfg.RestartAction)
+	}
+}
+
+// DockerRestarter does a `docker start <container>` through the Docker Engine API.
+// The container name is the node id, as set in the compose file
+type DockerRestarter struct {
+	client *http.Client
+}
+
+func NewDockerRestarter(socket string) *DockerRestarter {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &DockerRestarter{client: &http.Client{Transport: transport, Timeout: dockerTimeout}}
+}
+
+func (d *DockerRestarter) Restart(node string) error {
+	status, err := d.post("/containers/" + node + "/start")
+	if err != nil {
+		return err
+	}
+	// The container is still running but hung, so it is restarted instead
+	if status == http.StatusNotModified {
+		slog.Info("container is running, restarting it", slog.String("node", node))
+		status, err = d.post("/containers/" + node + "/restart")
+		if err != nil {
+			return err
+		}
+	}
+	if status != http.StatusNoContent {
+		return fmt.Errorf("docker answered %d for container %s", status, node)
+	}
+	return nil
+}
+
+func (d *DockerRestarter) post(path string) (int, error) {
+	// The host is ignored, the request goes through the unix socket
+	resp, err := d.client.Post("http://docker"+path, "application/json", nil)
+	if err != nil {
+		return 0, fmt.Errorf("error calling docker %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// ExecRestarter starts the node as a child process, to supervise nodes running locally
+type ExecRestarter struct {
+	command []string
+}
+
+func NewExecRestarter(command []string) *ExecRestarter {
+	return &ExecRestarter{command: command}
+}
+
+func (e *ExecRestarter) Restart(node string) error {
+	args := make([]string, len(e.command))
+	for i, arg := range e.command {
+		args[i] = strings.ReplaceAll(arg, nodePlaceholder, node)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting %s: %w", node, err)
+	}
+
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			slog.Warn("node process exited", slog.String("node", node), slog.String("error", err.Error()))
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"tp-sistemas-distribuidos/server/common"
+)
+
+const maxHeartbeatSize = 256
+
+// Watchdog receives the heartbeats of the nodes and restarts the ones that stop sending them.
+// Nodes listed in the config are watched from the start, any other node once its first heartbeat arrives.
+// Every replica tracks the heartbeats, but only the elected leader restarts nodes
+type Watchdog struct {
+	name          string
+	conn          net.PacketConn
+	election      *Election
+	heartbeat     *common.Heartbeater
+	restarter     Restarter
+	timeout       time.Duration
+	checkInterval time.Duration
+
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func NewWatchdog(cfg WatchdogConfig, restarter Restarter) (*Watchdog, error) {
+	conn, err := net.ListenPacket("udp", cfg.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s: %w", cfg.ListenAddr, err)
+	}
+
+	// Watched nodes get the startup grace to send their first heartbeat
+	firstDeadline := time.Now().Add(cfg.StartupGrace)
+	lastSeen := make(map[string]time.Time, len(cfg.Nodes))
+	for _, node := range cfg.Nodes {
+		if node != cfg.NodeID {
+			lastSeen[node] = firstDeadline
+		}
+	}
+
+	var election *Election
+	if len(cfg.Peers) > 0 {
+		peers, err := ParsePeers(cfg.Peers)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		election, err = NewElection(cfg.WatchdogID, cfg.ElectionAddr, peers, cfg.ElectionTimeout)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	return &Watchdog{
+		name:          cfg.NodeID,
+		conn:          conn,
+		election:      election,
+		heartbeat:     common.NewHeartbeater(cfg.WatchdogAddrs, cfg.NodeID),
+		restarter:     restarter,
+		timeout:       cfg.Timeout,
+		checkInterval: cfg.CheckInterval,
+		lastSeen:      lastSeen,
+	}, nil
+}
+
+func (w *Watchdog) Start() {
+	defer w.stop()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	go w.listen()
+	if w.election != nil {
+		w.election.Start(w.checkInterval)
+	}
+	slog.Info("watchdog started", slog.String("address", w.conn.LocalAddr().String()), slog.Int("nodes", len(w.lastSeen)))
+
+	ticker := time.NewTicker(w.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("received termination signal, stopping watchdog")
+			return
+		case now := <-ticker.C:
+			w.heartbeat.Beat()
+			w.check(now)
+		}
+	}
+}
+
+func (w *Watchdog) listen() {
+	buf := make([]byte, maxHeartbeatSize)
+	for {
+		n, _, err := w.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("error reading heartbeat", slog.String("error", err.Error()))
+			continue
+		}
+		w.heartbeatFrom(string(buf[:n]), time.Now())
+	}
+}
+
+func (w *Watchdog) isLeader() bool {
+	return w.election == nil || w.election.IsLeader()
+}
+
+func (w *Watchdog) heartbeatFrom(node string, now time.Time) {
+	if node == "" || node == w.name {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.lastSeen[node]; !ok {
+		slog.Info("watching new node", slog.String("node", node))
+	}
+	if now.After(w.lastSeen[node]) {
+		w.lastSeen[node] = now
+	}
+}
+
+// check restarts the nodes whose last heartbeat is older than the timeout.
+// A restarted node gets a full timeout to come back before it is declared dead again
+func (w *Watchdog) check(now time.Time) {
+	if !w.isLeader() {
+		return
+	}
+	for _, node := range w.deadNodes(now) {
+		slog.Warn("node is dead, restarting it", slog.String("node", node))
+		if err := w.restarter.Restart(node); err != nil {
+			slog.Error("error restarting node", slog.String("node", node), slog.String("error", err.Error()))
+		}
+
+		w.mu.Lock()
+		w.lastSeen[node] = time.Now()
+		w.mu.Unlock()
+	}
+}
+
+func (w *Watchdog) deadNodes(now time.Time) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var dead []string
+	for node, seen := range w.lastSeen {
+		if now.Sub(seen) > w.timeout {
+			dead = append(dead, node)
+		}
+	}
+	return dead
+}
+
+func (w *Watchdog) stop() {
+	_ = w.heartbeat.Close()
+	if w.election != nil {
+		if err := w.election.Close(); err != nil {
+			slog.Error("error closing election listener", slog.String("error", err.Error()))
+		}
+	}
+	if err := w.conn.Close(); err != nil {
+		slog.Error("error closing watchdog socket", slog.String("error", err.Error()))
+	}
+}
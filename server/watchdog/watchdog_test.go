@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"tp-sistemas-distribuidos/server/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRestarter struct {
+	mu        sync.Mutex
+	restarted []string
+}
+
+func (f *fakeRestarter) Restart(node string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.restarted = append(f.restarted, node)
+	return nil
+}
+
+func TestWatchdogRestartsSilentNodes(t *testing.T) {
+	restarter := &fakeRestarter{}
+	watchdog, err := NewWatchdog(WatchdogConfig{
+		ListenAddr: "127.0.0.1:0",
+		Nodes:      []string{"joiner-1", "final-reducer-q3"},
+		Timeout:    time.Second,
+	}, restarter)
+	require.NoError(t, err)
+	t.Cleanup(watchdog.stop)
+	go watchdog.listen()
+
+	// Only the joiner keeps beating
+	time.Sleep(600 * time.Millisecond)
+	heartbeater := common.NewHeartbeater([]string{watchdog.conn.LocalAddr().String()}, "joiner-1")
+	t.Cleanup(func() { _ = heartbeater.Close() })
+	beatAt := time.Now()
+	heartbeater.Beat()
+	require.Eventually(t, func() bool {
+		watchdog.mu.Lock()
+		defer watchdog.mu.Unlock()
+		return !watchdog.lastSeen["joiner-1"].Before(beatAt)
+	}, time.Second, 10*time.Millisecond)
+
+	watchdog.check(time.Now().Add(500 * time.Millisecond))
+	require.Equal(t, []string{"final-reducer-q3"}, restarter.restarted)
+
+	// The restarted node is not declared dead again right away
+	watchdog.check(time.Now().Add(500 * time.Millisecond))
+	require.Equal(t, []string{"final-reducer-q3"}, restarter.restarted)
+}
@@ -7,12 +7,12 @@ import (
 	"log/slog"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"tp-sistemas-distribuidos/server/common"
 )
 
 const (
-	rabbitHost              = "rabbitmq"
 	previousQueueQuery1     = "filter-year-q1"
 	previousQueueQuery3And4 = "filter-year-q3q4"
 	nextQueueQuery1         = "filter-production-q1"
@@ -21,6 +21,9 @@ const (
 
 type YearFilter struct {
 	middleware       *common.Middleware
+	health           *common.HealthServer
+	drainTimeout     time.Duration
+	pool             *common.WorkerPool
 	query1Connection connection
 	query3Connection connection
 }
@@ -30,8 +33,8 @@ type connection struct {
 	ChanToSend chan<- []byte
 }
 
-func NewYearFilter(rabbitUser, rabbitPass string) (*YearFilter, error) {
-	middleware, err := common.NewMiddleware(rabbitUser, rabbitPass, rabbitHost)
+func NewYearFilter(cfg YearFilterConfig) (*YearFilter, error) {
+	middleware, err := common.NewMiddleware(cfg.Node)
 	if err != nil {
 		return nil, fmt.Errorf("error creating middleware: %w", err)
 	}
@@ -46,7 +49,14 @@ func NewYearFilter(rabbitUser, rabbitPass string) (*YearFilter, error) {
 		return nil, fmt.Errorf("error initializing connections: %w", err)
 	}
 
-	return &YearFilter{middleware: middleware, query1Connection: query1Connection, query3Connection: query3And4Connection}, nil
+	return &YearFilter{
+		middleware:       middleware,
+		health:           common.NewHealthServer(cfg.Node, middleware),
+		drainTimeout:     cfg.DrainTimeout,
+		pool:             common.NewWorkerPoolWithOrder(cfg.Workers, cfg.PerClientOrder, common.ClientIDOf),
+		query1Connection: query1Connection,
+		query3Connection: query3And4Connection,
+	}, nil
 }
 
 func initializeConnection(middleware *common.Middleware, previousQueue string, nextQueue string) (connection, error) {
@@ -69,29 +79,51 @@ func (f *YearFilter) Start() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	f.start(ctx)
+	f.health.Start()
+	f.health.SetReady(true)
+
+	drainer := common.NewDrainer(ctx, f.middleware, f.drainTimeout)
+	f.start(drainer)
+	drainer.Finish()
 }
 
-func (f *YearFilter) start(ctx context.Context) {
+func (f *YearFilter) start(drainer *common.Drainer) {
+	ticker := time.NewTicker(common.HealthTickInterval)
+	defer ticker.Stop()
+	done := f.pool.RunAll(
+		common.Consumer{
+			Inbox: f.query1Connection.ChanToRecv,
+			Handle: func(msg common.Message) error {
+				if err := f.processQueryMessage(f.query1Connection.ChanToSend, msg, f.year2000sFilter); err != nil {
+					return fmt.Errorf("error processing q1 message: %w", err)
+				}
+				return nil
+			},
+		},
+		common.Consumer{
+			Inbox: f.query3Connection.ChanToRecv,
+			Handle: func(msg common.Message) error {
+				if err := f.processQueryMessage(f.query3Connection.ChanToSend, msg, f.yearAfter2000sFilter); err != nil {
+					return fmt.Errorf("error processing q3/q4 message: %w", err)
+				}
+				return nil
+			},
+		},
+	)
 	for {
 		select {
-		case <-ctx.Done():
-			slog.Info("received termination signal, stopping year filter")
+		case <-drainer.Signal():
+			slog.Info("received termination signal, draining year filter")
+			f.health.SetReady(false)
+			drainer.Start()
+		case <-drainer.Expired():
+			slog.Warn("drain timeout expired, stopping year filter")
+			return
+		case <-ticker.C:
+			f.health.Tick()
+		case <-done:
+			slog.Info("year filter drained")
 			return
-		case msg := <-f.query1Connection.ChanToRecv:
-			if err := f.processQueryMessage(f.query1Connection.ChanToSend, msg, f.year2000sFilter); err != nil {
-				slog.Error("error processing q1 message", slog.String("error", err.Error()))
-			}
-			if err := msg.Ack(); err != nil {
-				slog.Error("error acknowledging q1 message", slog.String("error", err.Error()))
-			}
-		case msg := <-f.query3Connection.ChanToRecv:
-			if err := f.processQueryMessage(f.query3Connection.ChanToSend, msg, f.yearAfter2000sFilter); err != nil {
-				slog.Error("error processing q3/q4 message", slog.String("error", err.Error()))
-			}
-			if err := msg.Ack(); err != nil {
-				slog.Error("error acknowledging q3/q4 message", slog.String("error", err.Error()))
-			}
 		}
 	}
 }
@@ -110,7 +142,7 @@ func (f *YearFilter) processQueryMessage(chanToSend chan<- []byte, msg common.Me
 func (f *YearFilter) filterMessage(msg common.Message, filterFunc func(common.Movie) bool) (common.Batch[common.Movie], error) {
 	var batch common.Batch[common.Movie]
 	if err := json.Unmarshal(msg.Body, &batch); err != nil {
-		return common.Batch[common.Movie]{}, fmt.Errorf("error unmarshalling message: %w", err)
+		return common.Batch[common.Movie]{}, fmt.Errorf("%w: error unmarshalling message: %w", common.ErrUnprocessable, err)
 	}
 
 	filteredMovies := batch.Data
@@ -140,6 +172,9 @@ func (f *YearFilter) yearAfter2000sFilter(movie common.Movie) bool {
 }
 
 func (f *YearFilter) stop() {
+	if err := f.health.Close(); err != nil {
+		slog.Error("error closing health server", slog.String("error", err.Error()))
+	}
 	if err := f.middleware.Close(); err != nil {
 		slog.Error("error closing middleware", slog.String("error", err.Error()))
 	}
@@ -3,10 +3,15 @@ package main
 import (
 	"fmt"
 	"log/slog"
-	"os"
+	"pkg/config"
 	"pkg/log"
 )
 
+type YearFilterConfig struct {
+	config.Node
+	config.Pool
+}
+
 func main() {
 	logger, err := log.SetupLogger("year-filter", false, nil)
 	if err != nil {
@@ -15,15 +20,14 @@ func main() {
 	}
 	slog.SetDefault(logger)
 
-	rabbitUser := os.Getenv("RABBITMQ_DEFAULT_USER")
-	rabbitPass := os.Getenv("RABBITMQ_DEFAULT_PASS")
-
-	if rabbitUser == "" || rabbitPass == "" {
-		slog.Error("environment validation failed", slog.String("error", "RABBITMQ_DEFAULT_USER and RABBITMQ_DEFAULT_PASS must be set"))
+	var cfg YearFilterConfig
+	if err := config.Load(&cfg); err != nil {
+		slog.Error("configuration validation failed", slog.String("error", err.Error()))
 		return
 	}
+	config.Log(cfg)
 
-	filter, err := NewYearFilter(rabbitUser, rabbitPass)
+	filter, err := NewYearFilter(cfg)
 	if err != nil {
 		slog.Error("error creating year filter", slog.String("error", err.Error()))
 		return